@@ -3,10 +3,14 @@ module github.com/your-username/iot-edge-gateway
 go 1.21
 
 require (
-    github.com/confluentinc/confluent-kafka-go v1.9.0 // indirect
-    github.com/eclipse/paho.mqtt.golang v1.3.5
-    github.com/spf13/viper v1.15.0
-    go.uber.org/zap v1.37.0
-    github.com/mattn/go-sqlite3 v1.14.13
-    github.com/prometheus/client_golang v1.14.0
+	github.com/confluentinc/confluent-kafka-go v1.9.0
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/klauspost/compress v1.17.11
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.13
+	github.com/mitchellh/mapstructure v1.5.0
+	github.com/prometheus/client_golang v1.14.0
+	github.com/spf13/viper v1.15.0
+	go.uber.org/zap v1.37.0
+	google.golang.org/protobuf v1.28.1
 )
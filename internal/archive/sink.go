@@ -0,0 +1,323 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+const (
+	// minPartSize is the smallest part S3 accepts, except for the last one.
+	minPartSize = 5 << 20
+
+	DefaultMaxFileBytes  = 32 << 20
+	DefaultMaxMessages   = 50000
+	DefaultMaxAge        = 15 * time.Minute
+	DefaultPartSize      = 8 << 20
+	DefaultUploadTimeout = 5 * time.Minute
+)
+
+// Config configures a Sink.
+type Config struct {
+	// Endpoint is the store's URL, e.g. http://minio:9000 or
+	// https://s3.eu-west-1.amazonaws.com.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to object keys, which are partitioned by the hour
+	// the first message of the file was buffered:
+	// <prefix>YYYY/MM/DD/HH/<time>-<first id>.ndjson.gz
+	Prefix string
+	// SpoolDir holds finalized files and their upload state until the upload
+	// is confirmed, so interrupted uploads resume where they stopped.
+	SpoolDir string
+	// A file is finalized once its uncompressed size reaches MaxFileBytes,
+	// it holds MaxMessages messages or its oldest message is MaxAge old.
+	MaxFileBytes  int64
+	MaxMessages   int
+	MaxAge        time.Duration
+	PartSize      int64
+	UploadTimeout time.Duration
+}
+
+// Sink archives buffered messages as gzip compressed NDJSON files in
+// S3-compatible object storage. Messages stay pending in the buffer until the
+// file holding them has been uploaded, so the forwarder acknowledges them
+// only after the store confirmed the object. Files larger than one part are
+// uploaded with multipart uploads whose progress is kept in the spool
+// directory, so a failed or interrupted upload continues with the missing
+// parts.
+type Sink struct {
+	cfg Config
+	s3  *s3Client
+	now func() time.Time
+}
+
+// spoolState is the upload progress of a finalized file.
+type spoolState struct {
+	Key      string          `json:"key"`
+	FirstID  int64           `json:"first_id"`
+	LastID   int64           `json:"last_id"`
+	Count    int             `json:"count"`
+	UploadID string          `json:"upload_id,omitempty"`
+	Parts    []completedPart `json:"parts,omitempty"`
+}
+
+// New validates cfg and creates the sink.
+func New(cfg Config) (*Sink, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("endpoint and bucket required")
+	}
+	if cfg.SpoolDir == "" {
+		cfg.SpoolDir = "./data/archive"
+	}
+	if cfg.MaxFileBytes <= 0 {
+		cfg.MaxFileBytes = DefaultMaxFileBytes
+	}
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = DefaultMaxMessages
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.PartSize < minPartSize {
+		return nil, fmt.Errorf("part size must be at least %d bytes", minPartSize)
+	}
+	if cfg.UploadTimeout <= 0 {
+		cfg.UploadTimeout = DefaultUploadTimeout
+	}
+	if err := os.MkdirAll(cfg.SpoolDir, 0o755); err != nil {
+		return nil, err
+	}
+	c, err := newS3Client(cfg.Endpoint, cfg.Region, cfg.Bucket, cfg.AccessKey, cfg.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{cfg: cfg, s3: c, now: time.Now}, nil
+}
+
+func (s *Sink) BatchSize() int {
+	return s.cfg.MaxMessages
+}
+
+// Take returns the number of messages in the next file: the messages of a
+// file that is still being uploaded, or as many as fit the thresholds once
+// one of them is reached.
+func (s *Sink) Take(msgs []plugin.Message) int {
+	if len(msgs) == 0 {
+		return 0
+	}
+	if st, err := s.loadState(msgs[0].ID); err == nil {
+		return st.Count
+	}
+	var size int64
+	for i, m := range msgs {
+		size += int64(len(m.Payload)) + 1
+		if size >= s.cfg.MaxFileBytes || i+1 >= s.cfg.MaxMessages {
+			return i + 1
+		}
+	}
+	if s.now().Sub(msgs[0].Time) >= s.cfg.MaxAge {
+		return len(msgs)
+	}
+	return 0
+}
+
+// Produce archives a single payload in its own file.
+func (s *Sink) Produce(payload []byte, timeout time.Duration) error {
+	now := s.now()
+	return s.ProduceBatch([]plugin.Message{{ID: now.UnixNano(), Payload: payload, Time: now}}, timeout)
+}
+
+// ProduceBatch writes msgs to one file and uploads it. The forwarder's
+// timeout is replaced by the configured upload timeout, as files are large.
+func (s *Sink) ProduceBatch(msgs []plugin.Message, timeout time.Duration) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	first, last := msgs[0], msgs[len(msgs)-1]
+	st, err := s.loadState(first.ID)
+	if err != nil || st.LastID != last.ID || st.Count != len(msgs) {
+		// no spooled file for exactly these messages: finalize a new one
+		st, err = s.spool(msgs)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(s.dataPath(first.ID))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.UploadTimeout)
+	defer cancel()
+	if int64(len(data)) <= s.cfg.PartSize {
+		err = s.s3.putObject(ctx, st.Key, data)
+	} else {
+		err = s.uploadMultipart(ctx, st, data)
+	}
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", st.Key, err)
+	}
+	_ = os.Remove(s.dataPath(first.ID))
+	_ = os.Remove(s.statePath(first.ID))
+	return nil
+}
+
+func (s *Sink) Close() {
+	s.s3.http.CloseIdleConnections()
+}
+
+// uploadMultipart uploads the parts of data that are not recorded in st yet
+// and completes the upload, saving progress after every part.
+func (s *Sink) uploadMultipart(ctx context.Context, st *spoolState, data []byte) error {
+	if st.UploadID == "" {
+		id, err := s.s3.createMultipart(ctx, st.Key)
+		if err != nil {
+			return err
+		}
+		st.UploadID = id
+		st.Parts = nil
+		if err := s.saveState(st); err != nil {
+			return err
+		}
+	}
+	done := make(map[int]bool, len(st.Parts))
+	for _, p := range st.Parts {
+		done[p.Number] = true
+	}
+	for off, n := int64(0), 1; off < int64(len(data)); off, n = off+s.cfg.PartSize, n+1 {
+		if done[n] {
+			continue
+		}
+		end := off + s.cfg.PartSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		etag, err := s.s3.uploadPart(ctx, st.Key, st.UploadID, n, data[off:end])
+		if errors.Is(err, errNoSuchUpload) {
+			return s.restart(st, err)
+		}
+		if err != nil {
+			return err
+		}
+		st.Parts = append(st.Parts, completedPart{Number: n, ETag: etag})
+		if err := s.saveState(st); err != nil {
+			return err
+		}
+	}
+	err := s.s3.completeMultipart(ctx, st.Key, st.UploadID, st.Parts)
+	if errors.Is(err, errNoSuchUpload) {
+		return s.restart(st, err)
+	}
+	return err
+}
+
+// restart forgets an upload the server no longer knows, so the next attempt
+// starts a new one.
+func (s *Sink) restart(st *spoolState, err error) error {
+	st.UploadID = ""
+	st.Parts = nil
+	if serr := s.saveState(st); serr != nil {
+		return serr
+	}
+	return err
+}
+
+// spool writes msgs as a gzip compressed NDJSON file to the spool directory
+// and records its upload state.
+func (s *Sink) spool(msgs []plugin.Message) (*spoolState, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, m := range msgs {
+		line := m.Payload
+		if json.Valid(line) {
+			var cb bytes.Buffer
+			if err := json.Compact(&cb, line); err != nil {
+				return nil, err
+			}
+			line = cb.Bytes()
+		} else {
+			b, err := json.Marshal(string(line))
+			if err != nil {
+				return nil, err
+			}
+			line = b
+		}
+		zw.Write(line)
+		zw.Write([]byte{'\n'})
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	first := msgs[0]
+	ts := first.Time.UTC()
+	st := &spoolState{
+		Key:     s.cfg.Prefix + ts.Format("2006/01/02/15/") + ts.Format("20060102T150405Z") + "-" + strconv.FormatInt(first.ID, 10) + ".ndjson.gz",
+		FirstID: first.ID,
+		LastID:  msgs[len(msgs)-1].ID,
+		Count:   len(msgs),
+	}
+	if err := writeFile(s.dataPath(first.ID), buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := s.saveState(st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Sink) dataPath(firstID int64) string {
+	return filepath.Join(s.cfg.SpoolDir, strconv.FormatInt(firstID, 10)+".ndjson.gz")
+}
+
+func (s *Sink) statePath(firstID int64) string {
+	return filepath.Join(s.cfg.SpoolDir, strconv.FormatInt(firstID, 10)+".json")
+}
+
+func (s *Sink) loadState(firstID int64) (*spoolState, error) {
+	b, err := os.ReadFile(s.statePath(firstID))
+	if err != nil {
+		return nil, err
+	}
+	var st spoolState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(s.dataPath(firstID)); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *Sink) saveState(st *spoolState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.statePath(st.FirstID), b)
+}
+
+// writeFile replaces path atomically.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,171 @@
+// Package backoff spaces out retries of a failing operation: delays grow
+// exponentially up to a cap and are randomized, so that gateways retrying
+// against the same broker after an outage do not all come back at once.
+package backoff
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Settings of DefaultPolicy.
+const (
+	DefaultInitial    = 500 * time.Millisecond
+	DefaultMultiplier = 2.0
+	DefaultMax        = time.Minute
+	DefaultJitter     = 0.2
+)
+
+// Policy describes how long to wait between retries.
+type Policy struct {
+	// Initial is the delay after the first failure.
+	Initial time.Duration
+	// Multiplier grows the delay after each further failure.
+	Multiplier float64
+	// Max caps the delay.
+	Max time.Duration
+	// Jitter randomizes each delay by up to this fraction of it in either
+	// direction, from 0 (none) to 1.
+	Jitter float64
+	// MaxElapsed limits how long one operation is retried before it is given
+	// up for now; zero means the number of retries alone limits it.
+	MaxElapsed time.Duration
+}
+
+// DefaultPolicy returns the policy used when none is configured.
+func DefaultPolicy() Policy {
+	return Policy{Initial: DefaultInitial, Multiplier: DefaultMultiplier, Max: DefaultMax, Jitter: DefaultJitter}
+}
+
+// Validate reports settings that make no sense.
+func (p Policy) Validate() error {
+	switch {
+	case p.Initial <= 0:
+		return fmt.Errorf("initial delay must be positive")
+	case p.Multiplier < 1:
+		return fmt.Errorf("multiplier must be at least 1")
+	case p.Max < p.Initial:
+		return fmt.Errorf("max delay %v is below the initial delay %v", p.Max, p.Initial)
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("jitter must be between 0 and 1")
+	case p.MaxElapsed < 0:
+		return fmt.Errorf("max elapsed must not be negative")
+	}
+	return nil
+}
+
+// Delay returns the delay after n consecutive failures, without jitter.
+func (p Policy) Delay(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	d := float64(p.Initial) * math.Pow(p.Multiplier, float64(n-1))
+	if d >= float64(p.Max) {
+		return p.Max
+	}
+	return time.Duration(d)
+}
+
+// Backoff tracks the consecutive failures of an operation, such as delivering
+// to one sink, so that the delays keep growing across separate attempts until
+// one succeeds. It is safe for concurrent use.
+type Backoff struct {
+	policy Policy
+
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+	rand     *rand.Rand
+}
+
+// New returns a Backoff following p. Invalid settings are replaced by the
+// defaults.
+func New(p Policy) *Backoff {
+	def := DefaultPolicy()
+	if p.Initial <= 0 {
+		p.Initial = def.Initial
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = def.Multiplier
+	}
+	if p.Max < p.Initial {
+		p.Max = def.Max
+		if p.Max < p.Initial {
+			p.Max = p.Initial
+		}
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	} else if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+	return &Backoff{policy: p, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Policy returns the policy b follows.
+func (b *Backoff) Policy() Policy {
+	return b.policy
+}
+
+// Failure records a failure and returns how long to wait before the next
+// attempt: the policy's delay with jitter, or min if that is longer, e.g.
+// because the other side asked for it.
+func (b *Backoff) Failure(min time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	d := b.policy.Delay(b.failures)
+	if j := b.policy.Jitter; j > 0 {
+		d = time.Duration(float64(d) * (1 + j*(2*b.rand.Float64()-1)))
+	}
+	if d < min {
+		d = min
+	}
+	if until := time.Now().Add(d); until.After(b.until) {
+		b.until = until
+	}
+	return d
+}
+
+// Success resets b after the operation succeeded.
+func (b *Backoff) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.until = time.Time{}
+}
+
+// Failures returns the number of consecutive failures.
+func (b *Backoff) Failures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures
+}
+
+// Remaining returns how long until the next attempt is due after the last
+// failure, or zero.
+func (b *Backoff) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := time.Until(b.until); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Sleep waits for d or until ctx is done, in which case it returns the
+// context's error.
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
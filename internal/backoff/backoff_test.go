@@ -0,0 +1,73 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	p := Policy{Initial: 100 * time.Millisecond, Multiplier: 2, Max: time.Second}
+	want := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for n, w := range want {
+		if d := p.Delay(n); d != w {
+			t.Fatalf("Delay(%d) = %v, want %v", n, d, w)
+		}
+	}
+	if d := p.Delay(10000); d != time.Second {
+		t.Fatalf("Delay(10000) = %v, want the cap", d)
+	}
+}
+
+func TestBackoffJitterAndReset(t *testing.T) {
+	b := New(Policy{Initial: 100 * time.Millisecond, Multiplier: 2, Max: time.Second, Jitter: 0.5})
+	for i := 1; i <= 6; i++ {
+		d := b.Failure(0)
+		base := b.Policy().Delay(i)
+		if d < base/2 || d > base*3/2 {
+			t.Fatalf("failure %d: delay %v outside %v ±50%%", i, d, base)
+		}
+	}
+	if b.Failures() != 6 || b.Remaining() <= 0 {
+		t.Fatalf("Failures = %d, Remaining = %v", b.Failures(), b.Remaining())
+	}
+	if d := b.Failure(time.Hour); d != time.Hour || b.Remaining() < 59*time.Minute {
+		t.Fatalf("Failure(1h) = %v, Remaining = %v; want the requested delay", d, b.Remaining())
+	}
+	b.Success()
+	if b.Failures() != 0 || b.Remaining() != 0 {
+		t.Fatalf("after Success: Failures = %d, Remaining = %v", b.Failures(), b.Remaining())
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	if err := DefaultPolicy().Validate(); err != nil {
+		t.Fatalf("default policy: %v", err)
+	}
+	bad := []Policy{
+		{Initial: 0, Multiplier: 2, Max: time.Second},
+		{Initial: time.Second, Multiplier: 0.5, Max: time.Second},
+		{Initial: time.Second, Multiplier: 2, Max: time.Millisecond},
+		{Initial: time.Second, Multiplier: 2, Max: time.Second, Jitter: 2},
+	}
+	for _, p := range bad {
+		if p.Validate() == nil {
+			t.Fatalf("Validate(%+v) = nil", p)
+		}
+	}
+}
+
+func TestSleepHonorsContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := Sleep(ctx, time.Minute); err != context.Canceled {
+		t.Fatalf("Sleep = %v, want context.Canceled", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Sleep did not return when the context was cancelled")
+	}
+	if err := Sleep(context.Background(), time.Millisecond); err != nil {
+		t.Fatalf("Sleep = %v", err)
+	}
+}
@@ -1,27 +1,90 @@
 package buffer
 
 import (
+	"crypto/cipher"
 	"database/sql"
 	"errors"
+	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Message struct {
-	ID        int64
+	ID int64
+	// Topic is the topic the message was submitted under, after processing.
+	// It is empty for messages buffered before topics were recorded.
+	Topic     string
 	Payload   []byte
 	CreatedAt time.Time
 	Sent      bool
+	// Priority orders delivery: higher priorities are fetched first. Only
+	// Store and Hybrid keep it; SegmentLog delivers strictly by id.
+	Priority int
 }
 
+// Buffer is the persistent queue between inputs and outputs. Messages are
+// delivered to each sink registered with SetSinks independently and become
+// sent once every sink has acknowledged them. Store keeps the buffer in
+// SQLite, SegmentLog in append-only segment files.
+type Buffer interface {
+	Enqueue(payload []byte) (int64, error)
+	EnqueueTopic(topic string, payload []byte) (int64, error)
+	// EnqueueBatch buffers the Topic, Payload, Priority and CreatedAt (zero
+	// means now) of each message and returns their ids in order. Either all
+	// messages are buffered or none are.
+	EnqueueBatch(msgs []Message) ([]int64, error)
+	SetSinks(names []string) error
+	FetchUnsent(limit int) ([]Message, error)
+	FetchPending(sink string, limit int) ([]Message, error)
+	CountUnsent() (int, error)
+	CountPending(sink string) (int, error)
+	PendingBytes() (int64, error)
+	MarkSent(ids []int64) error
+	Ack(sink string, ids []int64) error
+	PurgeSent() (int64, error)
+	Close() error
+}
+
+var (
+	_ Buffer = (*Store)(nil)
+	_ Buffer = (*SegmentLog)(nil)
+)
+
+// Store is the SQLite Buffer.
 type Store struct {
-	db *sql.DB
+	db    *sql.DB
+	codec string
+	// compacted is the id up to which Compact has handled all rows
+	compacted int64
+
+	// encryption, see SetKeyring
+	aeads            map[string]cipher.AEAD
+	current          string
+	plainUntil       int64
+	plainBlocksUntil int64
+
+	// group commit, see writer
+	writes      chan *writeReq
+	stop        chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	groupWindow atomic.Int64
+
+	// recovery is set when Init recovered the store from a corrupt database
+	recovery *Recovery
+
+	leases
 }
 
-// Init opens/creates the sqlite DB and ensures schema exists.
+// Init opens/creates the sqlite DB and ensures schema exists. A database
+// that fails its integrity check is set aside and what can still be read from
+// it is copied into a fresh one, see Recovery.
 func Init(path string) (*Store, error) {
 	if path == "" {
 		return nil, errors.New("buffer path is empty")
@@ -32,8 +95,20 @@ func Init(path string) (*Store, error) {
 			return nil, err
 		}
 	}
+	problem, err := checkIntegrity(path)
+	if err != nil {
+		return nil, err
+	}
+	if problem != "" {
+		return recoverStore(path, problem)
+	}
+	return openStore(path)
+}
 
-	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_foreign_keys=1")
+// openStore opens the database at path and brings its schema up to date.
+func openStore(path string) (*Store, error) {
+	// busy_timeout lets forwarders for different sinks write concurrently
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_foreign_keys=1&_busy_timeout=5000")
 	if err != nil {
 		return nil, err
 	}
@@ -43,70 +118,495 @@ func Init(path string) (*Store, error) {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		payload BLOB NOT NULL,
 		created_at INTEGER NOT NULL,
-		sent INTEGER NOT NULL DEFAULT 0
+		sent INTEGER NOT NULL DEFAULT 0,
+		topic TEXT NOT NULL DEFAULT '',
+		codec TEXT NOT NULL DEFAULT '',
+		block_id INTEGER NOT NULL DEFAULT 0,
+		key_id TEXT NOT NULL DEFAULT ''
 	);
 	CREATE INDEX IF NOT EXISTS idx_messages_sent ON messages(sent);
+	CREATE TABLE IF NOT EXISTS blocks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		codec TEXT NOT NULL,
+		data BLOB NOT NULL,
+		key_id TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS quarantine (
+		message_id INTEGER PRIMARY KEY,
+		topic TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		codec TEXT NOT NULL,
+		key_id TEXT NOT NULL,
+		block_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		quarantined_at INTEGER NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS sinks (
+		name TEXT PRIMARY KEY
+	);
+	CREATE TABLE IF NOT EXISTS pending (
+		sink TEXT NOT NULL,
+		message_id INTEGER NOT NULL,
+		PRIMARY KEY (sink, message_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_pending_message ON pending(message_id);
 	`
 	if _, err := db.Exec(create); err != nil {
 		db.Close()
 		return nil, err
 	}
+	// buffers created by earlier versions lack newer columns
+	if err := addColumn(db, "messages", "topic", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "messages", "codec", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "messages", "block_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "messages", "key_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "blocks", "key_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "messages", "priority", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addColumn(db, "pending", "priority", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_block ON messages(block_id);
+		CREATE INDEX IF NOT EXISTS idx_messages_priority ON messages(sent, priority DESC, id);
+		CREATE INDEX IF NOT EXISTS idx_pending_priority ON pending(sink, priority DESC, message_id)`); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	return &Store{db: db}, nil
+	s := &Store{
+		db:     db,
+		writes: make(chan *writeReq),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	s.groupWindow.Store(int64(DefaultGroupWindow))
+	s.leases.fetch = s.FetchPending
+	go s.writer()
+	return s, nil
+}
+
+// addColumn adds a column to an existing table unless it is already present.
+func addColumn(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+// SetCodec makes the store compress payloads written from now on with codec
+// (CodecZstd or CodecSnappy; CodecNone turns compression off). Payloads of
+// at least rowCompressSize bytes are compressed when enqueued; smaller ones
+// are packed into compressed blocks by Compact. Each row records its codec, so
+// rows written with different settings, including uncompressed rows from
+// earlier versions, stay readable. Payloads are decompressed when fetched, and
+// the size limits apply to the compressed size.
+func (s *Store) SetCodec(codec string) error {
+	if !validCodec(codec) {
+		return fmt.Errorf("unknown codec %q", codec)
+	}
+	s.codec = codec
+	return nil
+}
+
+// Codec returns the codec new payloads are compressed with, CodecNone when
+// compression is off.
+func (s *Store) Codec() string {
+	return s.codec
+}
+
+// Compact compresses unsent messages that were stored uncompressed: small
+// payloads are packed into blocks of blockMessages messages, larger ones are
+// compressed on their own. This migrates buffers written without compression
+// and shrinks a buffer that fills up during an outage. It examines up to limit
+// rows and returns how many it rewrote; callers repeat it until it returns 0.
+// Small messages are only packed once a block is full. It must not be called
+// concurrently.
+func (s *Store) Compact(limit int) (int, error) {
+	if s == nil || s.db == nil {
+		return 0, errors.New("store not initialized")
+	}
+	if s.codec == CodecNone {
+		return 0, nil
+	}
+	rows, err := s.db.Query("SELECT id, topic, payload, created_at, key_id FROM messages WHERE sent=0 AND codec='' AND block_id=0 AND id > ? ORDER BY id LIMIT ?", s.compacted, limit)
+	if err != nil {
+		return 0, err
+	}
+	var large, small []blockEntry
+	bad := make(map[int64]string)
+	last := s.compacted
+	for rows.Next() {
+		var e blockEntry
+		var keyID string
+		if err := rows.Scan(&e.id, &e.topic, &e.payload, &e.created, &keyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		last = e.id
+		if e.payload, err = s.open(keyID, e.payload, rowAAD(e.id, e.topic, CodecNone, e.created), e.id, s.plainUntil); err != nil {
+			bad[e.id] = err.Error()
+			continue
+		}
+		if len(e.payload) >= rowCompressSize {
+			large = append(large, e)
+		} else {
+			small = append(small, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := s.quarantine(bad); err != nil {
+		return 0, err
+	}
+	// the last partial block waits for more messages; the next call starts at
+	// its first message
+	if rest := len(small) % blockMessages; rest > 0 {
+		last = small[len(small)-rest].id - 1
+		small = small[:len(small)-rest]
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range large {
+		data, codec := encode(s.codec, e.payload)
+		if codec == CodecNone {
+			continue
+		}
+		data, keyID, err := s.seal(data, rowAAD(e.id, e.topic, codec, e.created))
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE messages SET payload = ?, codec = ?, key_id = ? WHERE id = ? AND codec=''", data, codec, keyID, e.id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n++
+	}
+	for i := 0; i < len(small); i += blockMessages {
+		entries := small[i : i+blockMessages]
+		data, keyID, err := s.seal(encodeBlock(s.codec, entries), blockAAD(s.codec))
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		res, err := tx.Exec("INSERT INTO blocks(codec, data, key_id) VALUES (?, ?, ?)", s.codec, data, keyID)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		block, err := res.LastInsertId()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		for _, e := range entries {
+			if _, err := tx.Exec("UPDATE messages SET payload = x'', codec = ?, key_id = '', block_id = ? WHERE id = ? AND codec=''", s.codec, block, e.id); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		n += len(entries)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.compacted = last
+	return n, nil
 }
 
 func (s *Store) Close() error {
 	if s == nil || s.db == nil {
 		return nil
 	}
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
 	return s.db.Close()
 }
 
-// Enqueue stores a payload on disk for later forwarding.
+// Enqueue stores a payload on disk for later forwarding. The message is
+// marked pending for every sink registered with SetSinks.
 func (s *Store) Enqueue(payload []byte) (int64, error) {
+	return s.EnqueueTopic("", payload)
+}
+
+// EnqueueTopic is like Enqueue and records the topic the payload was
+// submitted under, so sinks can route on it.
+func (s *Store) EnqueueTopic(topic string, payload []byte) (int64, error) {
+	ids, err := s.write([]Message{{Topic: topic, Payload: payload}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// EnqueueBatch buffers msgs in one transaction.
+func (s *Store) EnqueueBatch(msgs []Message) ([]int64, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	batch := make([]Message, len(msgs))
+	for i, m := range msgs {
+		batch[i] = Message{Topic: m.Topic, Payload: m.Payload, CreatedAt: m.CreatedAt, Priority: m.Priority}
+	}
+	return s.write(batch)
+}
+
+// enqueueAt buffers messages under the ids and creation times chosen by the
+// caller; the ids must not be in use.
+func (s *Store) enqueueAt(msgs []Message) error {
+	_, err := s.write(msgs)
+	return err
+}
+
+// lastID returns the highest id handed out or reserved so far.
+func (s *Store) lastID() (int64, error) {
+	var id int64
+	err := s.db.QueryRow("SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'messages'), 0)").Scan(&id)
+	return id, err
+}
+
+// reserveIDs keeps EnqueueTopic from handing out ids up to id, which the
+// caller assigns itself.
+func (s *Store) reserveIDs(id int64) error {
+	res, err := s.db.Exec("UPDATE sqlite_sequence SET seq = ? WHERE name = 'messages' AND seq < ?", id, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = s.db.Exec(`INSERT INTO sqlite_sequence(name, seq)
+		SELECT 'messages', ? WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'messages')`, id)
+	return err
+}
+
+// SetSinks registers the sinks that messages are delivered to. Each sink
+// tracks its own pending messages, so a slow or unreachable sink does not hold
+// back the others. A newly added sink receives every message that is still
+// unsent; pending messages of removed sinks are dropped. Messages become sent
+// once every sink has acknowledged them.
+//
+// With no sinks registered the store falls back to the single sent flag
+// (FetchUnsent / MarkSent).
+func (s *Store) SetSinks(names []string) error {
 	if s == nil || s.db == nil {
-		return 0, errors.New("store not initialized")
+		return errors.New("store not initialized")
+	}
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		if n == "" {
+			return errors.New("sink name is empty")
+		}
+		want[n] = true
 	}
-	stmt, err := s.db.Prepare("INSERT INTO messages(payload, created_at, sent) VALUES (?, ?, 0)")
+	tx, err := s.db.Begin()
 	if err != nil {
-		return 0, err
+		return err
 	}
-	defer stmt.Close()
-	res, err := stmt.Exec(payload, time.Now().Unix())
+	rows, err := tx.Query("SELECT name FROM sinks")
 	if err != nil {
-		return 0, err
+		tx.Rollback()
+		return err
+	}
+	have := make(map[string]bool)
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		have[n] = true
+	}
+	rows.Close()
+
+	for n := range have {
+		if want[n] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM sinks WHERE name = ?", n); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM pending WHERE sink = ?", n); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for n := range want {
+		if have[n] {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO sinks(name) VALUES (?)", n); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO pending(sink, message_id, priority) SELECT ?, id, priority FROM messages WHERE sent=0", n); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if len(want) > 0 {
+		// messages that were only waiting for a removed sink are done
+		if _, err := tx.Exec("UPDATE messages SET sent=1 WHERE sent=0 AND NOT EXISTS (SELECT 1 FROM pending WHERE message_id = messages.id)"); err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-	return res.LastInsertId()
+	return tx.Commit()
 }
 
-// FetchUnsent returns up to limit unsent messages ordered by id.
+// FetchUnsent returns up to limit unsent messages, highest priority first and
+// then by id.
 func (s *Store) FetchUnsent(limit int) ([]Message, error) {
+	return s.fetchBefore("", math.MaxInt64, limit)
+}
+
+// FetchPending returns up to limit messages not yet acknowledged by sink,
+// highest priority first and then by id. An empty sink name is the same as
+// FetchUnsent.
+func (s *Store) FetchPending(sink string, limit int) ([]Message, error) {
+	return s.fetchBefore(sink, math.MaxInt64, limit)
+}
+
+// fetchBefore is FetchPending limited to messages with an id below before.
+func (s *Store) fetchBefore(sink string, before int64, limit int) ([]Message, error) {
 	if s == nil || s.db == nil {
 		return nil, errors.New("store not initialized")
 	}
 	if limit <= 0 {
 		limit = 50
 	}
-	rows, err := s.db.Query("SELECT id, payload, created_at, sent FROM messages WHERE sent=0 ORDER BY id LIMIT ?", limit)
+	var rows *sql.Rows
+	var err error
+	if sink == "" {
+		rows, err = s.db.Query("SELECT id, topic, payload, codec, key_id, block_id, created_at, sent, priority FROM messages WHERE sent=0 AND id < ? ORDER BY priority DESC, id LIMIT ?", before, limit)
+	} else {
+		rows, err = s.db.Query(`SELECT m.id, m.topic, m.payload, m.codec, m.key_id, m.block_id, m.created_at, m.sent, m.priority FROM pending p
+		JOIN messages m ON m.id = p.message_id
+		WHERE p.sink = ? AND p.message_id < ? ORDER BY p.priority DESC, p.message_id LIMIT ?`, sink, before, limit)
+	}
 	if err != nil {
 		return nil, err
 	}
+	return s.scanMessages(rows)
+}
+
+func (s *Store) scanMessages(rows *sql.Rows) ([]Message, error) {
 	defer rows.Close()
 	var out []Message
+	var err error
+	inBlock := make(map[int]int64)
+	bad := make(map[int64]string)
 	for rows.Next() {
 		var m Message
 		var ts int64
 		var payload []byte
+		var codec, keyID string
+		var block int64
 		var sentInt int
-		if err := rows.Scan(&m.ID, &payload, &ts, &sentInt); err != nil {
+		if err := rows.Scan(&m.ID, &m.Topic, &payload, &codec, &keyID, &block, &ts, &sentInt, &m.Priority); err != nil {
 			return nil, err
 		}
-		m.Payload = payload
+		if block != 0 {
+			inBlock[len(out)] = block
+		} else if payload, err = s.open(keyID, payload, rowAAD(m.ID, m.Topic, codec, ts), m.ID, s.plainUntil); err != nil {
+			bad[m.ID] = err.Error()
+		} else if m.Payload, err = decode(codec, payload); err != nil {
+			bad[m.ID] = err.Error()
+		}
 		m.CreatedAt = time.Unix(ts, 0)
 		m.Sent = sentInt != 0
 		out = append(out, m)
 	}
-	return out, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// payloads packed into blocks; each block is read once
+	blocks := make(map[int64]map[int64][]byte)
+	blockErrs := make(map[int64]error)
+	for i, block := range inBlock {
+		payloads, ok := blocks[block]
+		if !ok && blockErrs[block] == nil {
+			var codec, keyID string
+			var data []byte
+			err := s.db.QueryRow("SELECT codec, key_id, data FROM blocks WHERE id = ?", block).Scan(&codec, &keyID, &data)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return nil, fmt.Errorf("message %d: block %d: %w", out[i].ID, block, err)
+			}
+			if err == nil {
+				data, err = s.open(keyID, data, blockAAD(codec), block, s.plainBlocksUntil)
+			}
+			if err == nil {
+				payloads, err = decodeBlock(codec, data)
+			}
+			blockErrs[block] = err
+			blocks[block] = payloads
+		}
+		if err := blockErrs[block]; err != nil {
+			bad[out[i].ID] = fmt.Sprintf("block %d: %v", block, err)
+			continue
+		}
+		p, ok := payloads[out[i].ID]
+		if !ok {
+			bad[out[i].ID] = fmt.Sprintf("missing from block %d", block)
+			continue
+		}
+		out[i].Payload = p
+	}
+	if err := s.quarantine(bad); err != nil {
+		return nil, err
+	}
+	return dropQuarantined(out, bad), nil
 }
 
 // CountUnsent returns the total number of unsent messages in the buffer.
@@ -122,7 +622,40 @@ func (s *Store) CountUnsent() (int, error) {
 	return count, nil
 }
 
-// MarkSent marks a list of message ids as sent (sent=1).
+// CountPending returns the number of messages not yet acknowledged by sink.
+// An empty sink name is the same as CountUnsent.
+func (s *Store) CountPending(sink string) (int, error) {
+	if sink == "" {
+		return s.CountUnsent()
+	}
+	if s == nil || s.db == nil {
+		return 0, errors.New("store not initialized")
+	}
+	var count int
+	row := s.db.QueryRow("SELECT COUNT(1) FROM pending WHERE sink = ?", sink)
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// PendingBytes returns the total stored payload size of unsent messages,
+// after compression.
+func (s *Store) PendingBytes() (int64, error) {
+	if s == nil || s.db == nil {
+		return 0, errors.New("store not initialized")
+	}
+	var size int64
+	row := s.db.QueryRow(`SELECT
+		(SELECT COALESCE(SUM(LENGTH(payload)), 0) FROM messages WHERE sent=0) +
+		(SELECT COALESCE(SUM(LENGTH(data)), 0) FROM blocks WHERE id IN (SELECT block_id FROM messages WHERE sent=0))`)
+	if err := row.Scan(&size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// MarkSent marks a list of message ids as sent (sent=1) for all sinks.
 func (s *Store) MarkSent(ids []int64) error {
 	if s == nil || s.db == nil {
 		return errors.New("store not initialized")
@@ -130,6 +663,7 @@ func (s *Store) MarkSent(ids []int64) error {
 	if len(ids) == 0 {
 		return nil
 	}
+	defer s.leases.acked("", ids)
 	tx, err := s.db.Begin()
 	if err != nil {
 		return err
@@ -140,11 +674,86 @@ func (s *Store) MarkSent(ids []int64) error {
 		return err
 	}
 	defer stmt.Close()
+	del, err := tx.Prepare("DELETE FROM pending WHERE message_id = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer del.Close()
 	for _, id := range ids {
 		if _, err := stmt.Exec(id); err != nil {
 			tx.Rollback()
 			return err
 		}
+		if _, err := del.Exec(id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Ack records that sink has delivered the given messages. A message is marked
+// sent once no sink has it pending. An empty sink name is the same as MarkSent.
+func (s *Store) Ack(sink string, ids []int64) error {
+	if sink == "" {
+		return s.MarkSent(ids)
+	}
+	if s == nil || s.db == nil {
+		return errors.New("store not initialized")
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	defer s.leases.acked(sink, ids)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	del, err := tx.Prepare("DELETE FROM pending WHERE sink = ? AND message_id = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer del.Close()
+	done, err := tx.Prepare("UPDATE messages SET sent=1 WHERE id = ? AND NOT EXISTS (SELECT 1 FROM pending WHERE message_id = ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer done.Close()
+	for _, id := range ids {
+		if _, err := del.Exec(sink, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := done.Exec(id, id); err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	return tx.Commit()
 }
+
+// PurgeSent deletes messages that every sink has acknowledged and returns how
+// many were removed.
+func (s *Store) PurgeSent() (int64, error) {
+	if s == nil || s.db == nil {
+		return 0, errors.New("store not initialized")
+	}
+	res, err := s.db.Exec("DELETE FROM messages WHERE sent=1")
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if _, err := s.db.Exec(`DELETE FROM blocks WHERE NOT EXISTS (SELECT 1 FROM messages WHERE block_id = blocks.id)
+			AND NOT EXISTS (SELECT 1 FROM quarantine WHERE block_id = blocks.id)`); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -1,9 +1,16 @@
 package buffer
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/your-username/iot-edge-gateway/internal/keyring"
 )
 
 func TestEnqueueFetchMarkSent(t *testing.T) {
@@ -53,3 +60,436 @@ func TestEnqueueFetchMarkSent(t *testing.T) {
 		t.Fatalf("db file not found")
 	}
 }
+
+func TestPerSinkDelivery(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer store.Close()
+
+	// a message buffered before sinks are registered is delivered to all of them
+	if _, err := store.Enqueue([]byte("m1")); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if err := store.SetSinks([]string{"kafka", "historian"}); err != nil {
+		t.Fatalf("SetSinks failed: %v", err)
+	}
+	if _, err := store.Enqueue([]byte("m2")); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	kafka, err := store.FetchPending("kafka", 10)
+	if err != nil {
+		t.Fatalf("FetchPending failed: %v", err)
+	}
+	if len(kafka) != 2 {
+		t.Fatalf("expected 2 pending for kafka, got %d", len(kafka))
+	}
+	if err := store.Ack("kafka", []int64{kafka[0].ID, kafka[1].ID}); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if n, _ := store.CountPending("kafka"); n != 0 {
+		t.Fatalf("expected nothing pending for kafka, got %d", n)
+	}
+	if n, _ := store.CountPending("historian"); n != 2 {
+		t.Fatalf("expected 2 pending for historian, got %d", n)
+	}
+	// not purgeable until the historian has them too
+	if n, _ := store.PurgeSent(); n != 0 {
+		t.Fatalf("expected no purge while historian is pending, purged %d", n)
+	}
+
+	if err := store.Ack("historian", []int64{kafka[0].ID}); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if n, _ := store.CountUnsent(); n != 1 {
+		t.Fatalf("expected 1 unsent, got %d", n)
+	}
+	if n, _ := store.PurgeSent(); n != 1 {
+		t.Fatalf("expected 1 purged, got %d", n)
+	}
+
+	// removing the historian releases what only it was waiting for
+	if err := store.SetSinks([]string{"kafka"}); err != nil {
+		t.Fatalf("SetSinks failed: %v", err)
+	}
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("expected 0 unsent after removing sink, got %d", n)
+	}
+}
+
+func TestTopicColumnMigration(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "buffer.db")
+	// schema written by earlier versions, without the topic column
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payload BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		sent INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT INTO messages(payload, created_at, sent) VALUES ('old', 0, 0);`); err != nil {
+		t.Fatalf("create old schema: %v", err)
+	}
+	db.Close()
+
+	store, err := Init(dbPath)
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.EnqueueTopic("sensors/a", []byte("new")); err != nil {
+		t.Fatalf("EnqueueTopic failed: %v", err)
+	}
+	msgs, err := store.FetchUnsent(10)
+	if err != nil {
+		t.Fatalf("FetchUnsent failed: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].Topic != "" || msgs[1].Topic != "sensors/a" {
+		t.Fatalf("unexpected messages after migration: %+v", msgs)
+	}
+}
+
+func TestCompressedPayloads(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "buffer.db")
+	store, err := Init(dbPath)
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer store.Close()
+
+	reading := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"measurement":"temperature","tags":{"device":"boiler-1","site":"north"},"fields":{"value":%d},"timestamp":"2024-05-01T12:00:00Z"}`, i))
+	}
+	large := []byte(strings.Repeat(`{"measurement":"vibration","fields":{"x":0.25}}`, 50))
+
+	// written before compression was turned on
+	for i := 0; i < blockMessages; i++ {
+		if _, err := store.Enqueue(reading(i)); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+	if _, err := store.Enqueue(large); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	rawBytes, _ := store.PendingBytes()
+
+	if err := store.SetCodec("lzma"); err == nil {
+		t.Fatalf("expected unknown codec to be rejected")
+	}
+	if err := store.SetCodec(CodecZstd); err != nil {
+		t.Fatalf("SetCodec: %v", err)
+	}
+	if _, err := store.Enqueue(large); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if err := store.SetCodec(CodecSnappy); err != nil {
+		t.Fatalf("SetCodec: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Enqueue(reading(100 + i)); err != nil {
+			t.Fatalf("Enqueue failed: %v", err)
+		}
+	}
+
+	// the old readings form one block and the large payload is compressed
+	// alone; the three new readings wait for a full block
+	if n, err := store.Compact(1000); err != nil || n != blockMessages+1 {
+		t.Fatalf("Compact = %d, %v", n, err)
+	}
+	if n, _ := store.Compact(1000); n != 0 {
+		t.Fatalf("expected nothing left to compact, got %d", n)
+	}
+	var blocks int
+	store.db.QueryRow("SELECT COUNT(1) FROM blocks").Scan(&blocks)
+	if blocks != 1 {
+		t.Fatalf("expected 1 block, got %d", blocks)
+	}
+	if b, _ := store.PendingBytes(); b*3 > rawBytes {
+		t.Fatalf("expected at least 3x compression, %d bytes from %d", b, rawBytes)
+	}
+
+	msgs, err := store.FetchUnsent(100)
+	if err != nil {
+		t.Fatalf("FetchUnsent failed: %v", err)
+	}
+	want := make([][]byte, 0, blockMessages+5)
+	for i := 0; i < blockMessages; i++ {
+		want = append(want, reading(i))
+	}
+	want = append(want, large, large, reading(100), reading(101), reading(102))
+	if len(msgs) != len(want) {
+		t.Fatalf("expected %d messages, got %d", len(want), len(msgs))
+	}
+	for i, m := range msgs {
+		if string(m.Payload) != string(want[i]) {
+			t.Fatalf("message %d: payload mismatch: %q", m.ID, m.Payload)
+		}
+	}
+
+	// blocks are removed with their last message
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	if err := store.MarkSent(ids); err != nil {
+		t.Fatalf("MarkSent failed: %v", err)
+	}
+	if _, err := store.PurgeSent(); err != nil {
+		t.Fatalf("PurgeSent failed: %v", err)
+	}
+	store.db.QueryRow("SELECT COUNT(1) FROM blocks").Scan(&blocks)
+	if blocks != 0 {
+		t.Fatalf("expected blocks to be purged, %d left", blocks)
+	}
+}
+
+func TestEncryptedPayloads(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "buffer.db")
+	store, err := Init(dbPath)
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer store.Close()
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	enqueue := func(topic, payload string) int64 {
+		id, err := store.EnqueueTopic(topic, []byte(payload))
+		if err != nil {
+			t.Fatalf("EnqueueTopic failed: %v", err)
+		}
+		return id
+	}
+
+	// written before encryption was enabled
+	enqueue("t", "legacy")
+
+	k1, err := keyring.Parse("k1:" + key(1))
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	if err := store.SetKeyring(k1); err != nil {
+		t.Fatalf("SetKeyring: %v", err)
+	}
+	one := enqueue("t", "secret-one")
+	flipped := enqueue("t", "secret-two")
+	retopic := enqueue("t", "secret-three")
+
+	// rotation: new rows use k2, rows encrypted with k1 stay readable
+	k2, _ := keyring.Parse("k1:" + key(1) + "\nk2:" + key(2))
+	if err := store.SetKeyring(k2); err != nil {
+		t.Fatalf("SetKeyring: %v", err)
+	}
+	enqueue("t", "secret-four")
+	copied := enqueue("t", "secret-five")
+
+	var plain int
+	store.db.QueryRow("SELECT COUNT(1) FROM messages WHERE payload LIKE '%secret%'").Scan(&plain)
+	if plain != 0 {
+		t.Fatalf("found %d plaintext payloads", plain)
+	}
+	var keys []string
+	rows, _ := store.db.Query("SELECT key_id FROM messages ORDER BY id")
+	for rows.Next() {
+		var k string
+		rows.Scan(&k)
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if strings.Join(keys, ",") != ",k1,k1,k1,k2,k2" {
+		t.Fatalf("unexpected key ids %v", keys)
+	}
+	onlyK2, _ := keyring.Parse("k2:" + key(2))
+	if err := store.SetKeyring(onlyK2); err == nil {
+		t.Fatalf("expected an error for rows encrypted with a key that was removed")
+	}
+	if err := store.SetKeyring(nil); err == nil {
+		t.Fatalf("expected an error turning encryption off with encrypted rows buffered")
+	}
+
+	// tampering: a changed ciphertext, a changed topic, a ciphertext copied
+	// from another row and an injected plaintext row are quarantined instead
+	// of forwarded
+	if _, err := store.db.Exec("UPDATE messages SET payload = substr(payload, 1, 20) || iif(substr(payload, 21, 1) = x'00', x'01', x'00') || substr(payload, 22) WHERE id = ?", flipped); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if _, err := store.db.Exec("UPDATE messages SET topic = 'other' WHERE id = ?", retopic); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if _, err := store.db.Exec("UPDATE messages SET (payload, key_id, created_at) = (SELECT payload, key_id, created_at FROM messages WHERE id = ?) WHERE id = ?", one, copied); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if _, err := store.db.Exec("INSERT INTO messages(topic, payload, created_at, sent) VALUES ('t', 'injected', 0, 0)"); err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	msgs, err := store.FetchUnsent(10)
+	if err != nil {
+		t.Fatalf("FetchUnsent failed: %v", err)
+	}
+	var got []string
+	for _, m := range msgs {
+		got = append(got, string(m.Payload))
+	}
+	if strings.Join(got, ",") != "legacy,secret-one,secret-four" {
+		t.Fatalf("unexpected payloads %v", got)
+	}
+	if n, _ := store.CountQuarantined(); n != 4 {
+		t.Fatalf("expected 4 quarantined messages, got %d", n)
+	}
+	if n, _ := store.CountUnsent(); n != 3 {
+		t.Fatalf("expected quarantined messages to leave the buffer, %d unsent", n)
+	}
+
+	// compacted blocks are encrypted too
+	if err := store.SetCodec(CodecZstd); err != nil {
+		t.Fatalf("SetCodec: %v", err)
+	}
+	for i := 0; i < blockMessages; i++ {
+		enqueue("t", fmt.Sprintf("secret-reading-%d", i))
+	}
+	if n, err := store.Compact(1000); err != nil || n != blockMessages {
+		t.Fatalf("Compact = %d, %v", n, err)
+	}
+	var blockKey string
+	store.db.QueryRow("SELECT key_id FROM blocks").Scan(&blockKey)
+	if blockKey != "k2" {
+		t.Fatalf("block key id = %q, want k2", blockKey)
+	}
+	if msgs, err = store.FetchUnsent(100); err != nil || len(msgs) != 3+blockMessages {
+		t.Fatalf("FetchUnsent = %d messages, %v", len(msgs), err)
+	}
+	if string(msgs[3].Payload) != "secret-reading-0" {
+		t.Fatalf("unexpected payload %q", msgs[3].Payload)
+	}
+	if _, err := store.db.Exec("UPDATE blocks SET data = substr(data, 1, 20) || iif(substr(data, 21, 1) = x'00', x'01', x'00') || substr(data, 22)"); err != nil {
+		t.Fatalf("tamper: %v", err)
+	}
+	if msgs, err = store.FetchUnsent(100); err != nil || len(msgs) != 3 {
+		t.Fatalf("FetchUnsent = %d messages, %v", len(msgs), err)
+	}
+	if n, _ := store.CountQuarantined(); n != 4+blockMessages {
+		t.Fatalf("expected block members to be quarantined, got %d", n)
+	}
+}
+
+func TestEncryptionOffAfterDrain(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer store.Close()
+	kr, err := keyring.Parse("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	if err := store.SetKeyring(kr); err != nil {
+		t.Fatalf("SetKeyring: %v", err)
+	}
+	id, err := store.Enqueue([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if err := store.SetKeyring(nil); err == nil {
+		t.Fatalf("expected an error turning encryption off with an encrypted row buffered")
+	}
+	// the keys are kept, so the row is still delivered
+	msgs, err := store.FetchUnsent(10)
+	if err != nil || len(msgs) != 1 || string(msgs[0].Payload) != "secret" {
+		t.Fatalf("FetchUnsent = %v, %v", msgs, err)
+	}
+
+	if err := store.MarkSent([]int64{id}); err != nil {
+		t.Fatalf("MarkSent failed: %v", err)
+	}
+	if _, err := store.PurgeSent(); err != nil {
+		t.Fatalf("PurgeSent failed: %v", err)
+	}
+	if err := store.SetKeyring(nil); err != nil {
+		t.Fatalf("SetKeyring(nil) after the buffer drained: %v", err)
+	}
+	if _, err := store.Enqueue([]byte("plain")); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if msgs, err = store.FetchUnsent(10); err != nil || len(msgs) != 1 || string(msgs[0].Payload) != "plain" {
+		t.Fatalf("FetchUnsent = %v, %v", msgs, err)
+	}
+}
+
+func TestInitRecoversCorruptDatabase(t *testing.T) {
+	for _, damage := range []string{"header", "page"} {
+		t.Run(damage, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "buffer.db")
+			store, err := Init(dbPath)
+			if err != nil {
+				t.Fatalf("Init failed: %v", err)
+			}
+			if err := store.SetSinks([]string{"a"}); err != nil {
+				t.Fatalf("SetSinks failed: %v", err)
+			}
+			batch := make([]Message, 3000)
+			for i := range batch {
+				batch[i] = Message{Topic: "t", Payload: []byte(fmt.Sprintf("%04d-%s", i, strings.Repeat("x", 300)))}
+			}
+			ids, err := store.EnqueueBatch(batch)
+			if err != nil {
+				t.Fatalf("EnqueueBatch failed: %v", err)
+			}
+			if store.Recovery() != nil {
+				t.Fatalf("new store reports a recovery")
+			}
+			store.Close()
+
+			f, err := os.OpenFile(dbPath, os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			st, _ := f.Stat()
+			off := int64(0)
+			if damage == "page" {
+				off = st.Size() / 2 / 4096 * 4096
+			}
+			f.WriteAt(bytes.Repeat([]byte{0xa5}, 4096), off)
+			f.Close()
+
+			store, err = Init(dbPath)
+			if err != nil {
+				t.Fatalf("Init of a corrupt database failed: %v", err)
+			}
+			defer store.Close()
+			rec := store.Recovery()
+			if rec == nil {
+				t.Fatalf("Recovery() = nil after opening a corrupt database")
+			}
+			if _, err := os.Stat(rec.SetAside); err != nil {
+				t.Fatalf("corrupt database not kept: %v", err)
+			}
+			if damage == "page" && rec.Messages == 0 {
+				t.Fatalf("no messages recovered from a database with one damaged page: %+v", rec)
+			}
+			msgs, err := store.FetchPending("a", 5000)
+			if err != nil {
+				t.Fatalf("FetchPending failed: %v", err)
+			}
+			if int64(len(msgs)) != rec.Messages {
+				t.Fatalf("%d messages pending, %d recovered", len(msgs), rec.Messages)
+			}
+			for _, m := range msgs {
+				if want := string(batch[m.ID-ids[0]].Payload); string(m.Payload) != want {
+					t.Fatalf("message %d = %.10q, want %.10q", m.ID, m.Payload, want)
+				}
+			}
+			// the recovered store keeps working and does not reuse ids
+			id, err := store.Enqueue([]byte("after"))
+			if err != nil {
+				t.Fatalf("Enqueue after recovery failed: %v", err)
+			}
+			if damage == "page" && id <= ids[len(ids)-1] {
+				t.Fatalf("id %d handed out again after recovery", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs recorded in the codec columns. Rows written without compression, or
+// by versions before compression was added, have an empty codec.
+const (
+	CodecNone   = ""
+	CodecZstd   = "zstd"
+	CodecSnappy = "snappy"
+)
+
+const (
+	// rowCompressSize is the payload size from which payloads are compressed
+	// on their own when enqueued. Smaller payloads, such as single JSON
+	// readings, hardly shrink alone and are packed into blocks by Compact.
+	rowCompressSize = 1024
+	// blockMessages is the number of small messages packed into one block.
+	blockMessages = 64
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+func validCodec(codec string) bool {
+	switch codec {
+	case CodecNone, CodecZstd, CodecSnappy:
+		return true
+	}
+	return false
+}
+
+func compress(codec string, data []byte) []byte {
+	switch codec {
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, nil)
+	case CodecSnappy:
+		return s2.EncodeSnappy(nil, data)
+	default:
+		return data
+	}
+}
+
+// encode compresses payload with codec and returns the stored bytes and the
+// codec actually used: payloads that do not get smaller are stored as they are.
+func encode(codec string, payload []byte) ([]byte, string) {
+	if codec == CodecNone {
+		return payload, CodecNone
+	}
+	out := compress(codec, payload)
+	if len(out) >= len(payload) {
+		return payload, CodecNone
+	}
+	return out, codec
+}
+
+// decode returns the original bytes of data stored with codec.
+func decode(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	case CodecSnappy:
+		// s2 reads the snappy block format
+		return s2.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+// A block holds the payloads of several messages, each as its id and length
+// as uvarints followed by the payload, compressed as a whole.
+type blockEntry struct {
+	id      int64
+	payload []byte
+	// topic and created are the message's columns, used by Compact
+	topic   string
+	created int64
+}
+
+func encodeBlock(codec string, entries []blockEntry) []byte {
+	var raw []byte
+	for _, e := range entries {
+		raw = binary.AppendUvarint(raw, uint64(e.id))
+		raw = binary.AppendUvarint(raw, uint64(len(e.payload)))
+		raw = append(raw, e.payload...)
+	}
+	return compress(codec, raw)
+}
+
+func decodeBlock(codec string, data []byte) (map[int64][]byte, error) {
+	raw, err := decode(codec, data)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int64][]byte)
+	for len(raw) > 0 {
+		id, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return nil, fmt.Errorf("corrupt block")
+		}
+		raw = raw[n:]
+		size, n := binary.Uvarint(raw)
+		if n <= 0 || uint64(len(raw)-n) < size {
+			return nil, fmt.Errorf("corrupt block")
+		}
+		raw = raw[n:]
+		out[int64(id)] = raw[:size:size]
+		raw = raw[size:]
+	}
+	return out, nil
+}
@@ -0,0 +1,195 @@
+package buffer
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	// DefaultGroupWindow is how long the writer keeps collecting enqueues
+	// once it sees them arriving concurrently.
+	DefaultGroupWindow = 2 * time.Millisecond
+	// maxGroup bounds the messages written in one transaction.
+	maxGroup = 1000
+)
+
+// writeReq is an enqueue waiting for the writer. Messages with an ID keep
+// it, the others are numbered by SQLite.
+type writeReq struct {
+	msgs []Message
+	ids  []int64
+	err  error
+	done chan struct{}
+}
+
+// SetGroupCommit sets how long concurrent enqueues are collected into one
+// transaction. Zero still groups the enqueues that queued up while the
+// previous transaction was committing, without waiting for more.
+func (s *Store) SetGroupCommit(window time.Duration) {
+	if window < 0 {
+		window = 0
+	}
+	s.groupWindow.Store(int64(window))
+}
+
+// write hands msgs to the writer and waits until they are committed.
+func (s *Store) write(msgs []Message) ([]int64, error) {
+	if s == nil || s.db == nil {
+		return nil, errors.New("store not initialized")
+	}
+	req := &writeReq{msgs: msgs, done: make(chan struct{})}
+	select {
+	case s.writes <- req:
+	case <-s.stop:
+		return nil, errors.New("store closed")
+	}
+	<-req.done
+	return req.ids, req.err
+}
+
+// writer commits enqueues in groups, so concurrent inputs share one
+// transaction and fsync instead of paying for one each. A lone enqueue is
+// committed at once; only when more are already waiting does the writer keep
+// collecting for up to groupWindow.
+func (s *Store) writer() {
+	defer close(s.done)
+	for {
+		var req *writeReq
+		select {
+		case <-s.stop:
+			return
+		case req = <-s.writes:
+		}
+		group, n := []*writeReq{req}, len(req.msgs)
+		var deadline <-chan time.Time
+		for n < maxGroup {
+			var r *writeReq
+			if deadline == nil {
+				select {
+				case r = <-s.writes:
+				default:
+				}
+				if r != nil {
+					if w := time.Duration(s.groupWindow.Load()); w > 0 {
+						deadline = time.After(w)
+					}
+				}
+			} else {
+				select {
+				case r = <-s.writes:
+				case <-deadline:
+				}
+			}
+			if r == nil {
+				break
+			}
+			group = append(group, r)
+			n += len(r.msgs)
+		}
+		s.commit(group)
+	}
+}
+
+// commit writes a group in one transaction. If that fails, each request is
+// retried on its own so one bad request does not fail the others.
+func (s *Store) commit(group []*writeReq) {
+	err := s.commitGroup(group)
+	if err != nil && len(group) > 1 {
+		for _, r := range group {
+			r.err = s.commitGroup([]*writeReq{r})
+		}
+	} else {
+		for _, r := range group {
+			r.err = err
+		}
+	}
+	for _, r := range group {
+		if r.err != nil {
+			r.ids = nil
+		}
+		close(r.done)
+	}
+}
+
+func (s *Store) commitGroup(group []*writeReq) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	ins, err := tx.Prepare("INSERT INTO messages(id, topic, payload, codec, key_id, created_at, priority, sent) VALUES (?, ?, ?, ?, ?, ?, ?, 0)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer ins.Close()
+	pend, err := tx.Prepare("INSERT INTO pending(sink, message_id, priority) SELECT name, ?, ? FROM sinks")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer pend.Close()
+	seal, err := tx.Prepare("UPDATE messages SET payload = ?, key_id = ? WHERE id = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer seal.Close()
+	for _, r := range group {
+		r.ids = make([]int64, len(r.msgs))
+		for i, m := range r.msgs {
+			if r.ids[i], err = s.insert(ins, pend, seal, m); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// insert stores one message and marks it pending for every sink. A zero ID
+// lets SQLite pick the next one and a zero CreatedAt means now. The id is part
+// of an encrypted payload's additional data, so without a given ID the payload
+// is sealed with seal once the row exists.
+func (s *Store) insert(ins, pend, seal *sql.Stmt, m Message) (int64, error) {
+	created := time.Now().Unix()
+	if !m.CreatedAt.IsZero() {
+		created = m.CreatedAt.Unix()
+	}
+	data, codec := m.Payload, CodecNone
+	if len(m.Payload) >= rowCompressSize {
+		data, codec = encode(s.codec, m.Payload)
+	}
+	later := s.aeads != nil && m.ID <= 0
+	stored, keyID := []byte{}, ""
+	if !later {
+		var err error
+		if stored, keyID, err = s.seal(data, rowAAD(m.ID, m.Topic, codec, created)); err != nil {
+			return 0, err
+		}
+	}
+	var rowID interface{}
+	if m.ID > 0 {
+		rowID = m.ID
+	}
+	res, err := ins.Exec(rowID, m.Topic, stored, codec, keyID, created, m.Priority)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if later {
+		if stored, keyID, err = s.seal(data, rowAAD(id, m.Topic, codec, created)); err != nil {
+			return 0, err
+		}
+		if _, err := seal.Exec(stored, keyID, id); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := pend.Exec(id, m.Priority); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
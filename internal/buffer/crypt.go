@@ -0,0 +1,209 @@
+package buffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/keyring"
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+)
+
+// Rows and blocks record the id of the key that encrypted them; plaintext
+// ones have an empty key id. Encrypted data is the random nonce followed by
+// the AES-GCM ciphertext. The additional data binds a message payload to the
+// message's id, topic, codec and creation time, so a changed column or a
+// payload copied to another row is detected like a changed payload; block
+// contents carry the ids of their messages.
+
+// SetKeyring makes the store encrypt payloads written from now on with the
+// keyring's current key. Rows encrypted with older keys stay readable as long
+// as their keys remain in the keyring; SetKeyring fails if the buffer holds
+// data encrypted with a key it does not have. Plaintext rows written before
+// encryption was enabled are still forwarded, but a plaintext row that
+// appears afterwards is treated as tampered. A nil keyring turns encryption
+// off, which fails while the buffer still holds encrypted data.
+//
+// Rows that fail authentication are moved to the quarantine table instead of
+// being returned by the fetch methods.
+func (s *Store) SetKeyring(kr keyring.Keyring) error {
+	if s == nil || s.db == nil {
+		return errors.New("store not initialized")
+	}
+	if kr == nil {
+		// turning encryption off would leave encrypted rows unreadable
+		var n int
+		if err := s.db.QueryRow("SELECT (SELECT COUNT(1) FROM messages WHERE key_id != '') + (SELECT COUNT(1) FROM blocks WHERE key_id != '')").Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("buffer holds %d encrypted row(s); keep the keys configured until they have been forwarded", n)
+		}
+		s.aeads, s.current = nil, ""
+		_, err := s.db.Exec("DELETE FROM meta WHERE key IN ('plaintext_until', 'plaintext_blocks_until')")
+		return err
+	}
+
+	ids := map[string]bool{kr.Current(): true}
+	rows, err := s.db.Query("SELECT DISTINCT key_id FROM messages WHERE key_id != '' UNION SELECT DISTINCT key_id FROM blocks WHERE key_id != ''")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	aeads := make(map[string]cipher.AEAD, len(ids))
+	for id := range ids {
+		key, ok := kr.Key(id)
+		if !ok {
+			return fmt.Errorf("buffer holds data encrypted with key %q, which is not in the keyring", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", id, err)
+		}
+		if aeads[id], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("key %q: %w", id, err)
+		}
+	}
+
+	// rows after the current last ids must be encrypted
+	if s.plainUntil, err = s.watermark("plaintext_until", "messages"); err != nil {
+		return err
+	}
+	if s.plainBlocksUntil, err = s.watermark("plaintext_blocks_until", "blocks"); err != nil {
+		return err
+	}
+	s.aeads, s.current = aeads, kr.Current()
+	return nil
+}
+
+// watermark returns the id stored under key in the meta table, recording the
+// last id of table first if there is none.
+func (s *Store) watermark(key, table string) (int64, error) {
+	if _, err := s.db.Exec(`INSERT OR IGNORE INTO meta(key, value)
+		SELECT ?, COALESCE((SELECT seq FROM sqlite_sequence WHERE name = ?), 0)`, key, table); err != nil {
+		return 0, err
+	}
+	var v string
+	if err := s.db.QueryRow("SELECT value FROM meta WHERE key = ?", key).Scan(&v); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// seal encrypts data with the current key, if encryption is on, and returns
+// the stored bytes and the key id.
+func (s *Store) seal(data, aad []byte) ([]byte, string, error) {
+	if s.aeads == nil {
+		return data, "", nil
+	}
+	aead := s.aeads[s.current]
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(out, out, data, aad), s.current, nil
+}
+
+// open decrypts data stored with keyID. id is the row's id, checked against
+// the plaintext watermark of its table.
+func (s *Store) open(keyID string, data, aad []byte, id, plainUntil int64) ([]byte, error) {
+	if keyID == "" {
+		if s.aeads != nil && id > plainUntil {
+			return nil, errors.New("unencrypted data written after encryption was enabled")
+		}
+		return data, nil
+	}
+	aead, ok := s.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", keyID)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	out, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed (key %q)", keyID)
+	}
+	return out, nil
+}
+
+func rowAAD(id int64, topic, codec string, created int64) []byte {
+	return []byte("message\x00" + strconv.FormatInt(id, 10) + "\x00" + topic + "\x00" + codec + "\x00" + strconv.FormatInt(created, 10))
+}
+
+func blockAAD(codec string) []byte {
+	return []byte("block\x00" + codec)
+}
+
+// quarantine moves messages that failed authentication out of delivery. The
+// rows are kept in the quarantine table for inspection.
+func (s *Store) quarantine(bad map[int64]string) error {
+	if len(bad) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for id, reason := range bad {
+		fmt.Printf("buffer: quarantining message %d: %s\n", id, reason)
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO quarantine(message_id, topic, payload, codec, key_id, block_id, created_at, reason, quarantined_at)
+			SELECT id, topic, payload, codec, key_id, block_id, created_at, ?, ? FROM messages WHERE id = ?`, reason, now, id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM pending WHERE message_id = ?", id); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM messages WHERE id = ?", id); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	metrics.BufferQuarantined.Add(float64(len(bad)))
+	return nil
+}
+
+// CountQuarantined returns the number of quarantined messages.
+func (s *Store) CountQuarantined() (int, error) {
+	if s == nil || s.db == nil {
+		return 0, errors.New("store not initialized")
+	}
+	var n int
+	err := s.db.QueryRow("SELECT COUNT(1) FROM quarantine").Scan(&n)
+	return n, err
+}
+
+// dropQuarantined removes ids in bad from msgs.
+func dropQuarantined(msgs []Message, bad map[int64]string) []Message {
+	if len(bad) == 0 {
+		return msgs
+	}
+	out := msgs[:0]
+	for _, m := range msgs {
+		if _, ok := bad[m.ID]; !ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
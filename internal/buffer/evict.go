@@ -0,0 +1,73 @@
+package buffer
+
+// Evicter is implemented by buffers that can drop unsent messages to make
+// room, so a full buffer can give up bulk data instead of refusing alarms.
+type Evicter interface {
+	// Evict deletes the oldest unsent messages of the given priority until
+	// the pending size is at most target bytes or none of that priority are
+	// left, and returns how many it deleted.
+	Evict(priority int, target int64) (int64, error)
+}
+
+var (
+	_ Evicter = (*Store)(nil)
+	_ Evicter = (*Hybrid)(nil)
+)
+
+// evictBatch is how many messages Evict deletes between size checks.
+const evictBatch = 256
+
+func (s *Store) Evict(priority int, target int64) (int64, error) {
+	var n int64
+	for {
+		size, err := s.PendingBytes()
+		if err != nil || size <= target {
+			return n, err
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return n, err
+		}
+		const oldest = "SELECT id FROM messages WHERE sent=0 AND priority = ? ORDER BY id LIMIT ?"
+		if _, err := tx.Exec("DELETE FROM pending WHERE message_id IN ("+oldest+")", priority, evictBatch); err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		res, err := tx.Exec("DELETE FROM messages WHERE id IN ("+oldest+")", priority, evictBatch)
+		if err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		if err := tx.Commit(); err != nil {
+			return n, err
+		}
+		n += deleted
+		if deleted == 0 {
+			return n, nil
+		}
+		if _, err := s.db.Exec(`DELETE FROM blocks WHERE NOT EXISTS (SELECT 1 FROM messages WHERE block_id = blocks.id)
+			AND NOT EXISTS (SELECT 1 FROM quarantine WHERE block_id = blocks.id)`); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Evict writes the ring to disk first, so eviction picks the oldest messages
+// wherever they are.
+func (h *Hybrid) Evict(priority int, target int64) (int64, error) {
+	ev, ok := h.disk.(Evicter)
+	if !ok {
+		return 0, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.spill(); err != nil {
+		return 0, err
+	}
+	return ev.Evict(priority, target)
+}
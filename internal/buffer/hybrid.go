@@ -0,0 +1,509 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Hybrid modes.
+const (
+	// ModeDurable writes every message to disk before Enqueue returns and
+	// keeps a copy in memory, so sinks that keep up are served without
+	// reading it back.
+	ModeDurable = "durable"
+	// ModeOverflow keeps messages in memory only and writes them to disk when
+	// the ring fills up, when they have waited longer than SpillAfter, and on
+	// Close. Messages still in memory are lost if the process crashes.
+	ModeOverflow = "overflow"
+)
+
+const (
+	DefaultMemoryMessages = 10000
+	DefaultMemoryBytes    = 16 << 20
+	DefaultSpillAfter     = 10 * time.Second
+
+	// reserveStep is how many ids are reserved on disk at a time.
+	reserveStep = 4096
+)
+
+// HybridOptions configures a Hybrid buffer.
+type HybridOptions struct {
+	// Mode is ModeDurable or ModeOverflow; empty means ModeDurable.
+	Mode string
+	// MaxMessages and MaxBytes bound the in-memory ring.
+	MaxMessages int
+	MaxBytes    int64
+	// SpillAfter is how long a message may wait in memory in ModeOverflow
+	// before it is written to disk because a sink is falling behind.
+	SpillAfter time.Duration
+}
+
+// diskBuffer is a Buffer that lets Hybrid assign message ids, so a message
+// keeps its id when it moves from memory to disk.
+type diskBuffer interface {
+	Buffer
+	lastID() (int64, error)
+	reserveIDs(id int64) error
+	enqueueAt(msgs []Message) error
+	fetchBefore(sink string, before int64, limit int) ([]Message, error)
+}
+
+// Hybrid is a Buffer that keeps recent messages in a bounded in-memory ring
+// in front of a disk Buffer, so a sink that keeps up is fed without a disk
+// round trip per message. Messages leave the ring once every sink has
+// acknowledged them; the ring only ever holds the newest messages, so among
+// messages of the same priority those on disk are delivered first.
+type Hybrid struct {
+	disk diskBuffer
+	opts HybridOptions
+
+	mu   sync.Mutex
+	ring []*memMessage
+	byID map[int64]*memMessage
+	// bytes is the payload size of the messages in ring, acknowledged or not
+	bytes    int64
+	sinks    []string
+	nextID   int64
+	reserved int64
+	stop     chan struct{}
+	done     chan struct{}
+	closed   bool
+
+	leases
+}
+
+// memMessage is a message in the ring. pending holds the sinks that have not
+// acknowledged it, or "" while no sinks are registered.
+type memMessage struct {
+	Message
+	pending map[string]bool
+	onDisk  bool
+}
+
+// NewHybrid puts an in-memory ring in front of disk, which must be a Store or
+// SegmentLog.
+func NewHybrid(disk Buffer, opts HybridOptions) (*Hybrid, error) {
+	d, ok := disk.(diskBuffer)
+	if !ok {
+		return nil, fmt.Errorf("buffer: %T cannot be used behind a memory buffer", disk)
+	}
+	switch opts.Mode {
+	case "":
+		opts.Mode = ModeDurable
+	case ModeDurable, ModeOverflow:
+	default:
+		return nil, fmt.Errorf("buffer: unknown memory mode %q", opts.Mode)
+	}
+	if opts.MaxMessages <= 0 {
+		opts.MaxMessages = DefaultMemoryMessages
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMemoryBytes
+	}
+	if opts.SpillAfter <= 0 {
+		opts.SpillAfter = DefaultSpillAfter
+	}
+	last, err := d.lastID()
+	if err != nil {
+		return nil, err
+	}
+	h := &Hybrid{
+		disk:     d,
+		opts:     opts,
+		byID:     make(map[int64]*memMessage),
+		nextID:   last + 1,
+		reserved: last,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	h.leases.fetch = h.FetchPending
+	if opts.Mode == ModeOverflow {
+		go h.spillLoop()
+	} else {
+		close(h.done)
+	}
+	return h, nil
+}
+
+// Disk returns the buffer behind the ring.
+func (h *Hybrid) Disk() Buffer {
+	return h.disk
+}
+
+// spillLoop writes messages to disk once they have waited in memory for
+// SpillAfter, so a stalled sink does not leave them exposed to a crash.
+func (h *Hybrid) spillLoop() {
+	defer close(h.done)
+	tick := time.NewTicker(h.opts.SpillAfter / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-tick.C:
+			h.mu.Lock()
+			if m := h.oldest(); m != nil && time.Since(m.CreatedAt) >= h.opts.SpillAfter {
+				if err := h.spill(); err != nil {
+					fmt.Printf("buffer: spilling to disk: %v\n", err)
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+func (h *Hybrid) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	close(h.stop)
+	h.mu.Unlock()
+	<-h.done
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	err := h.spill()
+	if cerr := h.disk.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (h *Hybrid) Enqueue(payload []byte) (int64, error) {
+	return h.EnqueueTopic("", payload)
+}
+
+func (h *Hybrid) EnqueueTopic(topic string, payload []byte) (int64, error) {
+	ids, err := h.EnqueueBatch([]Message{{Topic: topic, Payload: payload}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// EnqueueBatch adds msgs to the ring. In ModeDurable they are written to disk
+// first; in ModeOverflow a full ring is written to disk to make room.
+func (h *Hybrid) EnqueueBatch(msgs []Message) ([]int64, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, errors.New("store not initialized")
+	}
+	last := h.nextID + int64(len(msgs)) - 1
+	if last > h.reserved {
+		if err := h.disk.reserveIDs(last + reserveStep); err != nil {
+			return nil, err
+		}
+		h.reserved = last + reserveStep
+	}
+	now := time.Now()
+	batch := make([]Message, len(msgs))
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		batch[i] = Message{ID: h.nextID + int64(i), Topic: m.Topic, Payload: m.Payload, CreatedAt: m.CreatedAt, Priority: m.Priority}
+		if batch[i].CreatedAt.IsZero() {
+			batch[i].CreatedAt = now
+		}
+		ids[i] = batch[i].ID
+	}
+	if h.opts.Mode == ModeDurable {
+		if err := h.disk.enqueueAt(batch); err != nil {
+			return nil, err
+		}
+	}
+	h.nextID = last + 1
+	for _, m := range batch {
+		if err := h.add(m); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// add appends m to the ring, making room first.
+func (h *Hybrid) add(msg Message) error {
+	if h.opts.Mode == ModeDurable {
+		for len(h.ring) > 0 && h.full(len(msg.Payload)) {
+			// the message is on disk; acknowledged ones behind it go too
+			h.drop(h.ring[0])
+			h.bytes -= int64(len(h.ring[0].Payload))
+			h.ring = h.ring[1:]
+			h.trim()
+		}
+	} else if h.full(len(msg.Payload)) {
+		if err := h.spill(); err != nil {
+			return err
+		}
+	}
+	m := &memMessage{Message: msg, pending: make(map[string]bool, len(h.sinks)), onDisk: h.opts.Mode == ModeDurable}
+	for _, s := range h.sinks {
+		m.pending[s] = true
+	}
+	if len(h.sinks) == 0 {
+		m.pending[""] = true
+	}
+	h.ring = append(h.ring, m)
+	h.byID[m.ID] = m
+	h.bytes += int64(len(msg.Payload))
+	return nil
+}
+
+// spill empties the ring, writing the messages not yet on disk in one batch
+// together with the acknowledgements they already have.
+func (h *Hybrid) spill() error {
+	var batch []Message
+	acked := make(map[string][]int64)
+	for _, m := range h.ring {
+		if len(m.pending) == 0 || m.onDisk {
+			continue
+		}
+		batch = append(batch, m.Message)
+		for _, s := range h.sinks {
+			if !m.pending[s] {
+				acked[s] = append(acked[s], m.ID)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := h.disk.enqueueAt(batch); err != nil {
+			return err
+		}
+	}
+	for _, m := range h.ring {
+		h.drop(m)
+	}
+	h.ring = nil
+	h.bytes = 0
+	for s, ids := range acked {
+		if err := h.disk.Ack(s, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// full reports whether the ring has no room for a message of size bytes.
+// Acknowledged messages count until they leave the ring, which they can only
+// do from its front.
+func (h *Hybrid) full(size int) bool {
+	return len(h.ring) >= h.opts.MaxMessages || h.bytes+int64(size) > h.opts.MaxBytes
+}
+
+// drop stops serving m from the ring.
+func (h *Hybrid) drop(m *memMessage) {
+	delete(h.byID, m.ID)
+}
+
+// oldest returns the oldest message in the ring some sink still waits for.
+func (h *Hybrid) oldest() *memMessage {
+	for _, m := range h.ring {
+		if len(m.pending) > 0 {
+			return m
+		}
+	}
+	return nil
+}
+
+// trim removes acknowledged messages from the front of the ring.
+func (h *Hybrid) trim() {
+	i := 0
+	for i < len(h.ring) && len(h.ring[i].pending) == 0 {
+		h.bytes -= int64(len(h.ring[i].Payload))
+		i++
+	}
+	h.ring = h.ring[i:]
+}
+
+// SetSinks registers the sinks with the disk buffer and applies the same
+// rules to the ring: new sinks receive every unsent message and removed sinks
+// no longer hold messages back.
+func (h *Hybrid) SetSinks(names []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.disk.SetSinks(names); err != nil {
+		return err
+	}
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[n] = true
+	}
+	for _, m := range h.ring {
+		if len(m.pending) == 0 {
+			continue
+		}
+		for s := range m.pending {
+			if !want[s] {
+				delete(m.pending, s)
+			}
+		}
+		for s := range want {
+			if !h.registered(s) {
+				m.pending[s] = true
+			}
+		}
+		if len(want) == 0 {
+			m.pending[""] = true
+		}
+	}
+	h.sinks = append(h.sinks[:0:0], names...)
+	for _, m := range h.ring {
+		if len(m.pending) == 0 {
+			h.drop(m)
+		}
+	}
+	h.trim()
+	return nil
+}
+
+func (h *Hybrid) registered(sink string) bool {
+	for _, s := range h.sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hybrid) FetchUnsent(limit int) ([]Message, error) {
+	return h.FetchPending("", limit)
+}
+
+// FetchPending returns up to limit messages not yet acknowledged by sink,
+// from the ring and disk, highest priority first and then by id. Every
+// message from the first in the ring on is in the ring, so only older ones
+// are read from disk, and without holding the lock: a sink that keeps up is
+// served from memory, and enqueues do not wait for the disk.
+func (h *Hybrid) FetchPending(sink string, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	h.mu.Lock()
+	before := h.nextID
+	if len(h.ring) > 0 {
+		before = h.ring[0].ID
+	}
+	var mem []Message
+	for _, m := range h.ring {
+		if m.waitsFor(sink) {
+			mem = append(mem, m.Message)
+		}
+	}
+	h.mu.Unlock()
+
+	out, err := h.disk.fetchBefore(sink, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, mem...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority > out[j].Priority
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// waitsFor reports whether sink has not acknowledged m; an empty sink name
+// matches messages some sink has not acknowledged.
+func (m *memMessage) waitsFor(sink string) bool {
+	if sink == "" {
+		return len(m.pending) > 0
+	}
+	return m.pending[sink]
+}
+
+func (h *Hybrid) CountUnsent() (int, error) {
+	return h.CountPending("")
+}
+
+func (h *Hybrid) CountPending(sink string) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.disk.CountPending(sink)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range h.ring {
+		if !m.onDisk && m.waitsFor(sink) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PendingBytes returns the payload size of unsent messages on disk and in
+// the ring.
+func (h *Hybrid) PendingBytes() (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.disk.PendingBytes()
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range h.ring {
+		if !m.onDisk && len(m.pending) > 0 {
+			n += int64(len(m.Payload))
+		}
+	}
+	return n, nil
+}
+
+func (h *Hybrid) MarkSent(ids []int64) error {
+	return h.Ack("", ids)
+}
+
+// Ack records that sink has delivered the given messages. An empty sink name
+// acknowledges them for every sink.
+func (h *Hybrid) Ack(sink string, ids []int64) error {
+	defer h.leases.acked(sink, ids)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var disk []int64
+	for _, id := range ids {
+		m, ok := h.byID[id]
+		if !ok || m.onDisk {
+			disk = append(disk, id)
+		}
+		if !ok {
+			continue
+		}
+		if sink == "" {
+			m.pending = map[string]bool{}
+		} else {
+			delete(m.pending, sink)
+		}
+		if len(m.pending) == 0 {
+			h.drop(m)
+		}
+	}
+	h.trim()
+	if len(disk) == 0 {
+		return nil
+	}
+	if sink == "" {
+		return h.disk.MarkSent(disk)
+	}
+	return h.disk.Ack(sink, disk)
+}
+
+// PurgeSent deletes delivered messages from disk; the ring lets go of
+// messages as soon as they are acknowledged.
+func (h *Hybrid) PurgeSent() (int64, error) {
+	return h.disk.PurgeSent()
+}
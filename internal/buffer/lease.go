@@ -0,0 +1,147 @@
+package buffer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLeaseLost is returned by Extend when a lease has expired or was
+// released, so another owner may be delivering the message.
+var ErrLeaseLost = errors.New("lease lost")
+
+// Leaser is implemented by buffers that let several workers drain the same
+// sink without sending a message twice. Lease claims pending messages for an
+// owner until the lease expires; messages leased by others are skipped.
+// Acknowledging a message ends its lease, and expired leases return their
+// messages to the queue. Leases are held in memory and do not survive a
+// restart.
+type Leaser interface {
+	// Lease claims up to limit messages pending for sink for ttl.
+	Lease(sink, owner string, limit int, ttl time.Duration) ([]Message, error)
+	// Extend renews owner's leases on ids for ttl from now.
+	Extend(sink, owner string, ids []int64, ttl time.Duration) error
+	// Release gives up owner's leases on ids. The messages are leased to
+	// nobody for delay, so a failing batch is not picked up again at once.
+	Release(sink, owner string, ids []int64, delay time.Duration) error
+}
+
+var (
+	_ Leaser = (*Store)(nil)
+	_ Leaser = (*SegmentLog)(nil)
+	_ Leaser = (*Hybrid)(nil)
+)
+
+type leaseKey struct {
+	sink string
+	id   int64
+}
+
+type lease struct {
+	owner string
+	until time.Time
+}
+
+// leases implements Leaser on top of a buffer's FetchPending. Backends embed
+// it and set fetch when they are opened.
+type leases struct {
+	fetch func(sink string, limit int) ([]Message, error)
+
+	mu sync.Mutex
+	m  map[leaseKey]lease
+}
+
+func (l *leases) Lease(sink, owner string, limit int, ttl time.Duration) ([]Message, error) {
+	if owner == "" {
+		return nil, errors.New("lease owner is empty")
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	held := 0
+	for k, ls := range l.m {
+		if !now.Before(ls.until) {
+			delete(l.m, k)
+		} else if k.sink == sink {
+			held++
+		}
+	}
+	// fetching past every message leased by others yields limit free ones,
+	// if there are that many
+	msgs, err := l.fetch(sink, limit+held)
+	if err != nil {
+		return nil, err
+	}
+	if l.m == nil {
+		l.m = make(map[leaseKey]lease)
+	}
+	out := msgs[:0]
+	for _, m := range msgs {
+		if len(out) == limit {
+			break
+		}
+		k := leaseKey{sink, m.ID}
+		if _, taken := l.m[k]; taken {
+			continue
+		}
+		l.m[k] = lease{owner: owner, until: now.Add(ttl)}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func (l *leases) Extend(sink, owner string, ids []int64, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var err error
+	for _, id := range ids {
+		k := leaseKey{sink, id}
+		ls, ok := l.m[k]
+		if !ok || ls.owner != owner || !now.Before(ls.until) {
+			err = ErrLeaseLost
+			continue
+		}
+		l.m[k] = lease{owner: owner, until: now.Add(ttl)}
+	}
+	return err
+}
+
+func (l *leases) Release(sink, owner string, ids []int64, delay time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		k := leaseKey{sink, id}
+		if ls, ok := l.m[k]; ok && ls.owner == owner {
+			if delay > 0 {
+				l.m[k] = lease{until: time.Now().Add(delay)}
+			} else {
+				delete(l.m, k)
+			}
+		}
+	}
+	return nil
+}
+
+// acked ends the leases on ids, for every sink when sink is empty.
+func (l *leases) acked(sink string, ids []int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.m) == 0 {
+		return
+	}
+	for _, id := range ids {
+		if sink != "" {
+			delete(l.m, leaseKey{sink, id})
+			continue
+		}
+		for k := range l.m {
+			if k.id == id {
+				delete(l.m, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package buffer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+)
+
+// salvageRange is how many ids are read from a corrupt table at a time.
+const salvageRange = 1000
+
+// Recovery describes a corrupt buffer database that Init set aside and
+// recovered from.
+type Recovery struct {
+	// Problem is what the integrity check or opening the database reported.
+	Problem string
+	// SetAside is where the corrupt database was moved to.
+	SetAside string
+	// Messages is the number of messages copied into the new database.
+	Messages int64
+	// Unreadable is the number of message ids in damaged parts of the old
+	// database. Some may not have been in use, so it is an upper bound on
+	// the messages lost. It is zero when the messages could not be located
+	// at all; Problem then tells why.
+	Unreadable int64
+}
+
+// Recovery returns what Init recovered the store from, or nil when the
+// database was intact. A recovered store works normally, but messages may
+// have been lost or be delivered again.
+func (s *Store) Recovery() *Recovery {
+	return s.recovery
+}
+
+// checkIntegrity runs SQLite's quick_check on the database at path. It returns
+// a description of the problem if the database is corrupt, and an error if
+// it could not be checked for another reason. A missing database is intact.
+func checkIntegrity(path string) (string, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	rows, err := db.Query("PRAGMA quick_check(10)")
+	if err != nil {
+		if corrupt(err) {
+			return err.Error(), nil
+		}
+		return "", err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if corrupt(err) {
+			return err.Error(), nil
+		}
+		return "", err
+	}
+	return strings.Join(problems, "; "), nil
+}
+
+// corrupt reports whether err says the database file is damaged.
+func corrupt(err error) bool {
+	var se sqlite3.Error
+	return errors.As(err, &se) && (se.Code == sqlite3.ErrCorrupt || se.Code == sqlite3.ErrNotADB)
+}
+
+// recoverStore moves the corrupt database at path aside, together with its
+// WAL files, opens a fresh one and copies over whatever rows of the old one
+// can still be read. Messages whose pending rows were lost are pending again
+// for every sink, so they may be delivered twice rather than not at all.
+func recoverStore(path, problem string) (*Store, error) {
+	fmt.Printf("buffer: %s failed its integrity check: %s\n", path, problem)
+	aside := path + ".corrupt-" + time.Now().Format("20060102T150405")
+	if err := os.Rename(path, aside); err != nil {
+		return nil, fmt.Errorf("set aside corrupt buffer: %w", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Rename(path+suffix, aside+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("set aside corrupt buffer: %w", err)
+		}
+	}
+	s, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recovery{Problem: problem, SetAside: aside}
+	s.recovery = rec
+	metrics.BufferRecoveries.Inc()
+
+	// read-only keeps the file as it was; it fails if the WAL index is gone
+	src, err := sql.Open("sqlite3", "file:"+aside+"?mode=ro")
+	if err == nil {
+		err = src.Ping()
+	}
+	if err != nil {
+		if src != nil {
+			src.Close()
+		}
+		src, err = sql.Open("sqlite3", aside)
+	}
+	if err == nil {
+		defer src.Close()
+		err = salvage(src, s.db, rec)
+	}
+	metrics.BufferRecoveredMessages.Add(float64(rec.Messages))
+	metrics.BufferUnreadableIDs.Add(float64(rec.Unreadable))
+	if err != nil {
+		fmt.Printf("buffer: recovering from %s: %v\n", aside, err)
+	}
+	fmt.Printf("buffer: started a new buffer at %s with %d message(s) recovered; %d id(s) were unreadable; the corrupt database was kept as %s\n",
+		path, rec.Messages, rec.Unreadable, aside)
+	return s, nil
+}
+
+// salvage copies the readable rows of src into the fresh database dst.
+func salvage(src, dst *sql.DB, rec *Recovery) error {
+	tx, err := dst.Begin()
+	if err != nil {
+		return err
+	}
+	// small tables are copied as far as they can be read
+	for _, table := range []string{"sinks", "meta", "pending"} {
+		if _, _, err := copyRows(src, tx, table, "", 0, 0); err != nil {
+			fmt.Printf("buffer: recovering %s: %v\n", table, err)
+		}
+	}
+	var last int64
+	for _, t := range []struct{ table, key string }{
+		{"blocks", "id"},
+		{"messages", "id"},
+		{"quarantine", "message_id"},
+	} {
+		copied, unreadable, max := salvageTable(src, tx, t.table, t.key)
+		if t.table == "messages" {
+			rec.Messages, rec.Unreadable, last = copied, unreadable, max
+		}
+	}
+	// ids must not be handed out again, outputs and importers may know them
+	var seq int64
+	src.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'messages'").Scan(&seq)
+	if seq < last {
+		seq = last
+	}
+	if seq > 0 {
+		res, err := tx.Exec("UPDATE sqlite_sequence SET seq = max(seq, ?) WHERE name = 'messages'", seq)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				_, err = tx.Exec("INSERT INTO sqlite_sequence(name, seq) VALUES ('messages', ?)", seq)
+			}
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// drop what refers to lost rows and queue unsent messages whose pending
+	// rows were lost for every sink again
+	for _, q := range []string{
+		"DELETE FROM pending WHERE message_id NOT IN (SELECT id FROM messages)",
+		"DELETE FROM pending WHERE sink NOT IN (SELECT name FROM sinks)",
+		`INSERT INTO pending(sink, message_id, priority) SELECT s.name, m.id, m.priority FROM sinks s, messages m
+			WHERE m.sent = 0 AND NOT EXISTS (SELECT 1 FROM pending p WHERE p.message_id = m.id)`,
+	} {
+		if _, err := tx.Exec(q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// salvageTable copies table from src to dst in ranges of its integer key. A
+// range that cannot be read is retried row by row. It returns the rows
+// copied, the ids that could not be read and the highest id seen.
+func salvageTable(src *sql.DB, dst *sql.Tx, table, key string) (copied, unreadable, max int64) {
+	var lo, hi sql.NullInt64
+	src.QueryRow("SELECT min(" + key + ") FROM " + table).Scan(&lo)
+	if err := src.QueryRow("SELECT max(" + key + ") FROM " + table).Scan(&hi); err != nil {
+		// without the upper end, read in order until the damage
+		n, _, err := copyRows(src, dst, table, key, 0, 0)
+		if err != nil {
+			fmt.Printf("buffer: recovering %s: %v\n", table, err)
+		}
+		return n, 0, 0
+	}
+	if !hi.Valid {
+		return 0, 0, 0
+	}
+	for from := lo.Int64; from <= hi.Int64; from += salvageRange {
+		to := from + salvageRange - 1
+		n, ok, err := copyRows(src, dst, table, key, from, to)
+		copied += n
+		if ok {
+			continue
+		}
+		fmt.Printf("buffer: recovering %s: ids %d-%d: %v\n", table, from, to, err)
+		for id := from; id <= to; id++ {
+			if n, ok, _ := copyRows(src, dst, table, key, id, id); ok {
+				copied += n
+			} else {
+				unreadable++
+			}
+		}
+	}
+	return copied, unreadable, hi.Int64
+}
+
+// copyRows copies the rows of table with key between from and to, or all rows
+// when key is empty or from and to are zero. It returns how many rows were
+// added to dst and whether all of them could be read. The rows are read in
+// key order, so on a read error the rows before it have been copied.
+func copyRows(src *sql.DB, dst *sql.Tx, table, key string, from, to int64) (int64, bool, error) {
+	cols, err := columns(dst, table)
+	if err != nil {
+		return 0, false, err
+	}
+	q := "SELECT " + strings.Join(cols, ", ") + " FROM " + table
+	var args []interface{}
+	if key != "" {
+		if from != 0 || to != 0 {
+			q += " WHERE " + key + " BETWEEN ? AND ?"
+			args = append(args, from, to)
+		}
+		q += " ORDER BY " + key
+	}
+	rows, err := src.Query(q, args...)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	ins := "INSERT OR IGNORE INTO " + table + "(" + strings.Join(cols, ", ") + ") VALUES (?" + strings.Repeat(", ?", len(cols)-1) + ")"
+	var n int64
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, false, err
+		}
+		res, err := dst.Exec(ins, vals...)
+		if err != nil {
+			return n, false, err
+		}
+		added, _ := res.RowsAffected()
+		n += added
+	}
+	if err := rows.Err(); err != nil {
+		return n, false, err
+	}
+	return n, true, nil
+}
+
+// columns lists the columns of table in the current schema.
+func columns(tx *sql.Tx, table string) ([]string, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("no table %s", table)
+	}
+	return cols, rows.Err()
+}
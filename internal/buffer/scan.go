@@ -0,0 +1,54 @@
+package buffer
+
+import (
+	"errors"
+	"math"
+)
+
+// Scanner is implemented by buffers that can list their unsent messages in
+// id order, independent of delivery order and leases. It is used to copy a
+// buffer elsewhere, e.g. to export it.
+type Scanner interface {
+	// Scan returns up to limit unsent messages with an id above after,
+	// ordered by id.
+	Scan(after int64, limit int) ([]Message, error)
+}
+
+var (
+	_ Scanner = (*Store)(nil)
+	_ Scanner = (*SegmentLog)(nil)
+)
+
+// Scan returns up to limit messages not yet sent to every sink with an id
+// above after, ordered by id.
+func (s *Store) Scan(after int64, limit int) ([]Message, error) {
+	if s == nil || s.db == nil {
+		return nil, errors.New("store not initialized")
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.db.Query("SELECT id, topic, payload, codec, key_id, block_id, created_at, sent, priority FROM messages WHERE sent=0 AND id > ? ORDER BY id LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	return s.scanMessages(rows)
+}
+
+// Scan returns up to limit messages some sink has not acknowledged with an id
+// above after, ordered by id.
+func (l *SegmentLog) Scan(after int64, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, errors.New("store not initialized")
+	}
+	c := l.sent()
+	if after < c.Offset {
+		after = c.Offset
+	}
+	return l.read(c, after, math.MaxInt64, limit)
+}
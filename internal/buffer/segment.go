@@ -0,0 +1,776 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segment record layout, little endian:
+//
+//	crc32c of the body | uint32 body length | body
+//	body: uint64 id | int64 created (unix seconds) | uint16 topic length | topic | payload
+const (
+	recordHeader = 8
+	bodyFixed    = 8 + 8 + 2
+)
+
+const (
+	DefaultSegmentBytes = 16 << 20
+	segmentExt          = ".seg"
+	acksFile            = "acks.json"
+	reservedFile        = "reserved"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SegmentOptions configures a SegmentLog.
+type SegmentOptions struct {
+	// SegmentBytes is the size from which a new segment file is started.
+	SegmentBytes int64
+	// SyncInterval delays fsync of appended records by up to this long, so
+	// records arriving together are synced together. Zero syncs every append.
+	SyncInterval time.Duration
+}
+
+// SegmentLog is a Buffer kept in append-only segment files instead of a
+// database, for storage such as SD cards that wears out under the small
+// random writes of SQLite. Records are only ever appended and are checked
+// with a CRC when read back; delivery progress is kept per sink in a separate
+// acks file as the highest acknowledged id plus the ids acknowledged out of
+// order above it. Delivered data is removed by deleting whole segments once
+// every sink has acknowledged all their records, so PurgeSent frees space in
+// segment-sized steps.
+//
+// On open, the segments are scanned to rebuild the in-memory index. A torn
+// record at the end of the last segment, left by a crash during an append,
+// is truncated; records after a corrupt one in an older segment are skipped.
+type SegmentLog struct {
+	dir  string
+	opts SegmentOptions
+
+	mu        sync.Mutex
+	segs      []*segment
+	index     []entry
+	nextID    int64
+	reserved  int64
+	cursors   map[string]*cursor
+	syncTimer *time.Timer
+	closed    bool
+
+	leases
+}
+
+type segment struct {
+	first int64
+	path  string
+	f     *os.File
+	size  int64
+	last  int64
+}
+
+// entry locates a live record. cum is the payload bytes of all records
+// appended since the log was opened, up to and including this one.
+type entry struct {
+	id   int64
+	cum  int64
+	seg  *segment
+	off  int64
+	n    uint32
+	size uint32
+}
+
+// cursor is the delivery progress of one sink: every id up to offset and the
+// ids in acked have been acknowledged.
+type cursor struct {
+	Offset int64   `json:"offset"`
+	Acked  []int64 `json:"acked,omitempty"`
+	acked  map[int64]bool
+}
+
+// OpenSegmentLog opens or creates a segment log in dir.
+func OpenSegmentLog(dir string, opts SegmentOptions) (*SegmentLog, error) {
+	if dir == "" {
+		return nil, errors.New("buffer path is empty")
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = DefaultSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &SegmentLog{dir: dir, opts: opts, nextID: 1}
+	l.leases.fetch = l.FetchPending
+	if err := l.recover(); err != nil {
+		l.closeFiles()
+		return nil, err
+	}
+	if err := l.loadAcks(); err != nil {
+		l.closeFiles()
+		return nil, err
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, reservedFile)); err == nil {
+		l.reserved, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	return l, nil
+}
+
+// recover rebuilds the index from the segment files.
+func (l *SegmentLog) recover() error {
+	names, err := filepath.Glob(filepath.Join(l.dir, "*"+segmentExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		first, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segs = append(l.segs, &segment{first: first, path: name})
+	}
+	sort.Slice(l.segs, func(i, j int) bool { return l.segs[i].first < l.segs[j].first })
+
+	var cum int64
+	for i, seg := range l.segs {
+		f, err := os.OpenFile(seg.path, os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		seg.f = f
+		if seg.first > l.nextID {
+			l.nextID = seg.first
+		}
+		var off int64
+		for {
+			id, _, _, payload, n, err := readRecord(f, off)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if i == len(l.segs)-1 {
+					fmt.Printf("buffer: truncating %s at offset %d: %v\n", seg.path, off, err)
+					if err := f.Truncate(off); err != nil {
+						return err
+					}
+				} else {
+					fmt.Printf("buffer: skipping rest of %s from offset %d: %v\n", seg.path, off, err)
+				}
+				break
+			}
+			if id < l.nextID {
+				fmt.Printf("buffer: skipping rest of %s from offset %d: id %d out of order\n", seg.path, off, id)
+				break
+			}
+			cum += int64(len(payload))
+			l.index = append(l.index, entry{id: id, cum: cum, seg: seg, off: off, n: n, size: uint32(len(payload))})
+			seg.last = id
+			l.nextID = id + 1
+			off += int64(recordHeader + n)
+		}
+		seg.size = off
+	}
+	return nil
+}
+
+// readRecord reads and checks the record at off.
+func readRecord(f *os.File, off int64) (id, created int64, topic string, payload []byte, n uint32, err error) {
+	var hdr [recordHeader]byte
+	if _, err = f.ReadAt(hdr[:], off); err != nil {
+		if err == io.EOF && !isZero(hdr[:]) {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	n = binary.LittleEndian.Uint32(hdr[4:])
+	if n < bodyFixed {
+		err = fmt.Errorf("bad record length %d", n)
+		return
+	}
+	body := make([]byte, n)
+	if _, err = f.ReadAt(body, off+recordHeader); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(hdr[:4]) {
+		err = errors.New("checksum mismatch")
+		return
+	}
+	id = int64(binary.LittleEndian.Uint64(body))
+	created = int64(binary.LittleEndian.Uint64(body[8:]))
+	tl := int(binary.LittleEndian.Uint16(body[16:]))
+	if bodyFixed+tl > len(body) {
+		err = errors.New("bad topic length")
+		return
+	}
+	topic = string(body[bodyFixed : bodyFixed+tl])
+	payload = body[bodyFixed+tl:]
+	return
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *SegmentLog) loadAcks() error {
+	l.cursors = map[string]*cursor{"": {acked: map[int64]bool{}}}
+	b, err := os.ReadFile(filepath.Join(l.dir, acksFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cursors map[string]*cursor
+	if err := json.Unmarshal(b, &cursors); err != nil || len(cursors) == 0 {
+		// everything still buffered is delivered again
+		fmt.Printf("buffer: ignoring unreadable %s: %v\n", acksFile, err)
+		return nil
+	}
+	for _, c := range cursors {
+		c.acked = make(map[int64]bool, len(c.Acked))
+		for _, id := range c.Acked {
+			c.acked[id] = true
+		}
+	}
+	l.cursors = cursors
+	return nil
+}
+
+// saveAcks replaces the acks file. It is not synced: after a crash, at worst
+// recently acknowledged messages are delivered again.
+func (l *SegmentLog) saveAcks() error {
+	for _, c := range l.cursors {
+		c.Acked = c.Acked[:0]
+		for id := range c.acked {
+			c.Acked = append(c.Acked, id)
+		}
+		sort.Slice(c.Acked, func(i, j int) bool { return c.Acked[i] < c.Acked[j] })
+	}
+	b, err := json.Marshal(l.cursors)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, acksFile)
+	if err := os.WriteFile(path+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (l *SegmentLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.syncTimer != nil {
+		l.syncTimer.Stop()
+	}
+	var err error
+	if len(l.segs) > 0 {
+		err = l.segs[len(l.segs)-1].f.Sync()
+	}
+	if serr := l.saveAcks(); err == nil {
+		err = serr
+	}
+	l.closeFiles()
+	return err
+}
+
+func (l *SegmentLog) closeFiles() {
+	for _, seg := range l.segs {
+		if seg.f != nil {
+			seg.f.Close()
+		}
+	}
+}
+
+func (l *SegmentLog) Enqueue(payload []byte) (int64, error) {
+	return l.EnqueueTopic("", payload)
+}
+
+// EnqueueTopic appends the message to the active segment.
+func (l *SegmentLog) EnqueueTopic(topic string, payload []byte) (int64, error) {
+	ids, err := l.EnqueueBatch([]Message{{Topic: topic, Payload: payload}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// EnqueueBatch appends msgs and syncs them together.
+func (l *SegmentLog) EnqueueBatch(msgs []Message) ([]int64, error) {
+	if len(msgs) == 0 {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.nextID
+	if id <= l.reserved {
+		id = l.reserved + 1
+	}
+	batch := make([]Message, len(msgs))
+	ids := make([]int64, len(msgs))
+	now := time.Now()
+	for i, m := range msgs {
+		batch[i] = Message{ID: id + int64(i), Topic: m.Topic, Payload: m.Payload, CreatedAt: m.CreatedAt}
+		if batch[i].CreatedAt.IsZero() {
+			batch[i].CreatedAt = now
+		}
+		ids[i] = batch[i].ID
+	}
+	if err := l.appendBatch(batch); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// enqueueAt appends messages under the ids and creation times chosen by the
+// caller, which must be increasing and above every id appended so far.
+func (l *SegmentLog) enqueueAt(msgs []Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.nextID
+	for _, m := range msgs {
+		if m.ID < next {
+			return fmt.Errorf("id %d is not above the last id %d", m.ID, next-1)
+		}
+		next = m.ID + 1
+	}
+	return l.appendBatch(msgs)
+}
+
+// appendBatch appends msgs and syncs them. If an append fails, the records
+// appended before it are removed again.
+func (l *SegmentLog) appendBatch(msgs []Message) error {
+	if l.closed {
+		return errors.New("store not initialized")
+	}
+	for _, m := range msgs {
+		if len(m.Topic) > 0xffff {
+			return errors.New("topic too long")
+		}
+	}
+	nsegs, nindex, nextID := len(l.segs), len(l.index), l.nextID
+	var size, last int64
+	if seg := l.active(); seg != nil {
+		size, last = seg.size, seg.last
+	}
+	var seg *segment
+	for _, m := range msgs {
+		var err error
+		if seg, err = l.append(m.ID, m.Topic, m.Payload, m.CreatedAt); err != nil {
+			l.truncate(nsegs, nindex, nextID, size, last)
+			return err
+		}
+	}
+	if seg == nil {
+		return nil
+	}
+	return l.sync(seg)
+}
+
+// truncate drops what was appended after the log had nsegs segments, the
+// last one of size bytes ending at id last.
+func (l *SegmentLog) truncate(nsegs, nindex int, nextID, size, last int64) {
+	for _, seg := range l.segs[nsegs:] {
+		seg.f.Close()
+		os.Remove(seg.path)
+	}
+	l.segs = l.segs[:nsegs]
+	if seg := l.active(); seg != nil {
+		_ = seg.f.Truncate(size)
+		seg.size, seg.last = size, last
+	}
+	l.index = l.index[:nindex]
+	l.nextID = nextID
+}
+
+// append writes one record to the active segment, starting a new segment
+// when it is full, and returns the segment written to.
+func (l *SegmentLog) append(id int64, topic string, payload []byte, created time.Time) (*segment, error) {
+	seg := l.active()
+	if seg == nil || seg.size >= l.opts.SegmentBytes {
+		var err error
+		if seg, err = l.rotate(id); err != nil {
+			return nil, err
+		}
+	}
+
+	n := bodyFixed + len(topic) + len(payload)
+	rec := make([]byte, recordHeader+n)
+	body := rec[recordHeader:]
+	binary.LittleEndian.PutUint64(body, uint64(id))
+	binary.LittleEndian.PutUint64(body[8:], uint64(created.Unix()))
+	binary.LittleEndian.PutUint16(body[16:], uint16(len(topic)))
+	copy(body[bodyFixed:], topic)
+	copy(body[bodyFixed+len(topic):], payload)
+	binary.LittleEndian.PutUint32(rec, crc32.Checksum(body, crcTable))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(n))
+
+	if _, err := seg.f.WriteAt(rec, seg.size); err != nil {
+		// drop a partial record so the next append starts clean
+		_ = seg.f.Truncate(seg.size)
+		return nil, err
+	}
+	var cum int64
+	if len(l.index) > 0 {
+		cum = l.index[len(l.index)-1].cum
+	}
+	l.index = append(l.index, entry{id: id, cum: cum + int64(len(payload)), seg: seg, off: seg.size, n: uint32(n), size: uint32(len(payload))})
+	seg.size += int64(len(rec))
+	seg.last = id
+	l.nextID = id + 1
+	return seg, nil
+}
+
+// lastID returns the highest id appended or reserved so far.
+func (l *SegmentLog) lastID() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reserved >= l.nextID {
+		return l.reserved, nil
+	}
+	return l.nextID - 1, nil
+}
+
+// reserveIDs keeps EnqueueTopic from handing out ids up to id, which the
+// caller assigns itself. The reservation is kept in a small file next to the
+// segments, since the segments holding those ids may never be written.
+func (l *SegmentLog) reserveIDs(id int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id <= l.reserved {
+		return nil
+	}
+	path := filepath.Join(l.dir, reservedFile)
+	if err := os.WriteFile(path+".tmp", []byte(strconv.FormatInt(id, 10)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	l.reserved = id
+	return nil
+}
+
+func (l *SegmentLog) active() *segment {
+	if len(l.segs) == 0 {
+		return nil
+	}
+	return l.segs[len(l.segs)-1]
+}
+
+// rotate starts a new segment named after the id of its first record.
+func (l *SegmentLog) rotate(first int64) (*segment, error) {
+	if old := l.active(); old != nil {
+		if err := old.f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{first: first, path: path, f: f}
+	l.segs = append(l.segs, seg)
+	return seg, nil
+}
+
+// sync makes appended records durable, at once or within SyncInterval.
+func (l *SegmentLog) sync(seg *segment) error {
+	if l.opts.SyncInterval <= 0 {
+		return seg.f.Sync()
+	}
+	if l.syncTimer == nil {
+		l.syncTimer = time.AfterFunc(l.opts.SyncInterval, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.syncTimer = nil
+			if !l.closed {
+				if err := seg.f.Sync(); err != nil {
+					fmt.Printf("buffer: sync %s: %v\n", seg.path, err)
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// SetSinks registers the sinks messages are delivered to, like Store.SetSinks.
+func (l *SegmentLog) SetSinks(names []string) error {
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		if n == "" {
+			return errors.New("sink name is empty")
+		}
+		want[n] = true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sent := l.sent()
+	cursors := make(map[string]*cursor, len(want))
+	for n := range want {
+		if c, ok := l.cursors[n]; ok {
+			cursors[n] = c
+		} else {
+			// a new sink receives everything that is still unsent
+			cursors[n] = sent.clone()
+		}
+	}
+	if len(cursors) == 0 {
+		cursors[""] = sent
+	}
+	l.cursors = cursors
+	return l.saveAcks()
+}
+
+// sent returns the progress shared by all sinks: the messages every sink has
+// acknowledged.
+func (l *SegmentLog) sent() *cursor {
+	var min *cursor
+	for _, c := range l.cursors {
+		if min == nil || c.Offset < min.Offset {
+			min = c
+		}
+	}
+	out := &cursor{acked: map[int64]bool{}}
+	if min == nil {
+		return out
+	}
+	out.Offset = min.Offset
+	for id := range min.acked {
+		all := true
+		for _, c := range l.cursors {
+			if id > c.Offset && !c.acked[id] {
+				all = false
+				break
+			}
+		}
+		if all {
+			out.acked[id] = true
+		}
+	}
+	l.advance(out)
+	return out
+}
+
+func (c *cursor) clone() *cursor {
+	out := &cursor{Offset: c.Offset, acked: make(map[int64]bool, len(c.acked))}
+	for id := range c.acked {
+		out.acked[id] = true
+	}
+	return out
+}
+
+// progress returns the cursor of sink; an empty name is the shared progress.
+func (l *SegmentLog) progress(sink string) *cursor {
+	if c, ok := l.cursors[sink]; ok {
+		return c
+	}
+	if sink == "" {
+		return l.sent()
+	}
+	return nil
+}
+
+// advance moves the offset of c over acknowledged ids.
+func (l *SegmentLog) advance(c *cursor) {
+	for i := l.after(c.Offset); i < len(l.index); i++ {
+		id := l.index[i].id
+		if !c.acked[id] {
+			break
+		}
+		delete(c.acked, id)
+		c.Offset = id
+	}
+}
+
+// after returns the index position of the first record with an id above id.
+func (l *SegmentLog) after(id int64) int {
+	return sort.Search(len(l.index), func(i int) bool { return l.index[i].id > id })
+}
+
+func (l *SegmentLog) FetchUnsent(limit int) ([]Message, error) {
+	return l.FetchPending("", limit)
+}
+
+// FetchPending returns up to limit messages not yet acknowledged by sink,
+// ordered by id. An empty sink name returns the messages some sink has not
+// acknowledged yet.
+func (l *SegmentLog) FetchPending(sink string, limit int) ([]Message, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, errors.New("store not initialized")
+	}
+	c := l.progress(sink)
+	if c == nil {
+		return nil, nil
+	}
+	return l.read(c, c.Offset, math.MaxInt64, limit)
+}
+
+// fetchBefore is FetchPending limited to messages with an id below before.
+func (l *SegmentLog) fetchBefore(sink string, before int64, limit int) ([]Message, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil, errors.New("store not initialized")
+	}
+	c := l.progress(sink)
+	if c == nil {
+		return nil, nil
+	}
+	return l.read(c, c.Offset, before, limit)
+}
+
+// read returns up to limit messages with an id above after and below before
+// that c has not acknowledged.
+func (l *SegmentLog) read(c *cursor, after, before int64, limit int) ([]Message, error) {
+	var out []Message
+	for i := l.after(after); i < len(l.index) && l.index[i].id < before && len(out) < limit; i++ {
+		e := l.index[i]
+		if c.acked[e.id] {
+			continue
+		}
+		id, created, topic, payload, _, err := readRecord(e.seg.f, e.off)
+		if err == nil && id != e.id {
+			err = fmt.Errorf("found id %d", id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %s: %w", e.id, e.seg.path, err)
+		}
+		out = append(out, Message{ID: id, Topic: topic, Payload: payload, CreatedAt: time.Unix(created, 0)})
+	}
+	return out, nil
+}
+
+func (l *SegmentLog) CountUnsent() (int, error) {
+	return l.CountPending("")
+}
+
+// CountPending returns the number of messages not yet acknowledged by sink.
+func (l *SegmentLog) CountPending(sink string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.progress(sink)
+	if c == nil {
+		return 0, nil
+	}
+	return len(l.index) - l.after(c.Offset) - len(c.acked), nil
+}
+
+// PendingBytes returns the payload size of unsent messages.
+func (l *SegmentLog) PendingBytes() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.index) == 0 {
+		return 0, nil
+	}
+	c := l.sent()
+	i := l.after(c.Offset)
+	var size int64
+	if i < len(l.index) {
+		size = l.index[len(l.index)-1].cum - l.index[i].cum + int64(l.index[i].size)
+	}
+	for id := range c.acked {
+		if j := l.after(id - 1); j < len(l.index) && l.index[j].id == id {
+			size -= int64(l.index[j].size)
+		}
+	}
+	return size, nil
+}
+
+// MarkSent acknowledges ids for every sink.
+func (l *SegmentLog) MarkSent(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	defer l.leases.acked("", ids)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.cursors {
+		l.ack(c, ids)
+	}
+	return l.saveAcks()
+}
+
+// Ack records that sink has delivered the given messages. An empty sink name
+// is the same as MarkSent.
+func (l *SegmentLog) Ack(sink string, ids []int64) error {
+	if sink == "" {
+		return l.MarkSent(ids)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	defer l.leases.acked(sink, ids)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.cursors[sink]
+	if !ok {
+		return nil
+	}
+	l.ack(c, ids)
+	return l.saveAcks()
+}
+
+func (l *SegmentLog) ack(c *cursor, ids []int64) {
+	for _, id := range ids {
+		if id <= c.Offset {
+			continue
+		}
+		if i := l.after(id - 1); i < len(l.index) && l.index[i].id == id {
+			c.acked[id] = true
+		}
+	}
+	l.advance(c)
+}
+
+// PurgeSent deletes the segments whose messages every sink has acknowledged,
+// except the one being appended to, and returns how many messages they held.
+func (l *SegmentLog) PurgeSent() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sent := l.sent()
+	var n int64
+	for len(l.segs) > 1 && l.segs[0].last <= sent.Offset {
+		seg := l.segs[0]
+		seg.f.Close()
+		if err := os.Remove(seg.path); err != nil {
+			return n, err
+		}
+		l.segs = l.segs[1:]
+		i := l.after(seg.last)
+		n += int64(i)
+		l.index = append(l.index[:0:0], l.index[i:]...)
+	}
+	return n, nil
+}
@@ -0,0 +1,861 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// backends lists the Buffer implementations that must pass the shared suite.
+// open reopens the buffer in dir, so tests can check what survives a restart.
+var backends = []struct {
+	name string
+	open func(dir string) (Buffer, error)
+}{
+	{"sqlite", func(dir string) (Buffer, error) { return Init(filepath.Join(dir, "buffer.db")) }},
+	{"segment", func(dir string) (Buffer, error) {
+		// small segments so tests cross segment boundaries
+		return OpenSegmentLog(dir, SegmentOptions{SegmentBytes: 256})
+	}},
+	// small rings so tests cross from memory to disk
+	{"memory-durable", func(dir string) (Buffer, error) {
+		return withMemory(Init(filepath.Join(dir, "buffer.db")))(HybridOptions{Mode: ModeDurable, MaxMessages: 8})
+	}},
+	{"memory-overflow", func(dir string) (Buffer, error) {
+		return withMemory(OpenSegmentLog(dir, SegmentOptions{SegmentBytes: 256}))(HybridOptions{Mode: ModeOverflow, MaxMessages: 8})
+	}},
+}
+
+// withMemory returns a function putting a Hybrid ring in front of disk.
+func withMemory(disk Buffer, err error) func(HybridOptions) (Buffer, error) {
+	return func(opts HybridOptions) (Buffer, error) {
+		if err != nil {
+			return nil, err
+		}
+		return NewHybrid(disk, opts)
+	}
+}
+
+func TestBufferSuite(t *testing.T) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("FetchAndMarkSent", func(t *testing.T) { suiteFetchAndMarkSent(t, b.open) })
+			t.Run("PerSinkDelivery", func(t *testing.T) { suitePerSinkDelivery(t, b.open) })
+			t.Run("OutOfOrderAck", func(t *testing.T) { suiteOutOfOrderAck(t, b.open) })
+			t.Run("Reopen", func(t *testing.T) { suiteReopen(t, b.open) })
+			t.Run("EnqueueBatch", func(t *testing.T) { suiteEnqueueBatch(t, b.open) })
+			t.Run("Lease", func(t *testing.T) { suiteLease(t, b.open) })
+			t.Run("Scan", func(t *testing.T) { suiteScan(t, b.open) })
+		})
+	}
+}
+
+func openBuffer(t *testing.T, open func(string) (Buffer, error), dir string) Buffer {
+	t.Helper()
+	buf, err := open(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return buf
+}
+
+func enqueueN(t *testing.T, buf Buffer, n int) []int64 {
+	t.Helper()
+	ids := make([]int64, n)
+	for i := range ids {
+		id, err := buf.EnqueueTopic(fmt.Sprintf("t/%d", i), []byte(fmt.Sprintf("payload-%03d", i)))
+		if err != nil {
+			t.Fatalf("EnqueueTopic: %v", err)
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+func pendingIDs(t *testing.T, buf Buffer, sink string) []int64 {
+	t.Helper()
+	msgs, err := buf.FetchPending(sink, 1000)
+	if err != nil {
+		t.Fatalf("FetchPending(%q): %v", sink, err)
+	}
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	return ids
+}
+
+func suiteFetchAndMarkSent(t *testing.T, open func(string) (Buffer, error)) {
+	buf := openBuffer(t, open, t.TempDir())
+	defer buf.Close()
+
+	ids := enqueueN(t, buf, 30)
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("ids not increasing: %v", ids)
+		}
+	}
+	msgs, err := buf.FetchUnsent(10)
+	if err != nil || len(msgs) != 10 {
+		t.Fatalf("FetchUnsent = %d, %v", len(msgs), err)
+	}
+	if msgs[3].Topic != "t/3" || string(msgs[3].Payload) != "payload-003" || msgs[3].CreatedAt.IsZero() {
+		t.Fatalf("unexpected message %+v", msgs[3])
+	}
+	size, _ := buf.PendingBytes()
+	if size != 30*11 {
+		t.Fatalf("PendingBytes = %d, want %d", size, 30*11)
+	}
+
+	if err := buf.MarkSent(ids[:20]); err != nil {
+		t.Fatalf("MarkSent: %v", err)
+	}
+	if n, _ := buf.CountUnsent(); n != 10 {
+		t.Fatalf("CountUnsent = %d, want 10", n)
+	}
+	if size, _ := buf.PendingBytes(); size != 10*11 {
+		t.Fatalf("PendingBytes = %d after MarkSent", size)
+	}
+	if _, err := buf.PurgeSent(); err != nil {
+		t.Fatalf("PurgeSent: %v", err)
+	}
+	if got := pendingIDs(t, buf, ""); len(got) != 10 || got[0] != ids[20] {
+		t.Fatalf("unexpected unsent ids after purge: %v", got)
+	}
+}
+
+func suitePerSinkDelivery(t *testing.T, open func(string) (Buffer, error)) {
+	buf := openBuffer(t, open, t.TempDir())
+	defer buf.Close()
+
+	// messages buffered before sinks are registered go to all of them
+	before := enqueueN(t, buf, 3)
+	if err := buf.SetSinks([]string{"kafka", "historian"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	after := enqueueN(t, buf, 3)
+	all := append(before, after...)
+
+	if got := pendingIDs(t, buf, "kafka"); len(got) != 6 {
+		t.Fatalf("kafka pending %v", got)
+	}
+	if err := buf.Ack("kafka", all); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if n, _ := buf.CountPending("kafka"); n != 0 {
+		t.Fatalf("kafka still has %d pending", n)
+	}
+	if n, _ := buf.CountPending("historian"); n != 6 {
+		t.Fatalf("historian pending = %d, want 6", n)
+	}
+	if _, err := buf.PurgeSent(); err != nil {
+		t.Fatalf("PurgeSent: %v", err)
+	}
+	if got := pendingIDs(t, buf, "historian"); len(got) != 6 {
+		t.Fatalf("purge removed messages still pending for historian: %v", got)
+	}
+
+	if err := buf.Ack("historian", all[:2]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if n, _ := buf.CountUnsent(); n != 4 {
+		t.Fatalf("CountUnsent = %d, want 4", n)
+	}
+
+	// a new sink receives what is still unsent
+	if err := buf.SetSinks([]string{"kafka", "historian", "archive"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	if got := pendingIDs(t, buf, "archive"); len(got) != 4 || got[0] != all[2] {
+		t.Fatalf("archive pending %v", got)
+	}
+	if got := pendingIDs(t, buf, "unknown"); len(got) != 0 {
+		t.Fatalf("unknown sink has pending messages: %v", got)
+	}
+
+	// removing sinks releases what only they were waiting for
+	if err := buf.SetSinks([]string{"kafka"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	if n, _ := buf.CountUnsent(); n != 0 {
+		t.Fatalf("CountUnsent = %d after removing sinks", n)
+	}
+}
+
+func suiteOutOfOrderAck(t *testing.T, open func(string) (Buffer, error)) {
+	buf := openBuffer(t, open, t.TempDir())
+	defer buf.Close()
+	if err := buf.SetSinks([]string{"a"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	ids := enqueueN(t, buf, 5)
+	if err := buf.Ack("a", []int64{ids[1], ids[3]}); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	got := pendingIDs(t, buf, "a")
+	if len(got) != 3 || got[0] != ids[0] || got[1] != ids[2] || got[2] != ids[4] {
+		t.Fatalf("pending after out-of-order ack: %v", got)
+	}
+	if n, _ := buf.CountPending("a"); n != 3 {
+		t.Fatalf("CountPending = %d, want 3", n)
+	}
+	if size, _ := buf.PendingBytes(); size != 3*11 {
+		t.Fatalf("PendingBytes = %d, want %d", size, 3*11)
+	}
+	if err := buf.Ack("a", []int64{ids[0], ids[2]}); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if got := pendingIDs(t, buf, "a"); len(got) != 1 || got[0] != ids[4] {
+		t.Fatalf("pending %v, want only the last message", got)
+	}
+}
+
+func suiteReopen(t *testing.T, open func(string) (Buffer, error)) {
+	dir := t.TempDir()
+	buf := openBuffer(t, open, dir)
+	if err := buf.SetSinks([]string{"a", "b"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	ids := enqueueN(t, buf, 20)
+	if err := buf.Ack("a", ids[:15]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := buf.Ack("b", append(ids[:5:5], ids[7])); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if _, err := buf.PurgeSent(); err != nil {
+		t.Fatalf("PurgeSent: %v", err)
+	}
+	if err := buf.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	buf = openBuffer(t, open, dir)
+	defer buf.Close()
+	if err := buf.SetSinks([]string{"a", "b"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	if got := pendingIDs(t, buf, "a"); len(got) != 5 || got[0] != ids[15] {
+		t.Fatalf("a pending after reopen: %v", got)
+	}
+	if got := pendingIDs(t, buf, "b"); len(got) != 14 || got[0] != ids[5] {
+		t.Fatalf("b pending after reopen: %v", got)
+	}
+	// ids are not reused
+	id, err := buf.Enqueue([]byte("new"))
+	if err != nil || id <= ids[len(ids)-1] {
+		t.Fatalf("Enqueue after reopen = %d, %v", id, err)
+	}
+}
+
+func suiteEnqueueBatch(t *testing.T, open func(string) (Buffer, error)) {
+	buf := openBuffer(t, open, t.TempDir())
+	defer buf.Close()
+	if err := buf.SetSinks([]string{"a"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	first := enqueueN(t, buf, 2)
+	batch := make([]Message, 25)
+	for i := range batch {
+		batch[i] = Message{Topic: fmt.Sprintf("b/%d", i), Payload: []byte(fmt.Sprintf("batch-%03d", i))}
+	}
+	ids, err := buf.EnqueueBatch(batch)
+	if err != nil || len(ids) != len(batch) {
+		t.Fatalf("EnqueueBatch = %d ids, %v", len(ids), err)
+	}
+	if ids[0] <= first[1] {
+		t.Fatalf("batch ids %v not above %d", ids, first[1])
+	}
+	msgs, err := buf.FetchPending("a", 100)
+	if err != nil || len(msgs) != 27 {
+		t.Fatalf("FetchPending = %d, %v", len(msgs), err)
+	}
+	for i, m := range msgs[2:] {
+		if m.ID != ids[i] || m.Topic != batch[i].Topic || string(m.Payload) != string(batch[i].Payload) {
+			t.Fatalf("message %d = %+v, want id %d %+v", i, m, ids[i], batch[i])
+		}
+	}
+	if ids, err := buf.EnqueueBatch(nil); err != nil || len(ids) != 0 {
+		t.Fatalf("empty EnqueueBatch = %v, %v", ids, err)
+	}
+}
+
+func suiteScan(t *testing.T, open func(string) (Buffer, error)) {
+	buf := openBuffer(t, open, t.TempDir())
+	defer buf.Close()
+	sc, ok := buf.(Scanner)
+	if !ok {
+		t.Skipf("%T does not implement Scanner", buf)
+	}
+	if err := buf.SetSinks([]string{"a", "b"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	ids, err := buf.EnqueueBatch([]Message{
+		{Payload: []byte("m0"), CreatedAt: created},
+		{Payload: []byte("m1"), CreatedAt: created},
+		{Payload: []byte("m2"), CreatedAt: created},
+		{Payload: []byte("m3"), CreatedAt: created},
+	})
+	if err != nil {
+		t.Fatalf("EnqueueBatch: %v", err)
+	}
+	// sent to one sink only is still unsent
+	if err := buf.Ack("a", ids[:2]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := buf.Ack("b", ids[1:2]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	msgs, err := sc.Scan(0, 2)
+	if err != nil || len(msgs) != 2 || msgs[0].ID != ids[0] || msgs[1].ID != ids[2] {
+		t.Fatalf("Scan(0, 2) = %+v, %v; want ids %d and %d", msgs, err, ids[0], ids[2])
+	}
+	if !msgs[0].CreatedAt.Equal(created) {
+		t.Fatalf("CreatedAt = %v, want %v", msgs[0].CreatedAt, created)
+	}
+	msgs, err = sc.Scan(ids[2], 10)
+	if err != nil || len(msgs) != 1 || msgs[0].ID != ids[3] {
+		t.Fatalf("Scan(%d) = %+v, %v; want id %d", ids[2], msgs, err, ids[3])
+	}
+}
+
+func suiteLease(t *testing.T, open func(string) (Buffer, error)) {
+	buf := openBuffer(t, open, t.TempDir())
+	defer buf.Close()
+	if err := buf.SetSinks([]string{"a", "b"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	ids := enqueueN(t, buf, 10)
+	l, ok := buf.(Leaser)
+	if !ok {
+		t.Fatalf("%T does not implement Leaser", buf)
+	}
+	lease := func(owner string, limit int, ttl time.Duration) []int64 {
+		t.Helper()
+		msgs, err := l.Lease("a", owner, limit, ttl)
+		if err != nil {
+			t.Fatalf("Lease: %v", err)
+		}
+		out := make([]int64, len(msgs))
+		for i, m := range msgs {
+			out[i] = m.ID
+		}
+		return out
+	}
+
+	w1 := lease("w1", 4, time.Minute)
+	w2 := lease("w2", 4, 50*time.Millisecond)
+	if len(w1) != 4 || len(w2) != 4 || w2[0] != ids[4] {
+		t.Fatalf("leases overlap: w1 %v, w2 %v", w1, w2)
+	}
+	// other sinks are not affected
+	if got := pendingIDs(t, buf, "b"); len(got) != 10 {
+		t.Fatalf("b pending %v", got)
+	}
+	if err := buf.Ack("a", w1[:2]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := l.Release("a", "w1", w1[2:], 0); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := lease("w3", 10, time.Minute); len(got) != 4 || got[0] != w1[2] || got[2] != ids[8] {
+		t.Fatalf("w3 leased %v, want the released and the unleased messages", got)
+	}
+
+	// an expired lease returns its messages and cannot be extended
+	time.Sleep(60 * time.Millisecond)
+	if err := l.Extend("a", "w2", w2, time.Minute); err != ErrLeaseLost {
+		t.Fatalf("Extend of expired lease = %v, want ErrLeaseLost", err)
+	}
+	if got := lease("w4", 10, time.Minute); len(got) != 4 || got[0] != w2[0] {
+		t.Fatalf("w4 leased %v, want the expired lease %v", got, w2)
+	}
+
+	// a release with a delay keeps the messages from everyone for a while
+	if err := l.Release("a", "w4", w2, 50*time.Millisecond); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := lease("w5", 10, time.Minute); len(got) != 0 {
+		t.Fatalf("leased %v during release delay", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := lease("w5", 10, time.Minute); len(got) != 4 {
+		t.Fatalf("leased %v after release delay", got)
+	}
+}
+
+func TestPriorityOrderAndEviction(t *testing.T) {
+	for _, b := range backends {
+		if b.name == "segment" || b.name == "memory-overflow" {
+			// the segment log delivers strictly by id
+			continue
+		}
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			buf := openBuffer(t, b.open, t.TempDir())
+			defer buf.Close()
+			if err := buf.SetSinks([]string{"a"}); err != nil {
+				t.Fatalf("SetSinks: %v", err)
+			}
+			prios := []int{0, -1, 0, 1, -1, 0, 1, -1, 0, 0}
+			batch := make([]Message, len(prios))
+			for i, p := range prios {
+				batch[i] = Message{Topic: "t", Payload: []byte(fmt.Sprintf("p%d", i)), Priority: p}
+			}
+			ids, err := buf.EnqueueBatch(batch)
+			if err != nil {
+				t.Fatalf("EnqueueBatch: %v", err)
+			}
+			for _, sink := range []string{"a", ""} {
+				msgs, err := buf.FetchPending(sink, 4)
+				if err != nil {
+					t.Fatalf("FetchPending: %v", err)
+				}
+				want := []int64{ids[3], ids[6], ids[0], ids[2]}
+				for i, m := range msgs {
+					if m.ID != want[i] || m.Priority != prios[indexOf(ids, m.ID)] {
+						t.Fatalf("FetchPending(%q) = %+v, want ids %v", sink, msgs, want)
+					}
+				}
+			}
+
+			ev, ok := buf.(Evicter)
+			if !ok {
+				t.Fatalf("%T does not implement Evicter", buf)
+			}
+			n, err := ev.Evict(-1, 0)
+			if err != nil || n != 3 {
+				t.Fatalf("Evict = %d, %v, want 3", n, err)
+			}
+			if n, _ := buf.CountPending("a"); n != 7 {
+				t.Fatalf("CountPending = %d after evicting low priority, want 7", n)
+			}
+			// eviction stops once the buffer is small enough
+			if n, err := ev.Evict(0, 3*2); err != nil || n != 5 {
+				t.Fatalf("Evict normal = %d, %v, want 5", n, err)
+			}
+		})
+	}
+}
+
+func indexOf(ids []int64, id int64) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestStoreGroupsConcurrentEnqueues(t *testing.T) {
+	s, err := Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	const writers, each = 8, 50
+	ids := make(chan int64, writers*each)
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := 0; i < each; i++ {
+				id, err := s.EnqueueTopic("t", []byte(fmt.Sprintf("%d-%d", w, i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				ids <- id
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("EnqueueTopic: %v", err)
+		}
+	}
+	close(ids)
+	seen := map[int64]bool{}
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %d handed out twice", id)
+		}
+		seen[id] = true
+	}
+	if n, _ := s.CountUnsent(); n != writers*each || len(seen) != writers*each {
+		t.Fatalf("CountUnsent = %d, %d ids, want %d", n, len(seen), writers*each)
+	}
+	s.Close()
+	if _, err := s.Enqueue([]byte("late")); err == nil {
+		t.Fatalf("Enqueue after Close succeeded")
+	}
+}
+
+func TestSegmentLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenSegmentLog(dir, SegmentOptions{SegmentBytes: 200})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ids := enqueueN(t, l, 20)
+	l.Close()
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) < 3 {
+		t.Fatalf("expected several segments, got %d", len(segs))
+	}
+	// a torn append at the end of the last segment
+	last := segs[len(segs)-1]
+	f, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{1, 2, 3, 4, 40, 0, 0, 0, 9})
+	f.Close()
+	// a flipped bit in the middle of the first segment
+	first, _ := os.ReadFile(segs[0])
+	first[len(first)-3] ^= 0x40
+	os.WriteFile(segs[0], first, 0o644)
+
+	l, err = OpenSegmentLog(dir, SegmentOptions{SegmentBytes: 200})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer l.Close()
+	got := pendingIDs(t, l, "")
+	if len(got) != len(ids)-1 {
+		t.Fatalf("expected only the corrupt record to be lost, got %d of %d", len(got), len(ids))
+	}
+	for _, m := range mustFetch(t, l) {
+		if !bytes.HasPrefix(m.Payload, []byte("payload-")) {
+			t.Fatalf("corrupt payload returned: %q", m.Payload)
+		}
+	}
+	id, err := l.Enqueue([]byte("after"))
+	if err != nil || id != ids[len(ids)-1]+1 {
+		t.Fatalf("Enqueue after recovery = %d, %v", id, err)
+	}
+	if got := pendingIDs(t, l, ""); got[len(got)-1] != id {
+		t.Fatalf("appended record not readable after truncated tail")
+	}
+}
+
+func mustFetch(t *testing.T, buf Buffer) []Message {
+	t.Helper()
+	msgs, err := buf.FetchUnsent(1000)
+	if err != nil {
+		t.Fatalf("FetchUnsent: %v", err)
+	}
+	return msgs
+}
+
+func TestSegmentLogDeletesWholeSegments(t *testing.T) {
+	dir := t.TempDir()
+	l, err := OpenSegmentLog(dir, SegmentOptions{SegmentBytes: 200})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer l.Close()
+	ids := enqueueN(t, l, 20)
+	before, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+
+	if err := l.MarkSent(ids[:len(ids)-1]); err != nil {
+		t.Fatalf("MarkSent: %v", err)
+	}
+	n, err := l.PurgeSent()
+	if err != nil {
+		t.Fatalf("PurgeSent: %v", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(after) != 1 || n == 0 || n >= int64(len(ids)) {
+		t.Fatalf("expected all but the active segment removed: %d -> %d segments, %d messages", len(before), len(after), n)
+	}
+	if got := pendingIDs(t, l, ""); len(got) != 1 || got[0] != ids[len(ids)-1] {
+		t.Fatalf("pending after purge: %v", got)
+	}
+}
+
+func TestHybridSpillsOnClose(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenSegmentLog(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	h, err := NewHybrid(disk, HybridOptions{Mode: ModeOverflow})
+	if err != nil {
+		t.Fatalf("NewHybrid: %v", err)
+	}
+	if err := h.SetSinks([]string{"a", "b"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	ids := enqueueN(t, h, 5)
+	if err := h.Ack("a", ids); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if err := h.Ack("b", ids[:2]); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	if n, _ := disk.CountUnsent(); n != 0 {
+		t.Fatalf("overflow mode wrote %d messages to disk before it had to", n)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	disk, err = OpenSegmentLog(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	h, err = NewHybrid(disk, HybridOptions{Mode: ModeOverflow})
+	if err != nil {
+		t.Fatalf("NewHybrid: %v", err)
+	}
+	defer h.Close()
+	if err := h.SetSinks([]string{"a", "b"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+	if got := pendingIDs(t, h, "a"); len(got) != 0 {
+		t.Fatalf("a pending after reopen: %v", got)
+	}
+	if got := pendingIDs(t, h, "b"); len(got) != 3 || got[0] != ids[2] {
+		t.Fatalf("b pending after reopen: %v, want %v", got, ids[2:])
+	}
+	// ids handed out from memory are not reused either
+	id, err := h.Enqueue([]byte("new"))
+	if err != nil || id <= ids[len(ids)-1] {
+		t.Fatalf("Enqueue after reopen = %d, %v", id, err)
+	}
+}
+
+// countingDisk counts the messages Hybrid reads from disk.
+type countingDisk struct {
+	*Store
+	read int
+}
+
+func (d *countingDisk) fetchBefore(sink string, before int64, limit int) ([]Message, error) {
+	msgs, err := d.Store.fetchBefore(sink, before, limit)
+	d.read += len(msgs)
+	return msgs, err
+}
+
+func TestHybridReadsDiskOnlyForOlderMessages(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	disk := &countingDisk{Store: store}
+	h, err := NewHybrid(disk, HybridOptions{Mode: ModeDurable, MaxMessages: 8})
+	if err != nil {
+		t.Fatalf("NewHybrid: %v", err)
+	}
+	defer h.Close()
+	if err := h.SetSinks([]string{"a"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+
+	ids := enqueueN(t, h, 5)
+	if got := pendingIDs(t, h, "a"); len(got) != 5 || disk.read != 0 {
+		t.Fatalf("pending %v with %d message(s) read from disk, want %v from memory", got, disk.read, ids)
+	}
+	// the ring keeps the newest 8; the 7 before them are only on disk
+	ids = append(ids, enqueueN(t, h, 10)...)
+	if got := pendingIDs(t, h, "a"); len(got) != 15 || got[0] != ids[0] || got[14] != ids[14] || disk.read != 7 {
+		t.Fatalf("pending %v with %d message(s) read from disk, want %v with 7", got, disk.read, ids)
+	}
+}
+
+func TestHybridRingStaysBoundedBehindPendingMessage(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	h, err := NewHybrid(store, HybridOptions{Mode: ModeDurable, MaxMessages: 8})
+	if err != nil {
+		t.Fatalf("NewHybrid: %v", err)
+	}
+	defer h.Close()
+	if err := h.SetSinks([]string{"a"}); err != nil {
+		t.Fatalf("SetSinks: %v", err)
+	}
+
+	// the first message stays pending, e.g. behind a stuck lease, while
+	// everything after it is delivered
+	stuck := enqueueN(t, h, 1)[0]
+	for i := 0; i < 20; i++ {
+		if err := h.Ack("a", enqueueN(t, h, 1)); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+		h.mu.Lock()
+		n, bytes := len(h.ring), h.bytes
+		h.mu.Unlock()
+		if n > 8 {
+			t.Fatalf("ring holds %d messages (%d bytes) after %d acks, want at most 8", n, bytes, i+1)
+		}
+	}
+	if got := pendingIDs(t, h, "a"); len(got) != 1 || got[0] != stuck {
+		t.Fatalf("pending %v, want [%d]", got, stuck)
+	}
+}
+
+func TestHybridSpillsStalledMessages(t *testing.T) {
+	disk, err := Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	h, err := NewHybrid(disk, HybridOptions{Mode: ModeOverflow, SpillAfter: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewHybrid: %v", err)
+	}
+	defer h.Close()
+	enqueueN(t, h, 3)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n, _ := disk.CountUnsent()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stalled messages on disk, got %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, _ := h.CountUnsent(); n != 3 {
+		t.Fatalf("CountUnsent = %d after spill, want 3", n)
+	}
+}
+
+func benchmarkBackends(b *testing.B, run func(b *testing.B, buf Buffer)) {
+	for _, be := range backends {
+		be := be
+		b.Run(be.name, func(b *testing.B) {
+			dir := b.TempDir()
+			var buf Buffer
+			var err error
+			// full-sized segments and rings
+			switch be.name {
+			case "segment":
+				buf, err = OpenSegmentLog(dir, SegmentOptions{})
+			case "memory-durable":
+				buf, err = withMemory(Init(filepath.Join(dir, "buffer.db")))(HybridOptions{Mode: ModeDurable})
+			case "memory-overflow":
+				buf, err = withMemory(OpenSegmentLog(dir, SegmentOptions{}))(HybridOptions{Mode: ModeOverflow})
+			default:
+				buf, err = be.open(dir)
+			}
+			if err != nil {
+				b.Fatalf("open: %v", err)
+			}
+			defer buf.Close()
+			if err := buf.SetSinks([]string{"kafka"}); err != nil {
+				b.Fatalf("SetSinks: %v", err)
+			}
+			b.ResetTimer()
+			run(b, buf)
+		})
+	}
+}
+
+var benchPayload = []byte(`{"measurement":"temperature","tags":{"device":"boiler-1","site":"north"},"fields":{"value":21.5},"timestamp":"2024-05-01T12:00:00Z"}`)
+
+func BenchmarkEnqueue(b *testing.B) {
+	benchmarkBackends(b, func(b *testing.B, buf Buffer) {
+		b.SetBytes(int64(len(benchPayload)))
+		for i := 0; i < b.N; i++ {
+			if _, err := buf.EnqueueTopic("sensors/boiler-1", benchPayload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkEnqueueBatch(b *testing.B) {
+	benchmarkBackends(b, func(b *testing.B, buf Buffer) {
+		b.SetBytes(int64(len(benchPayload)))
+		batch := make([]Message, 100)
+		for i := range batch {
+			batch[i] = Message{Topic: "sensors/boiler-1", Payload: benchPayload}
+		}
+		for i := 0; i < b.N; i += len(batch) {
+			if _, err := buf.EnqueueBatch(batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkEnqueueRate offers messages at a fixed rate from 16 concurrent
+// inputs, as MQTT and HTTP ingest do, and reports the rate achieved and the
+// mean Enqueue latency. A backend keeps up while msgs/s matches the offered
+// rate.
+func BenchmarkEnqueueRate(b *testing.B) {
+	const inputs = 16
+	for _, rate := range []int{1000, 5000, 10000} {
+		rate := rate
+		b.Run(fmt.Sprintf("%dps", rate), func(b *testing.B) {
+			benchmarkBackends(b, func(b *testing.B, buf Buffer) {
+				interval := time.Duration(inputs) * time.Second / time.Duration(rate)
+				var wg sync.WaitGroup
+				var latency int64
+				start := time.Now()
+				for w := 0; w < inputs; w++ {
+					wg.Add(1)
+					go func(n int) {
+						defer wg.Done()
+						next := time.Now()
+						for i := 0; i < n; i++ {
+							if d := time.Until(next); d > 0 {
+								time.Sleep(d)
+							}
+							next = next.Add(interval)
+							t0 := time.Now()
+							if _, err := buf.EnqueueTopic("sensors/boiler-1", benchPayload); err != nil {
+								b.Error(err)
+								return
+							}
+							atomic.AddInt64(&latency, int64(time.Since(t0)))
+						}
+					}((b.N + inputs - 1) / inputs)
+				}
+				wg.Wait()
+				elapsed := time.Since(start)
+				n := (b.N + inputs - 1) / inputs * inputs
+				b.ReportMetric(float64(n)/elapsed.Seconds(), "msgs/s")
+				b.ReportMetric(float64(latency)/float64(n)/1e3, "us/enqueue")
+			})
+		})
+	}
+}
+
+// BenchmarkDeliver measures the full cycle per message: enqueue, then fetch,
+// acknowledge and purge in batches of 100 as the forwarder does.
+func BenchmarkDeliver(b *testing.B) {
+	benchmarkBackends(b, func(b *testing.B, buf Buffer) {
+		b.SetBytes(int64(len(benchPayload)))
+		for i := 0; i < b.N; i += 100 {
+			for j := 0; j < 100; j++ {
+				if _, err := buf.EnqueueTopic("sensors/boiler-1", benchPayload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			msgs, err := buf.FetchPending("kafka", 100)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids := make([]int64, len(msgs))
+			for k, m := range msgs {
+				ids[k] = m.ID
+			}
+			if err := buf.Ack("kafka", ids); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := buf.PurgeSent(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Message types.
+const (
+	Confirmable     uint8 = 0
+	NonConfirmable  uint8 = 1
+	Acknowledgement uint8 = 2
+	Reset           uint8 = 3
+)
+
+// Codes are encoded as class<<5 | detail, e.g. 2.04 is 0x44.
+const (
+	CodeEmpty    uint8 = 0x00
+	CodeGET      uint8 = 0x01
+	CodePOST     uint8 = 0x02
+	CodePUT      uint8 = 0x03
+	CodeCreated  uint8 = 0x41 // 2.01
+	CodeChanged  uint8 = 0x44 // 2.04
+	CodeContent  uint8 = 0x45 // 2.05
+	CodeContinue uint8 = 0x5f // 2.31
+
+	CodeBadRequest         uint8 = 0x80 // 4.00
+	CodeNotFound           uint8 = 0x84 // 4.04
+	CodeMethodNotAllowed   uint8 = 0x85 // 4.05
+	CodeRequestIncomplete  uint8 = 0x88 // 4.08
+	CodeRequestTooLarge    uint8 = 0x8d // 4.13
+	CodeInternalError      uint8 = 0xa0 // 5.00
+	CodeServiceUnavailable uint8 = 0xa3 // 5.03
+)
+
+// Option numbers used by the server.
+const (
+	OptObserve       uint16 = 6
+	OptURIPath       uint16 = 11
+	OptContentFormat uint16 = 12
+	OptMaxAge        uint16 = 14
+	OptBlock2        uint16 = 23
+	OptBlock1        uint16 = 27
+	OptSize1         uint16 = 60
+)
+
+var errMalformed = errors.New("malformed coap message")
+
+// Option is a single CoAP option.
+type Option struct {
+	Number uint16
+	Value  []byte
+}
+
+// Message is a decoded CoAP message (RFC 7252).
+type Message struct {
+	Type      uint8
+	Code      uint8
+	MessageID uint16
+	Token     []byte
+	Options   []Option
+	Payload   []byte
+}
+
+// Parse decodes a datagram into a message.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < 4 {
+		return nil, errMalformed
+	}
+	if b[0]>>6 != 1 {
+		return nil, errors.New("unsupported coap version")
+	}
+	m := &Message{
+		Type:      (b[0] >> 4) & 0x3,
+		Code:      b[1],
+		MessageID: binary.BigEndian.Uint16(b[2:]),
+	}
+	tkl := int(b[0] & 0xf)
+	if tkl > 8 || len(b) < 4+tkl {
+		return nil, errMalformed
+	}
+	m.Token = append([]byte(nil), b[4:4+tkl]...)
+	b = b[4+tkl:]
+
+	var num uint16
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return nil, errMalformed
+			}
+			m.Payload = append([]byte(nil), b[1:]...)
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		var err error
+		if delta, b, err = extended(delta, b); err != nil {
+			return nil, err
+		}
+		if length, b, err = extended(length, b); err != nil {
+			return nil, err
+		}
+		if len(b) < length || int(num)+delta > 0xffff {
+			return nil, errMalformed
+		}
+		num += uint16(delta)
+		m.Options = append(m.Options, Option{Number: num, Value: append([]byte(nil), b[:length]...)})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+func extended(v int, b []byte) (int, []byte, error) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errMalformed
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errMalformed
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errMalformed
+	}
+	return v, b, nil
+}
+
+// Marshal encodes the message into a datagram.
+func (m *Message) Marshal() []byte {
+	out := []byte{1<<6 | m.Type<<4 | uint8(len(m.Token)), m.Code, 0, 0}
+	binary.BigEndian.PutUint16(out[2:], m.MessageID)
+	out = append(out, m.Token...)
+
+	opts := append([]Option(nil), m.Options...)
+	sort.SliceStable(opts, func(i, j int) bool { return opts[i].Number < opts[j].Number })
+	var prev uint16
+	for _, o := range opts {
+		delta, length := int(o.Number-prev), len(o.Value)
+		prev = o.Number
+		dn, dext := nibble(delta)
+		ln, lext := nibble(length)
+		out = append(out, byte(dn<<4|ln))
+		out = append(out, dext...)
+		out = append(out, lext...)
+		out = append(out, o.Value...)
+	}
+	if len(m.Payload) > 0 {
+		out = append(out, 0xff)
+		out = append(out, m.Payload...)
+	}
+	return out
+}
+
+func nibble(v int) (int, []byte) {
+	switch {
+	case v < 13:
+		return v, nil
+	case v < 269:
+		return 13, []byte{byte(v - 13)}
+	default:
+		return 14, binary.BigEndian.AppendUint16(nil, uint16(v-269))
+	}
+}
+
+// Option returns the first value of option num.
+func (m *Message) Option(num uint16) ([]byte, bool) {
+	for _, o := range m.Options {
+		if o.Number == num {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// UintOption returns option num decoded as an unsigned integer.
+func (m *Message) UintOption(num uint16) (uint32, bool) {
+	v, ok := m.Option(num)
+	if !ok || len(v) > 4 {
+		return 0, false
+	}
+	var n uint32
+	for _, b := range v {
+		n = n<<8 | uint32(b)
+	}
+	return n, true
+}
+
+// SetUintOption replaces option num with the minimal encoding of v.
+func (m *Message) SetUintOption(num uint16, v uint32) {
+	var val []byte
+	for v > 0 {
+		val = append([]byte{byte(v)}, val...)
+		v >>= 8
+	}
+	kept := m.Options[:0]
+	for _, o := range m.Options {
+		if o.Number != num {
+			kept = append(kept, o)
+		}
+	}
+	m.Options = append(kept, Option{Number: num, Value: val})
+}
+
+// Path returns the request path assembled from Uri-Path options, with a
+// leading slash.
+func (m *Message) Path() string {
+	var parts []string
+	for _, o := range m.Options {
+		if o.Number == OptURIPath {
+			parts = append(parts, string(o.Value))
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// Block is a decoded Block1 or Block2 option (RFC 7959).
+type Block struct {
+	Num  uint32
+	More bool
+	SZX  uint8
+}
+
+// Size returns the block size in bytes.
+func (b Block) Size() int {
+	return 1 << (b.SZX + 4)
+}
+
+func (b Block) value() uint32 {
+	v := b.Num<<4 | uint32(b.SZX)
+	if b.More {
+		v |= 0x8
+	}
+	return v
+}
+
+// BlockOption decodes block option num (OptBlock1 or OptBlock2).
+func (m *Message) BlockOption(num uint16) (Block, bool) {
+	v, ok := m.UintOption(num)
+	if !ok {
+		return Block{}, false
+	}
+	return Block{Num: v >> 4, More: v&0x8 != 0, SZX: uint8(v & 0x7)}, true
+}
+
+// SetBlockOption sets block option num.
+func (m *Message) SetBlockOption(num uint16, b Block) {
+	m.SetUintOption(num, b.value())
+}
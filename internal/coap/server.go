@@ -0,0 +1,431 @@
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+const (
+	// exchangeLifetime is how long a response is kept to answer retransmitted
+	// confirmable requests (EXCHANGE_LIFETIME in RFC 7252).
+	exchangeLifetime = 247 * time.Second
+	// uploadTimeout drops incomplete block-wise uploads.
+	uploadTimeout = 60 * time.Second
+	// defaultSZX is the block size exponent used for responses when the client
+	// did not ask for a specific size (1024 bytes).
+	defaultSZX = 6
+	// DefaultMaxPayload limits the reassembled size of block-wise uploads.
+	DefaultMaxPayload = 64 * 1024
+	maxDatagram       = 1500
+	// maxExchanges bounds the confirmable exchanges kept for retransmissions;
+	// the oldest is forgotten first.
+	maxExchanges = 4096
+	// maxInFlight bounds the requests handled at once.
+	maxInFlight = 64
+)
+
+// Resource maps a CoAP path to the virtual topic its payloads are submitted under.
+type Resource struct {
+	Path  string
+	Topic string
+}
+
+type resource struct {
+	topic         string
+	last          []byte
+	contentFormat []byte
+	seq           uint32
+	observers     map[string]*observer
+}
+
+type observer struct {
+	addr    *net.UDPAddr
+	token   []byte
+	lastMID uint16
+}
+
+type upload struct {
+	buf     []byte
+	updated time.Time
+}
+
+// cached is the response to a confirmable request, nil while it is handled.
+type cached struct {
+	resp []byte
+	at   time.Time
+}
+
+// Server is a CoAP (RFC 7252) listener that accepts POST/PUT on configured
+// resource paths and submits the payloads to the pipeline. Confirmable
+// requests are acknowledged with piggybacked responses, block-wise uploads
+// (Block1) are reassembled, and clients can observe a resource to be notified
+// of the latest payload it received.
+type Server struct {
+	addr       string
+	in         plugin.Ingester
+	maxPayload int
+
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	resources map[string]*resource
+	dedup     map[string]cached
+	exchanges []string // dedup keys, oldest first
+	uploads   map[string]*upload
+	nextMID   uint16
+	lastPrune time.Time
+	wg        sync.WaitGroup
+}
+
+// New creates a CoAP server for addr (e.g. ":5683"). maxPayload limits the
+// size of a reassembled block-wise upload; zero uses DefaultMaxPayload.
+func New(addr string, resources []Resource, maxPayload int, in plugin.Ingester) (*Server, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("addr required")
+	}
+	if len(resources) == 0 {
+		return nil, fmt.Errorf("at least one resource required")
+	}
+	if maxPayload <= 0 {
+		maxPayload = DefaultMaxPayload
+	}
+	s := &Server{
+		addr:       addr,
+		in:         in,
+		maxPayload: maxPayload,
+		resources:  make(map[string]*resource),
+		dedup:      make(map[string]cached),
+		uploads:    make(map[string]*upload),
+		nextMID:    uint16(time.Now().UnixNano()),
+	}
+	for _, r := range resources {
+		if r.Path == "" || r.Topic == "" {
+			return nil, fmt.Errorf("resource requires path and topic")
+		}
+		p := r.Path
+		if p[0] != '/' {
+			p = "/" + p
+		}
+		s.resources[p] = &resource{topic: r.Topic, observers: make(map[string]*observer)}
+	}
+	return s, nil
+}
+
+// Start binds the UDP socket and serves requests in the background.
+func (s *Server) Start() error {
+	ua, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", ua)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go s.serve(conn)
+	return nil
+}
+
+// Addr returns the bound address once started.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+func (s *Server) Close() {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+	s.wg.Wait()
+}
+
+func (s *Server) serve(conn *net.UDPConn) {
+	defer s.wg.Done()
+	buf := make([]byte, maxDatagram)
+	sem := make(chan struct{}, maxInFlight)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("coap: read error: %v\n", err)
+			continue
+		}
+		msg, err := Parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		// a slow buffer write does not hold up other requests
+		sem <- struct{}{}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-sem }()
+			s.handle(conn, addr, msg)
+		}()
+	}
+}
+
+func (s *Server) handle(conn *net.UDPConn, addr *net.UDPAddr, req *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.prune(now)
+
+	switch {
+	case req.Type == Reset:
+		s.dropObserver(addr, req.MessageID)
+		return
+	case req.Type == Acknowledgement:
+		return
+	case req.Code == CodeEmpty:
+		// CoAP ping: answer confirmable empty messages with a reset
+		if req.Type == Confirmable {
+			rst := &Message{Type: Reset, MessageID: req.MessageID}
+			_, _ = conn.WriteToUDP(rst.Marshal(), addr)
+		}
+		return
+	case req.Code>>5 != 0:
+		// responses are not expected by a server
+		return
+	}
+
+	// only confirmable requests are retransmitted
+	key := fmt.Sprintf("%s/%d", addr, req.MessageID)
+	if req.Type == Confirmable {
+		if c, ok := s.dedup[key]; ok {
+			if c.resp != nil {
+				_, _ = conn.WriteToUDP(c.resp, addr)
+			}
+			return
+		}
+		s.remember(key, cached{at: now})
+	}
+
+	resp := s.respond(addr, req)
+	if req.Type == Confirmable {
+		resp.Type = Acknowledgement
+		resp.MessageID = req.MessageID
+	} else {
+		resp.Type = NonConfirmable
+		resp.MessageID = s.mid()
+	}
+	resp.Token = req.Token
+	out := resp.Marshal()
+	if c, ok := s.dedup[key]; ok && req.Type == Confirmable {
+		c.resp = out
+		s.dedup[key] = c
+	}
+	_, _ = conn.WriteToUDP(out, addr)
+	metrics.CoAPRequests.WithLabelValues(codeString(resp.Code)).Inc()
+
+	if res := s.resources[req.Path()]; res != nil && resp.Code == CodeChanged {
+		s.notify(conn, res)
+	}
+}
+
+func (s *Server) respond(addr *net.UDPAddr, req *Message) *Message {
+	res := s.resources[req.Path()]
+	if res == nil {
+		return &Message{Code: CodeNotFound}
+	}
+	switch req.Code {
+	case CodePOST, CodePUT:
+		return s.store(addr, req, res)
+	case CodeGET:
+		return s.get(addr, req, res)
+	default:
+		return &Message{Code: CodeMethodNotAllowed}
+	}
+}
+
+// store submits the payload of a POST or PUT, reassembling block-wise
+// uploads first. It is called with s.mu held and releases it while the
+// payload is submitted.
+func (s *Server) store(addr *net.UDPAddr, req *Message, res *resource) *Message {
+	payload := req.Payload
+	block, isBlock := req.BlockOption(OptBlock1)
+	if isBlock {
+		if block.SZX > 6 {
+			return &Message{Code: CodeBadRequest}
+		}
+		key := addr.String() + req.Path()
+		up := s.uploads[key]
+		if block.Num == 0 {
+			up = &upload{}
+			s.uploads[key] = up
+		}
+		if up == nil || int(block.Num)*block.Size() != len(up.buf) {
+			delete(s.uploads, key)
+			return &Message{Code: CodeRequestIncomplete}
+		}
+		if len(up.buf)+len(req.Payload) > s.maxPayload {
+			delete(s.uploads, key)
+			resp := &Message{Code: CodeRequestTooLarge}
+			resp.SetUintOption(OptSize1, uint32(s.maxPayload))
+			return resp
+		}
+		up.buf = append(up.buf, req.Payload...)
+		up.updated = time.Now()
+		if block.More {
+			resp := &Message{Code: CodeContinue}
+			resp.SetBlockOption(OptBlock1, block)
+			return resp
+		}
+		delete(s.uploads, key)
+		payload = up.buf
+	} else if len(payload) > s.maxPayload {
+		resp := &Message{Code: CodeRequestTooLarge}
+		resp.SetUintOption(OptSize1, uint32(s.maxPayload))
+		return resp
+	}
+
+	var resp *Message
+	s.mu.Unlock()
+	err := s.in.Submit(res.topic, payload)
+	s.mu.Lock()
+	if err != nil {
+		fmt.Printf("coap: submit failed for %s: %v\n", req.Path(), err)
+		resp = &Message{Code: CodeInternalError}
+		if errors.Is(err, plugin.ErrBufferFull) || errors.Is(err, plugin.ErrUnavailable) {
+			resp.Code = CodeServiceUnavailable
+			resp.SetUintOption(OptMaxAge, 5)
+		}
+		return resp
+	}
+	res.last = payload
+	res.contentFormat, _ = req.Option(OptContentFormat)
+	res.seq++
+	resp = &Message{Code: CodeChanged}
+	if isBlock {
+		resp.SetBlockOption(OptBlock1, block)
+	}
+	return resp
+}
+
+func (s *Server) get(addr *net.UDPAddr, req *Message, res *resource) *Message {
+	key := addr.String() + "|" + string(req.Token)
+	obs, observing := req.UintOption(OptObserve)
+	szx := uint8(defaultSZX)
+	var num uint32
+	if b, ok := req.BlockOption(OptBlock2); ok {
+		if b.SZX > 6 {
+			return &Message{Code: CodeBadRequest}
+		}
+		szx, num = b.SZX, b.Num
+	}
+
+	resp := &Message{Code: CodeContent}
+	if observing && obs == 0 && num == 0 {
+		res.observers[key] = &observer{addr: addr, token: req.Token}
+		resp.SetUintOption(OptObserve, res.seq)
+	} else if observing && obs == 1 {
+		delete(res.observers, key)
+	}
+	if !fillBlock(resp, res, num, szx) {
+		return &Message{Code: CodeBadRequest}
+	}
+	return resp
+}
+
+// fillBlock sets the payload of resp to block num of the resource's latest
+// payload, adding a Block2 option when the payload does not fit one block.
+func fillBlock(resp *Message, res *resource, num uint32, szx uint8) bool {
+	if res.contentFormat != nil {
+		resp.Options = append(resp.Options, Option{Number: OptContentFormat, Value: res.contentFormat})
+	}
+	b := Block{Num: num, SZX: szx}
+	size := b.Size()
+	start := int(num) * size
+	if start > len(res.last) || (start == len(res.last) && num > 0) {
+		return false
+	}
+	end := start + size
+	if end >= len(res.last) {
+		end = len(res.last)
+	} else {
+		b.More = true
+	}
+	if b.More || num > 0 {
+		resp.SetBlockOption(OptBlock2, b)
+	}
+	resp.Payload = res.last[start:end]
+	return true
+}
+
+// notify sends the resource's latest payload to all observers as
+// non-confirmable notifications.
+func (s *Server) notify(conn *net.UDPConn, res *resource) {
+	for _, o := range res.observers {
+		n := &Message{Type: NonConfirmable, Code: CodeContent, MessageID: s.mid(), Token: o.token}
+		n.SetUintOption(OptObserve, res.seq)
+		fillBlock(n, res, 0, defaultSZX)
+		o.lastMID = n.MessageID
+		_, _ = conn.WriteToUDP(n.Marshal(), o.addr)
+	}
+}
+
+// dropObserver removes the observer that rejected notification mid with a reset.
+func (s *Server) dropObserver(addr *net.UDPAddr, mid uint16) {
+	for _, res := range s.resources {
+		for k, o := range res.observers {
+			if o.lastMID == mid && o.addr.String() == addr.String() {
+				delete(res.observers, k)
+			}
+		}
+	}
+}
+
+func (s *Server) mid() uint16 {
+	s.nextMID++
+	return s.nextMID
+}
+
+func (s *Server) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < time.Second {
+		return
+	}
+	s.lastPrune = now
+	for len(s.exchanges) > 0 && now.Sub(s.dedup[s.exchanges[0]].at) > exchangeLifetime {
+		s.forgetOldest()
+	}
+	for k, u := range s.uploads {
+		if now.Sub(u.updated) > uploadTimeout {
+			delete(s.uploads, k)
+		}
+	}
+}
+
+// remember caches an exchange, forgetting the oldest when the cache is full.
+func (s *Server) remember(key string, c cached) {
+	if len(s.exchanges) >= maxExchanges {
+		s.forgetOldest()
+	}
+	s.dedup[key] = c
+	s.exchanges = append(s.exchanges, key)
+}
+
+func (s *Server) forgetOldest() {
+	delete(s.dedup, s.exchanges[0])
+	s.exchanges = s.exchanges[1:]
+}
+
+func codeString(c uint8) string {
+	return fmt.Sprintf("%d.%02d", c>>5, c&0x1f)
+}
@@ -0,0 +1,242 @@
+package coap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+	"github.com/your-username/iot-edge-gateway/internal/pipeline"
+)
+
+func startServer(t *testing.T) (*Server, *buffer.Store, *net.UDPConn) {
+	t.Helper()
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	s, err := New("127.0.0.1:0", []Resource{{Path: "/data", Topic: "coap/data"}}, 4096, pipeline.New(store, nil, 0))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(s.Close)
+	conn, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, store, conn
+}
+
+func exchange(t *testing.T, conn *net.UDPConn, m *Message) *Message {
+	t.Helper()
+	if _, err := conn.Write(m.Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return receive(t, conn)
+}
+
+func receive(t *testing.T, conn *net.UDPConn) *Message {
+	t.Helper()
+	buf := make([]byte, maxDatagram)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	resp, err := Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return resp
+}
+
+func post(mid uint16, path string, payload []byte) *Message {
+	m := &Message{Type: Confirmable, Code: CodePOST, MessageID: mid, Token: []byte{0xab}, Payload: payload}
+	m.Options = append(m.Options, Option{Number: OptURIPath, Value: []byte(path)})
+	return m
+}
+
+func TestConfirmablePostIsAcknowledgedOnce(t *testing.T) {
+	_, store, conn := startServer(t)
+
+	req := post(100, "data", []byte(`{"t":1}`))
+	resp := exchange(t, conn, req)
+	if resp.Type != Acknowledgement || resp.MessageID != 100 || resp.Code != CodeChanged {
+		t.Fatalf("unexpected response: type=%d mid=%d code=%s", resp.Type, resp.MessageID, codeString(resp.Code))
+	}
+	if !bytes.Equal(resp.Token, req.Token) {
+		t.Fatalf("token not echoed")
+	}
+
+	// a retransmission gets the same answer without buffering twice
+	if again := exchange(t, conn, req); again.MessageID != 100 || again.Code != CodeChanged {
+		t.Fatalf("unexpected retransmission response")
+	}
+	if cnt, _ := store.CountUnsent(); cnt != 1 {
+		t.Fatalf("expected 1 buffered message, got %d", cnt)
+	}
+
+	if resp := exchange(t, conn, post(101, "nope", []byte("x"))); resp.Code != CodeNotFound {
+		t.Fatalf("expected 4.04, got %s", codeString(resp.Code))
+	}
+}
+
+func TestBlockwiseUpload(t *testing.T) {
+	_, store, conn := startServer(t)
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 5) // 80 bytes, 16-byte blocks
+	for i := 0; i < 5; i++ {
+		req := post(uint16(200+i), "data", payload[i*16:(i+1)*16])
+		more := i < 4
+		req.SetBlockOption(OptBlock1, Block{Num: uint32(i), More: more, SZX: 0})
+		resp := exchange(t, conn, req)
+		want := CodeContinue
+		if !more {
+			want = CodeChanged
+		}
+		if resp.Code != want {
+			t.Fatalf("block %d: expected %s, got %s", i, codeString(want), codeString(resp.Code))
+		}
+	}
+	msgs, err := store.FetchUnsent(10)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Payload, payload) {
+		t.Fatalf("expected reassembled payload, got %d messages", len(msgs))
+	}
+
+	// out of order block
+	req := post(300, "data", payload[:16])
+	req.SetBlockOption(OptBlock1, Block{Num: 2, More: true, SZX: 0})
+	if resp := exchange(t, conn, req); resp.Code != CodeRequestIncomplete {
+		t.Fatalf("expected 4.08, got %s", codeString(resp.Code))
+	}
+}
+
+func TestObserveNotifiesOnNewData(t *testing.T) {
+	_, _, conn := startServer(t)
+
+	get := &Message{Type: Confirmable, Code: CodeGET, MessageID: 1, Token: []byte{0x01, 0x02}}
+	get.Options = append(get.Options, Option{Number: OptURIPath, Value: []byte("data")})
+	get.SetUintOption(OptObserve, 0)
+	resp := exchange(t, conn, get)
+	if resp.Code != CodeContent {
+		t.Fatalf("expected 2.05, got %s", codeString(resp.Code))
+	}
+	if _, ok := resp.Option(OptObserve); !ok {
+		t.Fatalf("expected observe option in registration response")
+	}
+
+	ack := exchange(t, conn, post(2, "data", []byte(`{"t":42}`)))
+	if ack.Code != CodeChanged {
+		t.Fatalf("expected 2.04, got %s", codeString(ack.Code))
+	}
+	n := receive(t, conn)
+	if !bytes.Equal(n.Token, get.Token) || string(n.Payload) != `{"t":42}` {
+		t.Fatalf("unexpected notification: token=%x payload=%q", n.Token, n.Payload)
+	}
+	if seq, _ := n.UintOption(OptObserve); seq != 1 {
+		t.Fatalf("expected observe sequence 1, got %d", seq)
+	}
+}
+
+func TestExchangeCacheIsBounded(t *testing.T) {
+	s, store, conn := startServer(t)
+
+	// non-confirmable requests are never retransmitted, so not cached
+	non := post(1, "data", []byte(`{"t":1}`))
+	non.Type = NonConfirmable
+	if resp := exchange(t, conn, non); resp.Code != CodeChanged {
+		t.Fatalf("expected 2.04, got %s", codeString(resp.Code))
+	}
+	s.mu.Lock()
+	n := len(s.dedup)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expected no cached exchange for a NON request, got %d", n)
+	}
+
+	exchange(t, conn, post(2, "data", []byte(`{"t":2}`)))
+	s.mu.Lock()
+	for i := 0; i < maxExchanges; i++ {
+		s.remember(fmt.Sprintf("spoofed-%d", i), cached{resp: []byte{0}, at: time.Now()})
+	}
+	n = len(s.dedup)
+	s.mu.Unlock()
+	if n != maxExchanges {
+		t.Fatalf("expected %d cached exchanges, got %d", maxExchanges, n)
+	}
+	// the oldest exchange was forgotten, so its retransmission is new
+	exchange(t, conn, post(2, "data", []byte(`{"t":2}`)))
+	if cnt, _ := store.CountUnsent(); cnt != 3 {
+		t.Fatalf("expected 3 buffered messages, got %d", cnt)
+	}
+}
+
+// slowIngester blocks submits until release is closed.
+type slowIngester struct {
+	release chan struct{}
+}
+
+func (s *slowIngester) Submit(string, []byte) error {
+	<-s.release
+	return nil
+}
+
+func (s *slowIngester) Full() bool { return false }
+
+func TestSlowSubmitDoesNotBlockRequests(t *testing.T) {
+	in := &slowIngester{release: make(chan struct{})}
+	s, err := New("127.0.0.1:0", []Resource{{Path: "/data", Topic: "coap/data"}}, 4096, in)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer s.Close()
+	defer close(in.release)
+	conn, err := net.DialUDP("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(post(1, "data", []byte(`{"t":1}`)).Marshal()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	get := &Message{Type: Confirmable, Code: CodeGET, MessageID: 2, Token: []byte{0x02}}
+	get.Options = append(get.Options, Option{Number: OptURIPath, Value: []byte("data")})
+	if resp := exchange(t, conn, get); resp.MessageID != 2 || resp.Code != CodeContent {
+		t.Fatalf("expected the GET answered while the POST is buffered, got mid=%d code=%s", resp.MessageID, codeString(resp.Code))
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := &Message{Type: NonConfirmable, Code: CodePUT, MessageID: 7, Token: []byte("tok")}
+	m.Options = append(m.Options,
+		Option{Number: OptURIPath, Value: []byte("a")},
+		Option{Number: OptURIPath, Value: []byte("b")},
+		Option{Number: OptSize1, Value: []byte{1, 0}},
+	)
+	m.Payload = []byte("hello")
+	got, err := Parse(m.Marshal())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got.Path() != "/a/b" || string(got.Payload) != "hello" || got.MessageID != 7 {
+		t.Fatalf("round trip mismatch: %+v", got)
+	}
+	if v, _ := got.UintOption(OptSize1); v != 256 {
+		t.Fatalf("size1: got %d", v)
+	}
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+    "fmt"
+    "time"
+
     "github.com/spf13/viper"
 )
 
@@ -17,6 +20,209 @@ type Config struct {
     Server struct {
         MetricsAddr string `mapstructure:"metrics_addr"`
     } `mapstructure:"server"`
+
+    // Inputs and Outputs list the sources and sinks to run. Each entry has a
+    // "type" key that selects a registered factory (see pkg/plugin); the other
+    // keys are decoded by that factory, usually into one of the types below.
+    // Load appends entries for the single-instance sections (mqtt, kafka,
+    // http_ingest, coap, modbus, line_protocol) when they are configured.
+    Inputs  []map[string]interface{} `mapstructure:"inputs"`
+    Outputs []map[string]interface{} `mapstructure:"outputs"`
+}
+
+// MQTTConfig is the schema of an input of type "mqtt".
+type MQTTConfig struct {
+    Broker   string `mapstructure:"broker"`
+    ClientID string `mapstructure:"client_id"`
+    Topic    string `mapstructure:"topic"`
+    QoS      int    `mapstructure:"qos"`
+    // Priority of the subscription's messages: "low", "normal", "high" or a
+    // number. Processor rules may override it.
+    Priority string `mapstructure:"priority"`
+}
+
+// MQTTBridgeConfig is the schema of an output of type "mqtt".
+type MQTTBridgeConfig struct {
+    Broker       string `mapstructure:"broker"`
+    ClientID     string `mapstructure:"client_id"`
+    Username     string `mapstructure:"username"`
+    Password     string `mapstructure:"password"`
+    QoS          int    `mapstructure:"qos"`
+    Retain       bool   `mapstructure:"retain"`
+    TopicPrefix  string `mapstructure:"topic_prefix"`
+    DefaultTopic string `mapstructure:"default_topic"`
+    BatchSize    int    `mapstructure:"batch_size"`
+    Mappings     []struct {
+        Match string `mapstructure:"match"`
+        Topic string `mapstructure:"topic"`
+    } `mapstructure:"mappings"`
+    TLS *struct {
+        CAFile             string `mapstructure:"ca_file"`
+        CertFile           string `mapstructure:"cert_file"`
+        KeyFile            string `mapstructure:"key_file"`
+        ServerName         string `mapstructure:"server_name"`
+        InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+    } `mapstructure:"tls"`
+}
+
+// HTTPSinkConfig is the schema of an output of type "http".
+type HTTPSinkConfig struct {
+    URL       string            `mapstructure:"url"`
+    Method    string            `mapstructure:"method"`
+    Format    string            `mapstructure:"format"`
+    BatchSize int               `mapstructure:"batch_size"`
+    Gzip      bool              `mapstructure:"gzip"`
+    Headers   map[string]string `mapstructure:"headers"`
+    Auth      struct {
+        Type     string `mapstructure:"type"`
+        Token    string `mapstructure:"token"`
+        Username string `mapstructure:"username"`
+        Password string `mapstructure:"password"`
+        Secret   string `mapstructure:"secret"`
+        Header   string `mapstructure:"header"`
+    } `mapstructure:"auth"`
+}
+
+// InfluxConfig is the schema of an output of type "influxdb".
+type InfluxConfig struct {
+    URL       string `mapstructure:"url"`
+    Org       string `mapstructure:"org"`
+    Bucket    string `mapstructure:"bucket"`
+    Token     string `mapstructure:"token"`
+    Precision string `mapstructure:"precision"`
+    BatchSize int    `mapstructure:"batch_size"`
+    Gzip      bool   `mapstructure:"gzip"`
+}
+
+// PostgresConfig is the schema of an output of type "postgres".
+type PostgresConfig struct {
+    DSN               string            `mapstructure:"dsn"`
+    BatchSize         int               `mapstructure:"batch_size"`
+    Table             string            `mapstructure:"table"`
+    TimeColumn        string            `mapstructure:"time_column"`
+    MeasurementColumn string            `mapstructure:"measurement_column"`
+    TagsColumn        string            `mapstructure:"tags_column"`
+    FieldsColumn      string            `mapstructure:"fields_column"`
+    Tags              map[string]string `mapstructure:"tags"`
+    Fields            map[string]string `mapstructure:"fields"`
+    ConflictColumns   []string          `mapstructure:"conflict_columns"`
+}
+
+// ArchiveConfig is the schema of an output of type "s3".
+type ArchiveConfig struct {
+    Endpoint      string        `mapstructure:"endpoint"`
+    Region        string        `mapstructure:"region"`
+    Bucket        string        `mapstructure:"bucket"`
+    AccessKey     string        `mapstructure:"access_key"`
+    SecretKey     string        `mapstructure:"secret_key"`
+    Prefix        string        `mapstructure:"prefix"`
+    SpoolDir      string        `mapstructure:"spool_dir"`
+    MaxFileMB     int           `mapstructure:"max_file_mb"`
+    MaxMessages   int           `mapstructure:"max_messages"`
+    MaxAge        time.Duration `mapstructure:"max_age"`
+    PartSizeMB    int           `mapstructure:"part_size_mb"`
+    UploadTimeout time.Duration `mapstructure:"upload_timeout"`
+}
+
+// RetryConfig is the schema of the "retry" key of any output: how often and
+// how far apart failed sends are retried. Unset keys keep their defaults.
+type RetryConfig struct {
+    MaxRetries     *int          `mapstructure:"max_retries"`
+    AttemptTimeout time.Duration `mapstructure:"attempt_timeout"`
+    Initial        time.Duration `mapstructure:"initial"`
+    Multiplier     float64       `mapstructure:"multiplier"`
+    Max            time.Duration `mapstructure:"max"`
+    Jitter         *float64      `mapstructure:"jitter"`
+    MaxElapsed     time.Duration `mapstructure:"max_elapsed"`
+}
+
+// CircuitConfig is the schema of the "circuit" key of any output: after how
+// many consecutive failed sends the output is paused and for how long before
+// one message probes it. Zero failures turns the breaker off.
+type CircuitConfig struct {
+    Failures *int          `mapstructure:"failures"`
+    OpenFor  time.Duration `mapstructure:"open_for"`
+}
+
+// KafkaConfig is the schema of an output of type "kafka".
+type KafkaConfig struct {
+    Brokers     []string     `mapstructure:"brokers"`
+    Topic       string       `mapstructure:"topic"`
+    ClientID    string       `mapstructure:"client_id"`
+    Compression string       `mapstructure:"compression"`
+    Routes      []KafkaRoute `mapstructure:"routes"`
+    Envelope    struct {
+        Enabled   bool   `mapstructure:"enabled"`
+        GatewayID string `mapstructure:"gateway_id"`
+        Size      int    `mapstructure:"size"`
+        SeqFile   string `mapstructure:"seq_file"`
+    } `mapstructure:"envelope"`
+}
+
+// KafkaRoute sends matching messages to a templated topic (see kafka.Route).
+type KafkaRoute struct {
+    Match string `mapstructure:"match"`
+    Field string `mapstructure:"field"`
+    Value string `mapstructure:"value"`
+    Topic string `mapstructure:"topic"`
+}
+
+// HTTPIngestConfig is the schema of an input of type "http".
+type HTTPIngestConfig struct {
+    Addr         string `mapstructure:"addr"`
+    MaxBodyBytes int64  `mapstructure:"max_body_bytes"`
+    Auth         struct {
+        Type   string `mapstructure:"type"`
+        Token  string `mapstructure:"token"`
+        Secret string `mapstructure:"secret"`
+        Header string `mapstructure:"header"`
+    } `mapstructure:"auth"`
+    Routes []struct {
+        Path  string `mapstructure:"path"`
+        Topic string `mapstructure:"topic"`
+    } `mapstructure:"routes"`
+}
+
+// CoAPConfig is the schema of an input of type "coap".
+type CoAPConfig struct {
+    Addr            string `mapstructure:"addr"`
+    MaxPayloadBytes int    `mapstructure:"max_payload_bytes"`
+    Resources       []struct {
+        Path  string `mapstructure:"path"`
+        Topic string `mapstructure:"topic"`
+    } `mapstructure:"resources"`
+}
+
+// LineProtoListener is the schema of an input of type "line_protocol".
+type LineProtoListener struct {
+    Format      string `mapstructure:"format"`
+    Transport   string `mapstructure:"transport"`
+    Addr        string `mapstructure:"addr"`
+    TopicPrefix string `mapstructure:"topic_prefix"`
+    Precision   string `mapstructure:"precision"`
+}
+
+// ModbusDevice is the schema of an input of type "modbus".
+type ModbusDevice struct {
+    Name           string           `mapstructure:"name"`
+    Address        string           `mapstructure:"address"`
+    UnitID         int              `mapstructure:"unit_id"`
+    PollIntervalMs int              `mapstructure:"poll_interval_ms"`
+    TimeoutMs      int              `mapstructure:"timeout_ms"`
+    Topic          string           `mapstructure:"topic"`
+    MaxGap         int              `mapstructure:"max_gap"`
+    Registers      []ModbusRegister `mapstructure:"registers"`
+}
+
+type ModbusRegister struct {
+    Name      string  `mapstructure:"name"`
+    Table     string  `mapstructure:"table"`
+    Address   int     `mapstructure:"address"`
+    Type      string  `mapstructure:"type"`
+    ByteOrder string  `mapstructure:"byte_order"`
+    WordOrder string  `mapstructure:"word_order"`
+    Scale     float64 `mapstructure:"scale"`
+    Offset    float64 `mapstructure:"offset"`
 }
 
 func Load(path string) (*Config, error) {
@@ -29,5 +235,68 @@ func Load(path string) (*Config, error) {
     if err := v.Unmarshal(&cfg); err != nil {
         return nil, err
     }
+    cfg.Inputs = append(cfg.Inputs, sectionInputs(v, &cfg)...)
+    cfg.Outputs = append(cfg.Outputs, sectionOutputs(&cfg)...)
     return &cfg, nil
 }
+
+// sectionInputs converts the single-instance input sections into entries.
+// A section is skipped when its address or broker is empty.
+func sectionInputs(v *viper.Viper, cfg *Config) []map[string]interface{} {
+    var out []map[string]interface{}
+    if isSet(cfg.MQTT["broker"]) {
+        out = append(out, withType("mqtt", cfg.MQTT))
+    }
+    if m := v.GetStringMap("http_ingest"); isSet(m["addr"]) {
+        out = append(out, withType("http", m))
+    }
+    if m := v.GetStringMap("coap"); isSet(m["addr"]) {
+        out = append(out, withType("coap", m))
+    }
+    for _, m := range listOfMaps(v.Get("modbus.devices")) {
+        out = append(out, withType("modbus", m))
+    }
+    for _, m := range listOfMaps(v.Get("line_protocol.listeners")) {
+        out = append(out, withType("line_protocol", m))
+    }
+    return out
+}
+
+// sectionOutputs converts the kafka section into an output entry.
+func sectionOutputs(cfg *Config) []map[string]interface{} {
+    if !isSet(cfg.Kafka["brokers"]) {
+        return nil
+    }
+    return []map[string]interface{}{withType("kafka", cfg.Kafka)}
+}
+
+func withType(typ string, m map[string]interface{}) map[string]interface{} {
+    out := make(map[string]interface{}, len(m)+1)
+    for k, v := range m {
+        out[k] = v
+    }
+    out["type"] = typ
+    return out
+}
+
+func listOfMaps(v interface{}) []map[string]interface{} {
+    items, _ := v.([]interface{})
+    var out []map[string]interface{}
+    for _, it := range items {
+        if m, ok := it.(map[string]interface{}); ok {
+            out = append(out, m)
+        }
+    }
+    return out
+}
+
+func isSet(v interface{}) bool {
+    switch vv := v.(type) {
+    case nil:
+        return false
+    case []interface{}:
+        return len(vv) > 0
+    default:
+        return fmt.Sprint(v) != ""
+    }
+}
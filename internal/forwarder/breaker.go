@@ -0,0 +1,140 @@
+package forwarder
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+)
+
+// Circuit breaker defaults.
+const (
+	DefaultBreakerFailures = 5
+	DefaultBreakerOpenFor  = 30 * time.Second
+)
+
+// BreakerState is the state of a forwarder's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed delivers normally.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen sends nothing until the open period has passed.
+	BreakerOpen
+	// BreakerHalfOpen sends a single message to probe whether the sink is
+	// back.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker stops a forwarder from sending to a sink that keeps failing. It
+// opens after a number of consecutive failed sends, then after a pause lets
+// one probe through: if that succeeds it closes, otherwise it opens again.
+// Only transitions are logged.
+type breaker struct {
+	sink     string
+	failures int
+	openFor  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failed   int
+	openedAt time.Time
+	probing  bool
+}
+
+// newBreaker returns a breaker that opens after failures consecutive failures
+// for openFor. Zero failures disables it.
+func newBreaker(sink string, failures int, openFor time.Duration) *breaker {
+	if openFor <= 0 {
+		openFor = DefaultBreakerOpenFor
+	}
+	b := &breaker{sink: sink, failures: failures, openFor: openFor}
+	metrics.SinkCircuitState.WithLabelValues(sink).Set(float64(BreakerClosed))
+	return b
+}
+
+// allow reports whether a flush may send, and whether it is the probe of a
+// half-open breaker. A probe must be finished with endProbe.
+func (b *breaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false, false
+		}
+		b.set(BreakerHalfOpen, "probing with one message")
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// endProbe lets the next flush probe again if the probe sent nothing.
+func (b *breaker) endProbe() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// success records that the sink took a send.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed = 0
+	if b.state != BreakerClosed {
+		b.set(BreakerClosed, "sink recovered")
+	}
+}
+
+// failure records a failed send and reports whether the breaker is open now.
+func (b *breaker) failure(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures <= 0 {
+		return false
+	}
+	b.failed++
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.openedAt = time.Now()
+		b.set(BreakerOpen, fmt.Sprintf("probe failed: %v; next probe in %v", err, b.openFor))
+	case b.state == BreakerClosed && b.failed >= b.failures:
+		b.openedAt = time.Now()
+		b.set(BreakerOpen, fmt.Sprintf("%d consecutive failures, last: %v; pausing for %v", b.failed, err, b.openFor))
+	}
+	return b.state == BreakerOpen
+}
+
+// current returns the breaker's state.
+func (b *breaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breaker) set(s BreakerState, why string) {
+	label := ""
+	if b.sink != "" {
+		label = "[" + b.sink + "]"
+	}
+	fmt.Printf("forwarder%s: circuit %s: %s\n", label, s, why)
+	b.state = s
+	metrics.SinkCircuitState.WithLabelValues(b.sink).Set(float64(s))
+}
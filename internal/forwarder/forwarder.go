@@ -3,28 +3,54 @@ package forwarder
 import (
 	"context"
 	"fmt"
-	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/your-username/iot-edge-gateway/internal/backoff"
 	"github.com/your-username/iot-edge-gateway/internal/buffer"
-	"github.com/your-username/iot-edge-gateway/internal/kafka"
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
 )
 
 type Forwarder struct {
-	store    *buffer.Store
-	producer kafka.ProducerClient
+	sink     string
+	store    buffer.Buffer
+	producer plugin.Sink
 	interval time.Duration
 	ctx      context.Context
 	cancel   context.CancelFunc
 	retries  int
 	timeout  time.Duration
+	workers  int
+	loops    sync.WaitGroup
+	// backoff spaces out retries and, once they are used up, the next flush
+	backoff *backoff.Backoff
+	breaker *breaker
+
+	// flush trigger, see SetTrigger
+	wake      chan struct{}
+	linger    time.Duration
+	threshold int64
+	arrived   atomic.Int64
+	urgent    atomic.Bool
 }
 
-// New creates a forwarder that polls the buffer and forwards messages to Kafka.
+// leaseMargin is added to lease durations to cover the time around a send.
+const leaseMargin = 30 * time.Second
+
+// New creates a forwarder that polls the buffer and forwards messages to a sink.
 // interval: how often to poll the buffer
 // retries: number of retries per message on transient failures
 // timeout: per-message produce timeout
-func New(store *buffer.Store, producer kafka.ProducerClient, interval time.Duration, retries int, timeout time.Duration) *Forwarder {
+func New(store buffer.Buffer, producer plugin.Sink, interval time.Duration, retries int, timeout time.Duration) *Forwarder {
+	return NewForSink("", store, producer, interval, retries, timeout)
+}
+
+// NewForSink creates a forwarder that delivers the messages pending for the
+// named sink (see buffer.Buffer.SetSinks) and acknowledges them independently
+// of other sinks. An empty name uses the store's shared sent flag.
+func NewForSink(sink string, store buffer.Buffer, producer plugin.Sink, interval time.Duration, retries int, timeout time.Duration) *Forwarder {
 	if retries < 0 {
 		retries = 3
 	}
@@ -33,6 +59,7 @@ func New(store *buffer.Store, producer kafka.ProducerClient, interval time.Durat
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Forwarder{
+		sink:     sink,
 		store:    store,
 		producer: producer,
 		interval: interval,
@@ -40,65 +67,246 @@ func New(store *buffer.Store, producer kafka.ProducerClient, interval time.Durat
 		cancel:   cancel,
 		retries:  retries,
 		timeout:  timeout,
+		backoff:  backoff.New(backoff.DefaultPolicy()),
+		breaker:  newBreaker(sink, DefaultBreakerFailures, DefaultBreakerOpenFor),
 	}
 }
 
+// SetBackoff sets the policy for the delays between retries. Failures count
+// across flushes until a send succeeds, so a sink that stays down is tried
+// less and less often, up to the policy's maximum delay. Call it before
+// Start.
+func (f *Forwarder) SetBackoff(p backoff.Policy) {
+	f.backoff = backoff.New(p)
+}
+
+// SetWorkers sets how many goroutines drain the sink in parallel. Each worker
+// leases the messages it sends, so this needs a buffer implementing
+// buffer.Leaser and a sink that is safe for concurrent use; messages may then
+// arrive out of order. Accumulator sinks always use a single worker. Call it
+// before Start.
+func (f *Forwarder) SetWorkers(n int) {
+	f.workers = n
+}
+
+// SetBreaker sets after how many consecutive failed sends the circuit breaker
+// opens and how long it stays open before it lets one message through to
+// probe the sink. Zero failures disables the breaker. Call it before Start.
+func (f *Forwarder) SetBreaker(failures int, openFor time.Duration) {
+	f.breaker = newBreaker(f.sink, failures, openFor)
+}
+
+// Circuit returns the state of the circuit breaker.
+func (f *Forwarder) Circuit() BreakerState {
+	return f.breaker.current()
+}
+
 func (f *Forwarder) Start() {
-	go f.loop()
+	_, leasing := f.store.(buffer.Leaser)
+	_, accumulating := f.producer.(plugin.Accumulator)
+	if f.workers <= 1 || !leasing || accumulating {
+		f.loops.Add(1)
+		go f.loop("")
+		return
+	}
+	for i := 0; i < f.workers; i++ {
+		f.loops.Add(1)
+		go f.loop(fmt.Sprintf("%s#%d", f.sink, i))
+	}
 }
 
+// Stop stops the forwarder and waits until its loops have returned, so the
+// sink and the buffer are no longer in use. A send in progress is not
+// retried, but may take up to the produce timeout to finish.
 func (f *Forwarder) Stop() {
 	if f.cancel != nil {
 		f.cancel()
 	}
+	f.loops.Wait()
 }
 
-func (f *Forwarder) loop() {
+// loop flushes every interval and, with a trigger set, when notified of new
+// messages. A non-empty owner leases the messages it sends, so several loops
+// can drain the same sink.
+func (f *Forwarder) loop(owner string) {
+	defer f.loops.Done()
 	ticker := time.NewTicker(f.interval)
 	defer ticker.Stop()
+	var linger <-chan time.Time
 	for {
 		select {
 		case <-f.ctx.Done():
 			return
 		case <-ticker.C:
-			f.flushOnce()
+		case <-linger:
+		case <-f.wake:
+			if !f.due() {
+				if linger == nil {
+					linger = time.After(f.linger)
+				}
+				continue
+			}
+		}
+		linger = nil
+		f.arrived.Store(0)
+		f.urgent.Store(false)
+		if f.flush(owner) && f.wake != nil {
+			// more is waiting; carry on instead of waiting for the next tick
+			f.urgent.Store(true)
+			f.signal()
 		}
 	}
 }
 
 func (f *Forwarder) flushOnce() {
+	f.flush("")
+}
+
+// flush delivers the next messages pending for the sink and reports whether
+// it delivered a full fetch without failures, so more may be waiting.
+func (f *Forwarder) flush(owner string) bool {
 	if f.store == nil || f.producer == nil {
-		return
+		return false
+	}
+	if f.backoff.Remaining() > 0 {
+		// the sink failed recently; wait out the backoff before sending again
+		return false
+	}
+	ok, probe := f.breaker.allow()
+	if !ok {
+		return false
+	}
+	if probe {
+		defer f.breaker.endProbe()
 	}
 
-	msgs, err := f.store.FetchUnsent(100)
+	// Batch sinks take up to BatchSize messages per delivery, other sinks one.
+	size := 1
+	bs, batched := f.producer.(plugin.BatchSink)
+	if batched && bs.BatchSize() > 1 {
+		size = bs.BatchSize()
+	}
+	limit := 100
+	if size > limit {
+		limit = size
+	}
+	acc, accumulating := f.producer.(plugin.Accumulator)
+	retries := f.retries
+	if probe {
+		// a half-open breaker tries one message, or one unit of an
+		// accumulating sink, once
+		retries = 0
+		if !accumulating {
+			size, limit = 1, 1
+		}
+	}
+
+	var msgs []buffer.Message
+	var err error
+	leaser, _ := f.store.(buffer.Leaser)
+	if owner != "" {
+		msgs, err = leaser.Lease(f.sink, owner, limit, f.timeout+leaseMargin)
+	} else {
+		msgs, err = f.store.FetchPending(f.sink, limit)
+	}
 	if err != nil {
-		fmt.Printf("forwarder: fetch unsent error: %v\n", err)
-		return
+		fmt.Printf("forwarder%s: fetch unsent error: %v\n", f.label(), err)
+		return false
 	}
 	if len(msgs) == 0 {
-		return
+		return false
+	}
+	batch := make([]plugin.Message, len(msgs))
+	for i, m := range msgs {
+		batch[i] = plugin.Message{ID: m.ID, Topic: m.Topic, Payload: m.Payload, Time: m.CreatedAt}
+	}
+
+	// renew keeps the leases on the messages not yet sent for d more
+	renew := func(d time.Duration) error { return nil }
+	if owner != "" {
+		defer func() {
+			// what is left goes back to the queue after a pause
+			if err := leaser.Release(f.sink, owner, ids(batch), f.interval); err != nil {
+				fmt.Printf("forwarder%s: release leases: %v\n", f.label(), err)
+			}
+		}()
 	}
 
 	var sentIDs []int64
-	for _, m := range msgs {
-		ok := f.sendWithRetry(m.Payload)
-		if ok {
-			sentIDs = append(sentIDs, m.ID)
-		} else {
+	for len(batch) > 0 {
+		n := size
+		if accumulating {
+			// the sink decides how many messages form its next unit, if any yet
+			if n = acc.Take(batch); n <= 0 {
+				break
+			}
+		}
+		if n > len(batch) {
+			n = len(batch)
+		}
+		if owner != "" {
+			held := ids(batch)
+			renew = func(d time.Duration) error { return leaser.Extend(f.sink, owner, held, d+leaseMargin) }
+			if err := renew(f.timeout); err != nil {
+				fmt.Printf("forwarder%s: %v; leaving messages to other workers\n", f.label(), err)
+				break
+			}
+		}
+		chunk := batch[:n]
+
+		err := f.sendWithRetry(chunk, retries, renew)
+		if err != nil && !plugin.IsPermanent(err) {
 			// If a message fails after retries, stop processing further to avoid reordering,
 			// and leave remaining messages for the next run. This is conservative.
-			fmt.Printf("forwarder: message id=%d failed after retries; will retry later\n", m.ID)
+			if f.breaker.current() == BreakerClosed {
+				fmt.Printf("forwarder%s: message id=%d failed after retries; will retry later\n", f.label(), chunk[0].ID)
+			}
+			metrics.ForwardFailed.Add(float64(n))
 			break
 		}
+		batch = batch[n:]
+		if err != nil {
+			// The sink rejected the messages; retrying would block the buffer forever.
+			fmt.Printf("forwarder%s: dropping %d message(s) from id=%d rejected by sink: %v\n", f.label(), n, chunk[0].ID, err)
+			metrics.ForwardDropped.Add(float64(n))
+		} else {
+			metrics.Forwarded.Add(float64(n))
+		}
+		for _, m := range chunk {
+			sentIDs = append(sentIDs, m.ID)
+		}
 	}
 
+	more := len(msgs) == limit && len(sentIDs) == len(msgs)
 	if len(sentIDs) > 0 {
-		if err := f.store.MarkSent(sentIDs); err != nil {
-			fmt.Printf("forwarder: failed to mark messages as sent: %v\n", err)
+		if err := f.store.Ack(f.sink, sentIDs); err != nil {
+			more = false
+			fmt.Printf("forwarder%s: failed to mark messages as sent: %v\n", f.label(), err)
 			// We don't attempt rollback; on next run, fetch will include same messages (but they may be re-sent).
+		} else if _, err := f.store.PurgeSent(); err != nil {
+			fmt.Printf("forwarder%s: purge sent messages: %v\n", f.label(), err)
 		}
 	}
+	if cnt, err := f.store.CountPending(f.sink); err == nil {
+		metrics.SinkPending.WithLabelValues(f.sink).Set(float64(cnt))
+	}
+	return more
+}
+
+// label returns the sink name formatted for log lines.
+func (f *Forwarder) label() string {
+	if f.sink == "" {
+		return ""
+	}
+	return "[" + f.sink + "]"
+}
+
+func ids(msgs []plugin.Message) []int64 {
+	out := make([]int64, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.ID
+	}
+	return out
 }
 
 // FlushOnce exposes flushOnce for testing.
@@ -106,21 +314,57 @@ func (f *Forwarder) FlushOnce() {
 	f.flushOnce()
 }
 
-func (f *Forwarder) sendWithRetry(payload []byte) bool {
-	var lastErr error
-	for attempt := 0; attempt <= f.retries; attempt++ {
-		// exponential backoff sleep for attempts > 0
-		if attempt > 0 {
-			backoff := time.Duration(math.Pow(2, float64(attempt-1))) * 500 * time.Millisecond
-			time.Sleep(backoff)
+// sendWithRetry delivers msgs, retrying transient failures after the delays
+// of the backoff policy, or longer when the sink asked for a delay. Permanent
+// failures are returned without retrying. It gives up after the given number
+// of retries, once the policy's MaxElapsed has passed, when the circuit
+// breaker opens and when the forwarder is stopped. renew is called before
+// each wait with the time until the next attempt ends; its error stops the
+// retries.
+func (f *Forwarder) sendWithRetry(msgs []plugin.Message, retries int, renew func(time.Duration) error) error {
+	maxElapsed := f.backoff.Policy().MaxElapsed
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		err := f.produce(msgs)
+		if err == nil || plugin.IsPermanent(err) {
+			// a rejection still shows the sink is up
+			f.backoff.Success()
+			f.breaker.success()
+			return err
 		}
-		err := f.producer.Produce(payload, f.timeout)
-		if err == nil {
-			return true
+		if f.breaker.current() == BreakerClosed {
+			fmt.Printf("forwarder%s: produce attempt=%d failed: %v\n", f.label(), attempt+1, err)
 		}
-		lastErr = err
-		fmt.Printf("forwarder: produce attempt=%d failed: %v\n", attempt+1, err)
+		asked, _ := plugin.RetryDelay(err)
+		delay := f.backoff.Failure(asked)
+		if attempt >= retries || maxElapsed > 0 && time.Since(start)+delay > maxElapsed {
+			// the breaker counts failed sends, not attempts
+			if !f.breaker.failure(err) {
+				fmt.Printf("forwarder%s: all retries failed; next attempt in %v; last error: %v\n", f.label(), delay.Round(time.Millisecond), err)
+			}
+			return err
+		}
+		if f.breaker.current() == BreakerOpen {
+			// another worker's failures opened it
+			return err
+		}
+		if rerr := renew(delay + f.timeout); rerr != nil {
+			return rerr
+		}
+		if backoff.Sleep(f.ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+// produce hands msgs to the sink using the richest interface it implements.
+func (f *Forwarder) produce(msgs []plugin.Message) error {
+	switch p := f.producer.(type) {
+	case plugin.BatchSink:
+		return p.ProduceBatch(msgs, f.timeout)
+	case plugin.TopicSink:
+		return p.ProduceTopic(msgs[0].Topic, msgs[0].Payload, f.timeout)
+	default:
+		return p.Produce(msgs[0].Payload, f.timeout)
 	}
-	fmt.Printf("forwarder: all retries failed; last error: %v\n", lastErr)
-	return false
 }
@@ -1,14 +1,18 @@
 package forwarder
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 	"path/filepath"
 
+	"github.com/your-username/iot-edge-gateway/internal/backoff"
 	"github.com/your-username/iot-edge-gateway/internal/buffer"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
 )
 
-// mock producer implements kafka.ProducerClient
+// mock producer implements plugin.Sink
 type mockProducer struct {
 	fail  bool
 	calls int
@@ -105,3 +109,441 @@ func TestForwarderFlushOnceRetryFail(t *testing.T) {
 		t.Fatalf("expected unsent messages to remain after failed forward")
 	}
 }
+
+func TestForwarderBacksOffBetweenFlushes(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Enqueue([]byte("m1")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	mock := &mockProducer{fail: true}
+	f := New(store, mock, time.Second, 1, 100*time.Millisecond)
+	f.SetBackoff(backoff.Policy{Initial: 20 * time.Millisecond, Multiplier: 2, Max: time.Second})
+	f.FlushOnce()
+	if mock.calls != 2 {
+		t.Fatalf("expected 2 produce calls, got %d", mock.calls)
+	}
+	// the second failure set a 40ms delay, which the next flush respects
+	f.FlushOnce()
+	if mock.calls != 2 {
+		t.Fatalf("flush during backoff called the sink; %d calls", mock.calls)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mock.fail = false
+	f.FlushOnce()
+	if mock.calls != 3 {
+		t.Fatalf("expected a third produce call after the backoff, got %d", mock.calls)
+	}
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("%d messages unsent after the sink recovered", n)
+	}
+}
+
+func TestForwarderStopInterruptsRetry(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Enqueue([]byte("m1")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	f := New(store, &mockProducer{fail: true}, time.Second, 5, 100*time.Millisecond)
+	f.SetBackoff(backoff.Policy{Initial: time.Minute, Multiplier: 1, Max: time.Minute})
+	done := make(chan struct{})
+	go func() {
+		f.FlushOnce()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	f.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stop did not interrupt the retry delay")
+	}
+}
+
+// blockingProducer holds every send until release is closed.
+type blockingProducer struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingProducer) Produce(payload []byte, timeout time.Duration) error {
+	b.entered <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func (b *blockingProducer) Close() {}
+
+func TestForwarderStopWaitsForSend(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Enqueue([]byte("m1")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	sink := &blockingProducer{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	f := New(store, sink, 10*time.Millisecond, 0, time.Second)
+	f.Start()
+	<-sink.entered
+	stopped := make(chan struct{})
+	go func() {
+		f.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatalf("Stop returned while a send was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sink.release)
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stop did not return after the send finished")
+	}
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("expected the message acknowledged before Stop returned, got %d unsent", n)
+	}
+}
+
+func TestForwarderCircuitBreaker(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := store.Enqueue([]byte(fmt.Sprintf("m%d", i))); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	mock := &mockProducer{fail: true}
+	f := New(store, mock, time.Second, 0, 100*time.Millisecond)
+	f.SetBackoff(backoff.Policy{Initial: time.Millisecond, Multiplier: 1, Max: time.Millisecond})
+	f.SetBreaker(2, 50*time.Millisecond)
+	flush := func() {
+		time.Sleep(2 * time.Millisecond) // past the backoff
+		f.FlushOnce()
+	}
+
+	flush()
+	flush()
+	if f.Circuit() != BreakerOpen || mock.calls != 2 {
+		t.Fatalf("after 2 failures: circuit %s, %d calls; want open after 2", f.Circuit(), mock.calls)
+	}
+	flush()
+	if mock.calls != 2 {
+		t.Fatalf("open circuit let a send through")
+	}
+
+	// a failed probe opens it again
+	time.Sleep(50 * time.Millisecond)
+	flush()
+	if f.Circuit() != BreakerOpen || mock.calls != 3 {
+		t.Fatalf("after failed probe: circuit %s, %d calls", f.Circuit(), mock.calls)
+	}
+
+	// a successful probe sends one message and closes it
+	time.Sleep(50 * time.Millisecond)
+	mock.fail = false
+	flush()
+	if f.Circuit() != BreakerClosed || mock.calls != 4 {
+		t.Fatalf("after probe: circuit %s, %d calls", f.Circuit(), mock.calls)
+	}
+	if n, _ := store.CountUnsent(); n != 2 {
+		t.Fatalf("probe sent %d messages, want 1", 3-n)
+	}
+	flush()
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("%d messages unsent after the circuit closed", n)
+	}
+}
+
+func TestForwarderBreakerCountsSendsNotAttempts(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Enqueue([]byte("m")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+
+	mock := &mockProducer{fail: true}
+	f := New(store, mock, time.Second, 3, 100*time.Millisecond)
+	f.SetBackoff(backoff.Policy{Initial: time.Millisecond, Multiplier: 1, Max: time.Millisecond})
+	f.SetBreaker(2, time.Minute)
+
+	f.FlushOnce()
+	if f.Circuit() != BreakerClosed || mock.calls != 4 {
+		t.Fatalf("after one failed send: circuit %s, %d calls; want closed after 4", f.Circuit(), mock.calls)
+	}
+	time.Sleep(2 * time.Millisecond) // past the backoff
+	f.FlushOnce()
+	if f.Circuit() != BreakerOpen || mock.calls != 8 {
+		t.Fatalf("after two failed sends: circuit %s, %d calls; want open after 8", f.Circuit(), mock.calls)
+	}
+}
+
+func TestForwarderSinksDrainIndependently(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	if err := store.SetSinks([]string{"cloud", "local"}); err != nil {
+		t.Fatalf("set sinks: %v", err)
+	}
+	for _, p := range []string{"m1", "m2"} {
+		if _, err := store.Enqueue([]byte(p)); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	cloud := &mockProducer{fail: true}
+	local := &mockProducer{}
+	NewForSink("cloud", store, cloud, time.Second, 0, 100*time.Millisecond).FlushOnce()
+	NewForSink("local", store, local, time.Second, 0, 100*time.Millisecond).FlushOnce()
+
+	if local.calls != 2 {
+		t.Fatalf("expected local sink to receive both messages, got %d calls", local.calls)
+	}
+	if n, _ := store.CountPending("local"); n != 0 {
+		t.Fatalf("expected nothing pending for local, got %d", n)
+	}
+	if n, _ := store.CountPending("cloud"); n != 2 {
+		t.Fatalf("expected 2 pending for failing cloud sink, got %d", n)
+	}
+
+	cloud.fail = false
+	NewForSink("cloud", store, cloud, time.Second, 0, 100*time.Millisecond).FlushOnce()
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("expected all messages sent once both sinks acked, got %d unsent", n)
+	}
+}
+
+// batchProducer implements plugin.BatchSink
+type batchProducer struct {
+	size    int
+	err     error
+	batches [][]plugin.Message
+}
+
+func (b *batchProducer) Produce(payload []byte, timeout time.Duration) error { return nil }
+func (b *batchProducer) Close()                                            {}
+func (b *batchProducer) BatchSize() int                                    { return b.size }
+func (b *batchProducer) ProduceBatch(msgs []plugin.Message, timeout time.Duration) error {
+	b.batches = append(b.batches, msgs)
+	return b.err
+}
+
+func TestForwarderBatchesAndDropsRejected(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	for _, p := range []string{"m1", "m2", "m3"} {
+		if _, err := store.EnqueueTopic("t/"+p, []byte(p)); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	sink := &batchProducer{size: 2}
+	New(store, sink, time.Second, 0, time.Second).FlushOnce()
+	if len(sink.batches) != 2 || len(sink.batches[0]) != 2 || len(sink.batches[1]) != 1 {
+		t.Fatalf("unexpected batches: %v", sink.batches)
+	}
+	if sink.batches[1][0].Topic != "t/m3" {
+		t.Fatalf("expected topic to be passed through, got %q", sink.batches[1][0].Topic)
+	}
+
+	// a permanent rejection is not retried and does not block the buffer
+	if _, err := store.Enqueue([]byte("bad")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	sink = &batchProducer{size: 2, err: plugin.Permanent(errMock)}
+	New(store, sink, time.Second, 3, time.Second).FlushOnce()
+	if len(sink.batches) != 1 {
+		t.Fatalf("expected a single attempt for a permanent failure, got %d", len(sink.batches))
+	}
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("expected rejected message to be dropped, got %d unsent", n)
+	}
+}
+
+// accProducer implements plugin.Accumulator, taking messages in groups of want
+type accProducer struct {
+	batchProducer
+	want int
+}
+
+func (a *accProducer) Take(msgs []plugin.Message) int {
+	if len(msgs) < a.want {
+		return 0
+	}
+	return a.want
+}
+
+func TestForwarderAccumulatorKeepsMessagesPending(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	enqueue := func(p string) {
+		if _, err := store.Enqueue([]byte(p)); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	enqueue("m1")
+	enqueue("m2")
+
+	sink := &accProducer{batchProducer: batchProducer{size: 10}, want: 3}
+	New(store, sink, time.Second, 0, time.Second).FlushOnce()
+	if len(sink.batches) != 0 {
+		t.Fatalf("expected nothing sent before the sink is ready, got %v", sink.batches)
+	}
+
+	// a failed upload leaves the messages pending
+	enqueue("m3")
+	sink.err = errMock
+	New(store, sink, time.Second, 0, time.Second).FlushOnce()
+	if n, _ := store.CountUnsent(); n != 3 {
+		t.Fatalf("expected 3 unsent after failed upload, got %d", n)
+	}
+
+	// being notified of new messages does not wake an accumulating sink
+	f := New(store, sink, time.Second, 0, time.Second)
+	f.SetTrigger(0, 1)
+	if f.wake != nil {
+		t.Fatalf("expected no flush trigger for an accumulating sink")
+	}
+	f.Notify(1, plugin.PriorityHigh)
+
+	sink.err = nil
+	New(store, sink, time.Second, 0, time.Second).FlushOnce()
+	if last := sink.batches[len(sink.batches)-1]; len(last) != 3 {
+		t.Fatalf("expected one batch of 3, got %d", len(last))
+	}
+	if n, _ := store.CountUnsent(); n != 0 {
+		t.Fatalf("expected all messages sent, got %d unsent", n)
+	}
+}
+
+// countingProducer records how often each payload was sent; safe for
+// concurrent use
+type countingProducer struct {
+	mu   sync.Mutex
+	sent map[string]int
+}
+
+func (c *countingProducer) Produce(payload []byte, timeout time.Duration) error {
+	time.Sleep(100 * time.Microsecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent[string(payload)]++
+	return nil
+}
+
+func (c *countingProducer) Close() {}
+
+func TestForwarderWorkersDoNotSendTwice(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	if err := store.SetSinks([]string{"cloud"}); err != nil {
+		t.Fatalf("set sinks: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		if _, err := store.Enqueue([]byte(fmt.Sprintf("m%d", i))); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+
+	sink := &countingProducer{sent: map[string]int{}}
+	f := NewForSink("cloud", store, sink, time.Second, 0, time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f.flush(fmt.Sprintf("cloud#%d", i))
+		}(i)
+	}
+	wg.Wait()
+
+	if len(sink.sent) != 300 {
+		t.Fatalf("expected 300 distinct messages sent, got %d", len(sink.sent))
+	}
+	for p, n := range sink.sent {
+		if n != 1 {
+			t.Fatalf("%s sent %d times", p, n)
+		}
+	}
+	if n, _ := store.CountPending("cloud"); n != 0 {
+		t.Fatalf("expected nothing pending, got %d", n)
+	}
+}
+
+func TestForwarderFlushesWhenNotified(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+
+	sink := &countingProducer{sent: map[string]int{}}
+	// the ticker never fires during the test
+	f := New(store, sink, time.Hour, 0, time.Second)
+	f.SetTrigger(20*time.Millisecond, 1000)
+	f.Start()
+	defer f.Stop()
+
+	waitSent := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			sink.mu.Lock()
+			got := len(sink.sent)
+			sink.mu.Unlock()
+			if got == n {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("%d messages not sent after being notified", n)
+	}
+
+	// a single message goes out after the linger time
+	if _, err := store.Enqueue([]byte("first")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	f.Notify(1, plugin.PriorityNormal)
+	waitSent(1)
+
+	// a high priority message skips the linger, and a backlog larger than
+	// one fetch is drained without waiting for the ticker
+	for i := 0; i < 250; i++ {
+		if _, err := store.Enqueue([]byte(fmt.Sprintf("m%d", i))); err != nil {
+			t.Fatalf("enqueue: %v", err)
+		}
+	}
+	f.Notify(250, plugin.PriorityHigh)
+	waitSent(251)
+}
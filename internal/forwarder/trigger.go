@@ -0,0 +1,57 @@
+package forwarder
+
+import (
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// Flush trigger defaults.
+const (
+	DefaultLinger    = 50 * time.Millisecond
+	DefaultThreshold = 100
+)
+
+// SetTrigger makes the forwarder flush when it is notified of new messages
+// instead of only every interval, which remains as a fallback. After the
+// first new message it lingers to collect more into the same flush, but
+// flushes at once when threshold messages have arrived or a message of high
+// priority. A zero linger flushes on every notification; a zero threshold
+// always lingers. Accumulator sinks are left to the interval: they deliver
+// on their own size and age thresholds, and waking them would fetch a whole
+// unit only for Take to wait for more. Call it before Start.
+func (f *Forwarder) SetTrigger(linger time.Duration, threshold int) {
+	if _, ok := f.producer.(plugin.Accumulator); ok {
+		return
+	}
+	f.wake = make(chan struct{}, 1)
+	f.linger = linger
+	f.threshold = int64(threshold)
+}
+
+// Notify tells the forwarder that n messages were buffered, the highest of
+// them with the given priority. It does not block and does nothing unless
+// SetTrigger was called.
+func (f *Forwarder) Notify(n, priority int) {
+	if f.wake == nil {
+		return
+	}
+	f.arrived.Add(int64(n))
+	if priority >= plugin.PriorityHigh {
+		f.urgent.Store(true)
+	}
+	f.signal()
+}
+
+func (f *Forwarder) signal() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due reports whether the messages that arrived warrant a flush without
+// lingering.
+func (f *Forwarder) due() bool {
+	return f.linger <= 0 || f.urgent.Load() || f.threshold > 0 && f.arrived.Load() >= f.threshold
+}
@@ -0,0 +1,283 @@
+package httpingest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// DefaultMaxBodyBytes is used when no request size limit is configured.
+const DefaultMaxBodyBytes = 1 << 20
+
+// Route maps an HTTP path to the virtual topic its payloads are submitted under.
+type Route struct {
+	Path  string
+	Topic string
+}
+
+// Auth selects how requests are authenticated.
+// Type is one of "none", "bearer" or "hmac". For "hmac" the request must carry
+// the hex encoded HMAC-SHA256 of the body in Header (default X-Signature),
+// optionally prefixed with "sha256=".
+type Auth struct {
+	Type   string
+	Token  string
+	Secret string
+	Header string
+}
+
+// Server accepts JSON readings over HTTP and submits them to the pipeline.
+type Server struct {
+	http    *http.Server
+	in      plugin.Ingester
+	auth    Auth
+	maxBody int64
+}
+
+// New creates an HTTP ingest server listening on addr.
+// maxBody limits the request body size in bytes; zero uses DefaultMaxBodyBytes.
+func New(addr string, routes []Route, auth Auth, maxBody int64, in plugin.Ingester) (*Server, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("addr required")
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("at least one route required")
+	}
+	switch auth.Type {
+	case "", "none":
+	case "bearer":
+		if auth.Token == "" {
+			return nil, fmt.Errorf("bearer auth requires a token")
+		}
+	case "hmac":
+		if auth.Secret == "" {
+			return nil, fmt.Errorf("hmac auth requires a secret")
+		}
+		if auth.Header == "" {
+			auth.Header = "X-Signature"
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth type %q", auth.Type)
+	}
+	if maxBody <= 0 {
+		maxBody = DefaultMaxBodyBytes
+	}
+	s := &Server{
+		in:      in,
+		auth:    auth,
+		maxBody: maxBody,
+	}
+	mux := http.NewServeMux()
+	for _, r := range routes {
+		if r.Path == "" || r.Topic == "" {
+			return nil, fmt.Errorf("route requires path and topic")
+		}
+		mux.Handle(r.Path, s.handler(r.Topic))
+	}
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// Start binds the listener and serves requests in the background.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.http.Serve(ln); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("http ingest: server error: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// Close stops accepting requests and waits up to 5s for in-flight ones.
+func (s *Server) Close() {
+	if s == nil || s.http == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = s.http.Shutdown(ctx)
+}
+
+// Handler returns the underlying HTTP handler; used by tests.
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+func (s *Server) handler(topic string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code, body := s.serve(topic, r)
+		metrics.HTTPIngestRequests.WithLabelValues(strconv.Itoa(code)).Inc()
+		if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "5")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+}
+
+type response struct {
+	Accepted int    `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (s *Server) serve(topic string, r *http.Request) (int, response) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		return http.StatusMethodNotAllowed, response{Error: "method not allowed"}
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, s.maxBody+1))
+	if err != nil {
+		return http.StatusBadRequest, response{Error: "failed reading body"}
+	}
+	if int64(len(body)) > s.maxBody {
+		return http.StatusRequestEntityTooLarge, response{Error: "request body too large"}
+	}
+	if !s.authorized(r, body) {
+		return http.StatusUnauthorized, response{Error: "unauthorized"}
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !supported(mt) {
+		return http.StatusUnsupportedMediaType, response{Error: "unsupported content type"}
+	}
+	payloads, err := split(mt, body)
+	if err != nil {
+		return http.StatusBadRequest, response{Error: err.Error()}
+	}
+	if s.in.Full() {
+		return http.StatusTooManyRequests, response{Error: "buffer full"}
+	}
+
+	if bi, ok := s.in.(plugin.BatchIngester); ok {
+		// all or nothing, so a rejected request can be resent whole
+		if err := bi.SubmitBatch(topic, payloads); err != nil {
+			return submitError(topic, err)
+		}
+		return http.StatusAccepted, response{Accepted: len(payloads)}
+	}
+	accepted := 0
+	for _, p := range payloads {
+		if err := s.in.Submit(topic, p); err != nil {
+			if accepted > 0 {
+				// resending the request would duplicate what was accepted
+				fmt.Printf("http ingest: submit failed for topic %s after %d of %d item(s): %v\n", topic, accepted, len(payloads), err)
+				return http.StatusAccepted, response{Accepted: accepted, Error: err.Error()}
+			}
+			return submitError(topic, err)
+		}
+		accepted++
+	}
+	return http.StatusAccepted, response{Accepted: accepted}
+}
+
+// submitError maps a failed submit to the response asking the client to
+// retry.
+func submitError(topic string, err error) (int, response) {
+	if errors.Is(err, plugin.ErrBufferFull) {
+		return http.StatusTooManyRequests, response{Error: "buffer full"}
+	}
+	fmt.Printf("http ingest: submit failed for topic %s: %v\n", topic, err)
+	return http.StatusServiceUnavailable, response{Error: "buffer unavailable"}
+}
+
+func (s *Server) authorized(r *http.Request, body []byte) bool {
+	switch s.auth.Type {
+	case "bearer":
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && subtle.ConstantTimeCompare([]byte(got), []byte(s.auth.Token)) == 1
+	case "hmac":
+		sig := strings.TrimPrefix(r.Header.Get(s.auth.Header), "sha256=")
+		got, err := hex.DecodeString(sig)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(s.auth.Secret))
+		mac.Write(body)
+		return hmac.Equal(got, mac.Sum(nil))
+	default:
+		return true
+	}
+}
+
+func supported(mediaType string) bool {
+	return isNDJSON(mediaType) || mediaType == "" || mediaType == "application/json"
+}
+
+func isNDJSON(mediaType string) bool {
+	return mediaType == "application/x-ndjson" || mediaType == "application/ndjson" || mediaType == "application/jsonl"
+}
+
+// split turns a request body into individual JSON payloads. NDJSON bodies are
+// split per line, JSON arrays per element; any other JSON value is a single
+// reading.
+func split(mediaType string, body []byte) ([][]byte, error) {
+	if isNDJSON(mediaType) {
+		var out [][]byte
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		sc.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+		for n := 1; sc.Scan(); n++ {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return nil, fmt.Errorf("invalid JSON on line %d", n)
+			}
+			out = append(out, append([]byte(nil), line...))
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("empty body")
+		}
+		return out, nil
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("invalid JSON")
+	}
+	if body[0] != '[' {
+		return [][]byte{body}, nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, fmt.Errorf("invalid JSON array")
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	out := make([][]byte, 0, len(items))
+	for _, it := range items {
+		out = append(out, []byte(it))
+	}
+	return out, nil
+}
@@ -0,0 +1,164 @@
+package httpingest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+	"github.com/your-username/iot-edge-gateway/internal/pipeline"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+func newTestServer(t *testing.T, auth Auth, maxBytes int64) (*Server, *buffer.Store) {
+	t.Helper()
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	in := pipeline.New(store, nil, maxBytes)
+	s, err := New(":0", []Route{{Path: "/ingest", Topic: "http/test"}}, auth, 64, in)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	return s, store
+}
+
+func post(s *Server, contentType, body string, hdr map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIngestBatchAndNDJSON(t *testing.T) {
+	s, store := newTestServer(t, Auth{}, 0)
+
+	if rec := post(s, "application/json", `{"t":1}`, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("single: expected 202, got %d", rec.Code)
+	}
+	if rec := post(s, "application/json", `[{"t":2},{"t":3}]`, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("batch: expected 202, got %d", rec.Code)
+	}
+	if rec := post(s, "application/x-ndjson", "{\"t\":4}\n\n{\"t\":5}\n", nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("ndjson: expected 202, got %d", rec.Code)
+	}
+	cnt, err := store.CountUnsent()
+	if err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if cnt != 5 {
+		t.Fatalf("expected 5 buffered messages, got %d", cnt)
+	}
+
+	if rec := post(s, "application/json", `{"t":`, nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid json: expected 400, got %d", rec.Code)
+	}
+	if rec := post(s, "text/plain", `x`, nil); rec.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("text: expected 415, got %d", rec.Code)
+	}
+	if rec := post(s, "application/json", `{"v":"`+strings.Repeat("x", 64)+`"}`, nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large: expected 413, got %d", rec.Code)
+	}
+}
+
+func TestIngestAuth(t *testing.T) {
+	s, _ := newTestServer(t, Auth{Type: "bearer", Token: "secret"}, 0)
+	if rec := post(s, "application/json", `{}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("missing token: expected 401, got %d", rec.Code)
+	}
+	if rec := post(s, "application/json", `{}`, map[string]string{"Authorization": "Bearer secret"}); rec.Code != http.StatusAccepted {
+		t.Fatalf("bearer: expected 202, got %d", rec.Code)
+	}
+
+	s, _ = newTestServer(t, Auth{Type: "hmac", Secret: "k"}, 0)
+	body := `{"t":1}`
+	mac := hmac.New(sha256.New, []byte("k"))
+	mac.Write([]byte(body))
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if rec := post(s, "application/json", body, map[string]string{"X-Signature": sig}); rec.Code != http.StatusAccepted {
+		t.Fatalf("hmac: expected 202, got %d", rec.Code)
+	}
+	if rec := post(s, "application/json", `{"t":2}`, map[string]string{"X-Signature": sig}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("bad hmac: expected 401, got %d", rec.Code)
+	}
+}
+
+func TestIngestBufferFull(t *testing.T) {
+	s, store := newTestServer(t, Auth{}, 1)
+	if rec := post(s, "application/json", `{"t":1}`, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("first: expected 202, got %d", rec.Code)
+	}
+	// the size verdict is cached, so force a fresh check
+	s.in = pipeline.New(store, nil, 1)
+	rec := post(s, "application/json", `{"t":2}`, nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("full: expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+
+	s.in = pipeline.New(nil, nil, 0)
+	if rec := post(s, "application/json", `{"t":3}`, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unavailable: expected 503, got %d", rec.Code)
+	}
+}
+
+// oneByOne accepts limit payloads through Submit, then reports a full buffer.
+type oneByOne struct {
+	limit int
+	got   int
+}
+
+func (o *oneByOne) Submit(topic string, payload []byte) error {
+	if o.got >= o.limit {
+		return plugin.ErrBufferFull
+	}
+	o.got++
+	return nil
+}
+
+func (o *oneByOne) Full() bool { return false }
+
+func TestIngestBatchIsAllOrNothing(t *testing.T) {
+	// the pipeline buffers a request in one batch
+	s, store := newTestServer(t, Auth{}, 0)
+	if rec := post(s, "application/json", `[{"t":1},{"t":2},{"t":3}]`, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("batch: expected 202, got %d", rec.Code)
+	}
+	if n, _ := store.CountUnsent(); n != 3 {
+		t.Fatalf("expected 3 buffered messages, got %d", n)
+	}
+	s.in = pipeline.New(nil, nil, 0)
+	if rec := post(s, "application/json", `[{"t":4},{"t":5}]`, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unavailable: expected 503, got %d", rec.Code)
+	}
+
+	// an ingester without batches that fails part way answers 2xx, so the
+	// client does not resend what was accepted
+	in := &oneByOne{limit: 2}
+	s.in = in
+	rec := post(s, "application/json", `[{"t":6},{"t":7},{"t":8}]`, nil)
+	var resp response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if rec.Code != http.StatusAccepted || resp.Accepted != 2 || resp.Error == "" {
+		t.Fatalf("partial: got %d %+v, want 202 with 2 accepted and an error", rec.Code, resp)
+	}
+	if rec := post(s, "application/json", `[{"t":9}]`, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("none accepted: expected 429, got %d", rec.Code)
+	}
+}
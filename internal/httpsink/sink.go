@@ -0,0 +1,284 @@
+package httpsink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// DefaultBatchSize is the number of messages sent per request when no batch
+// size is configured.
+const DefaultBatchSize = 100
+
+// Auth configures how requests are authenticated.
+// Type is one of "none", "bearer", "basic" or "hmac". For "hmac" the hex
+// encoded HMAC-SHA256 of the request body, as sent, is set in Header
+// (default X-Signature) with a "sha256=" prefix, which is the format the
+// gateway's own HTTP ingest listener verifies.
+type Auth struct {
+	Type     string
+	Token    string
+	Username string
+	Password string
+	Secret   string
+	Header   string
+}
+
+// Config configures a Sink.
+type Config struct {
+	URL    string
+	Method string
+	// Format is "json" for a JSON array of messages per request or "ndjson"
+	// for one message per line.
+	Format    string
+	BatchSize int
+	Gzip      bool
+	Headers   map[string]string
+	Auth      Auth
+}
+
+// Sink posts buffered messages to an HTTP endpoint in batches. Only 400 and
+// 422 responses reject a batch for good; other failures are retried
+// (honouring Retry-After), so a revoked token or a wrong URL pauses delivery
+// instead of dropping the buffer. A batch answered with 413 is split.
+type Sink struct {
+	cfg    Config
+	client *http.Client
+}
+
+// New validates cfg and creates the sink.
+func New(cfg Config) (*Sink, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("url required")
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	switch cfg.Format {
+	case "":
+		cfg.Format = "json"
+	case "json", "ndjson":
+	default:
+		return nil, fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	switch cfg.Auth.Type {
+	case "", "none":
+	case "bearer":
+		if cfg.Auth.Token == "" {
+			return nil, fmt.Errorf("bearer auth requires a token")
+		}
+	case "basic":
+		if cfg.Auth.Username == "" {
+			return nil, fmt.Errorf("basic auth requires a username")
+		}
+	case "hmac":
+		if cfg.Auth.Secret == "" {
+			return nil, fmt.Errorf("hmac auth requires a secret")
+		}
+		if cfg.Auth.Header == "" {
+			cfg.Auth.Header = "X-Signature"
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth type %q", cfg.Auth.Type)
+	}
+	return &Sink{cfg: cfg, client: &http.Client{}}, nil
+}
+
+func (s *Sink) BatchSize() int {
+	return s.cfg.BatchSize
+}
+
+// Produce sends a single payload.
+func (s *Sink) Produce(payload []byte, timeout time.Duration) error {
+	return s.ProduceBatch([]plugin.Message{{Payload: payload}}, timeout)
+}
+
+// ProduceBatch sends msgs in one request, or in smaller ones if the server
+// finds it too large, and waits up to timeout for a 2xx response to each.
+func (s *Sink) ProduceBatch(msgs []plugin.Message, timeout time.Duration) error {
+	return Split(msgs, func(part []plugin.Message) error { return s.send(part, timeout) })
+}
+
+// send posts msgs in one request.
+func (s *Sink) send(msgs []plugin.Message, timeout time.Duration) error {
+	body, err := s.encode(msgs)
+	if err != nil {
+		return plugin.Permanent(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, s.cfg.Method, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return plugin.Permanent(err)
+	}
+	if s.cfg.Format == "ndjson" {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	switch s.cfg.Auth.Type {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Auth.Token)
+	case "basic":
+		req.SetBasicAuth(s.cfg.Auth.Username, s.cfg.Auth.Password)
+	case "hmac":
+		mac := hmac.New(sha256.New, []byte(s.cfg.Auth.Secret))
+		mac.Write(body)
+		req.Header.Set(s.cfg.Auth.Header, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	return StatusError(s.cfg.Method, s.cfg.URL, resp)
+}
+
+func (s *Sink) Close() {
+	s.client.CloseIdleConnections()
+}
+
+// ErrTooLarge is wrapped by StatusError for a 413 response; the messages
+// have to be sent in smaller requests, see Split.
+var ErrTooLarge = errors.New("request too large")
+
+// StatusError classifies a response for the forwarder: nil for 2xx and a
+// permanent error for 400 and 422, which reject the content itself. Anything
+// else is retriable, carrying the Retry-After delay when the server sent one:
+// 401, 403 and 404 usually mean a revoked credential or a wrong URL, which
+// retrying lets the circuit breaker ride out until the configuration is
+// fixed, while dropping would empty the buffer. A 413 wraps ErrTooLarge.
+func StatusError(method, url string, resp *http.Response) error {
+	err := fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity:
+		return plugin.Permanent(err)
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("%w: %w", err, ErrTooLarge)
+	case resp.StatusCode < 400:
+		return fmt.Errorf("%s %s: unexpected %s", method, url, resp.Status)
+	}
+	if d, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+		return plugin.RetryAfter(err, d)
+	}
+	return err
+}
+
+// Split sends msgs with send and, while the server answers that a request is
+// too large, sends each half separately instead. A single message that is
+// still too large is rejected permanently. Parts the server rejects are
+// dropped as long as the others were taken; a retriable failure of any part
+// fails the whole batch, so parts already sent are sent again.
+func Split(msgs []plugin.Message, send func([]plugin.Message) error) error {
+	err := send(msgs)
+	if !errors.Is(err, ErrTooLarge) {
+		return err
+	}
+	if len(msgs) == 1 {
+		return plugin.Permanent(err)
+	}
+	parts := [][]plugin.Message{msgs[:len(msgs)/2], msgs[len(msgs)/2:]}
+	var rejected []error
+	for _, part := range parts {
+		err := Split(part, send)
+		if err != nil && !plugin.IsPermanent(err) {
+			return err
+		}
+		rejected = append(rejected, err)
+	}
+	if rejected[0] != nil && rejected[1] != nil {
+		return rejected[0]
+	}
+	for i, err := range rejected {
+		if err != nil {
+			fmt.Printf("httpsink: dropping %d message(s) from id=%d rejected by the server: %v\n", len(parts[i]), parts[i][0].ID, err)
+		}
+	}
+	return nil
+}
+
+// encode builds the request body. Payloads that are not valid JSON are sent
+// as JSON strings so the body stays well formed.
+func (s *Sink) encode(msgs []plugin.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if s.cfg.Format == "json" {
+		buf.WriteByte('[')
+	}
+	for i, m := range msgs {
+		if i > 0 && s.cfg.Format == "json" {
+			buf.WriteByte(',')
+		}
+		if json.Valid(m.Payload) {
+			if err := json.Compact(&buf, m.Payload); err != nil {
+				return nil, err
+			}
+		} else {
+			b, err := json.Marshal(string(m.Payload))
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(b)
+		}
+		if s.cfg.Format == "ndjson" {
+			buf.WriteByte('\n')
+		}
+	}
+	if s.cfg.Format == "json" {
+		buf.WriteByte(']')
+	}
+	if !s.cfg.Gzip {
+		return buf.Bytes(), nil
+	}
+	var zb bytes.Buffer
+	zw := gzip.NewWriter(&zb)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return zb.Bytes(), nil
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,202 @@
+package httpsink
+
+import (
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+type request struct {
+	header http.Header
+	body   string
+}
+
+func newTestServer(t *testing.T, status int, header map[string]string) (*httptest.Server, chan request) {
+	t.Helper()
+	reqs := make(chan request, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rd io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("gzip: %v", err)
+				return
+			}
+			rd = zr
+		}
+		b, _ := io.ReadAll(rd)
+		reqs <- request{header: r.Header, body: string(b)}
+		for k, v := range header {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, reqs
+}
+
+var batch = []plugin.Message{
+	{Topic: "a", Payload: []byte(`{"v": 1}`)},
+	{Topic: "b", Payload: []byte("not json")},
+}
+
+func TestJSONBatchWithBearer(t *testing.T) {
+	ts, reqs := newTestServer(t, http.StatusOK, nil)
+	s, err := New(Config{URL: ts.URL, Headers: map[string]string{"X-Site": "north"}, Auth: Auth{Type: "bearer", Token: "tok"}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := s.ProduceBatch(batch, time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	r := <-reqs
+	if r.body != `[{"v":1},"not json"]` {
+		t.Fatalf("unexpected body %s", r.body)
+	}
+	if r.header.Get("Authorization") != "Bearer tok" || r.header.Get("X-Site") != "north" {
+		t.Fatalf("missing headers: %v", r.header)
+	}
+	if r.header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected content type %q", r.header.Get("Content-Type"))
+	}
+}
+
+func TestNDJSONGzipWithHMAC(t *testing.T) {
+	var raw []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ = io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(raw)
+		if r.Header.Get("X-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		zr, err := gzip.NewReader(strings.NewReader(string(raw)))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := io.ReadAll(zr)
+		if string(b) != "{\"v\":1}\n\"not json\"\n" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	s, err := New(Config{URL: ts.URL, Format: "ndjson", Gzip: true, Auth: Auth{Type: "hmac", Secret: "secret"}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := s.ProduceBatch(batch, time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ts, reqs := newTestServer(t, http.StatusNoContent, nil)
+	s, err := New(Config{URL: ts.URL, Auth: Auth{Type: "basic", Username: "gw", Password: "pw"}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if err := s.Produce([]byte(`{}`), time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	r := <-reqs
+	req := &http.Request{Header: r.header}
+	if u, p, ok := req.BasicAuth(); !ok || u != "gw" || p != "pw" {
+		t.Fatalf("unexpected basic auth %q %q %v", u, p, ok)
+	}
+}
+
+func TestStatusClassification(t *testing.T) {
+	cases := []struct {
+		status    int
+		header    map[string]string
+		permanent bool
+		delay     time.Duration
+	}{
+		{http.StatusServiceUnavailable, map[string]string{"Retry-After": "7"}, false, 7 * time.Second},
+		{http.StatusTooManyRequests, map[string]string{"Retry-After": "2"}, false, 2 * time.Second},
+		{http.StatusBadGateway, nil, false, 0},
+		{http.StatusBadRequest, nil, true, 0},
+		{http.StatusUnprocessableEntity, nil, true, 0},
+		{http.StatusUnauthorized, nil, false, 0},
+		{http.StatusForbidden, nil, false, 0},
+		{http.StatusNotFound, nil, false, 0},
+		{http.StatusRequestTimeout, map[string]string{"Retry-After": "3"}, false, 3 * time.Second},
+	}
+	for _, c := range cases {
+		ts, _ := newTestServer(t, c.status, c.header)
+		s, err := New(Config{URL: ts.URL})
+		if err != nil {
+			t.Fatalf("new: %v", err)
+		}
+		err = s.ProduceBatch(batch, time.Second)
+		if err == nil {
+			t.Fatalf("status %d: expected error", c.status)
+		}
+		if plugin.IsPermanent(err) != c.permanent {
+			t.Fatalf("status %d: permanent = %v, want %v", c.status, plugin.IsPermanent(err), c.permanent)
+		}
+		d, ok := plugin.RetryDelay(err)
+		if ok != (c.delay > 0) || d != c.delay {
+			t.Fatalf("status %d: retry delay = %v %v, want %v", c.status, d, ok, c.delay)
+		}
+	}
+}
+
+func TestSplitsTooLargeBatch(t *testing.T) {
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if strings.Count(string(b), ",") >= 2 || strings.Contains(string(b), "huge") {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		bodies = append(bodies, string(b))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	s, err := New(Config{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	msgs := []plugin.Message{
+		{ID: 1, Payload: []byte("1")}, {ID: 2, Payload: []byte("2")},
+		{ID: 3, Payload: []byte("3")}, {ID: 4, Payload: []byte("4")},
+		{ID: 5, Payload: []byte("5")},
+	}
+	if err := s.ProduceBatch(msgs, time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	if got := strings.Join(bodies, " "); got != "[1,2] [3] [4,5]" {
+		t.Fatalf("unexpected requests %s", got)
+	}
+
+	// a message that is too large on its own is dropped, the rest delivered
+	bodies = nil
+	msgs = []plugin.Message{{ID: 1, Payload: []byte("1")}, {ID: 2, Payload: []byte(`"huge"`)}}
+	if err := s.ProduceBatch(msgs, time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	if got := strings.Join(bodies, " "); got != "[1]" {
+		t.Fatalf("unexpected requests %s", got)
+	}
+	err = s.ProduceBatch(msgs[1:], time.Second)
+	if !plugin.IsPermanent(err) || !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected a permanent too large error, got %v", err)
+	}
+}
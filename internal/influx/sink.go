@@ -0,0 +1,154 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/httpsink"
+	"github.com/your-username/iot-edge-gateway/internal/lineproto"
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// DefaultBatchSize is the number of readings written per request when no
+// batch size is configured.
+const DefaultBatchSize = 500
+
+// Config configures a Sink.
+type Config struct {
+	// URL is the server's base URL, e.g. http://localhost:8086.
+	URL       string
+	Org       string
+	Bucket    string
+	Token     string
+	Precision string
+	BatchSize int
+	Gzip      bool
+}
+
+// Sink writes readings to InfluxDB through the v2 write API using line
+// protocol. Points are identified by measurement, tags and timestamp, so a
+// batch that is written again after a lost acknowledgement overwrites the
+// same points instead of duplicating them. Readings without a timestamp use
+// the time they were buffered.
+type Sink struct {
+	cfg      Config
+	writeURL string
+	client   *http.Client
+}
+
+// New validates cfg and creates the sink.
+func New(cfg Config) (*Sink, error) {
+	if cfg.URL == "" || cfg.Org == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("url, org and bucket required")
+	}
+	switch cfg.Precision {
+	case "":
+		cfg.Precision = "ns"
+	case "ns", "us", "ms", "s":
+	default:
+		return nil, fmt.Errorf("unknown precision %q", cfg.Precision)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	q := url.Values{}
+	q.Set("org", cfg.Org)
+	q.Set("bucket", cfg.Bucket)
+	q.Set("precision", cfg.Precision)
+	return &Sink{
+		cfg:      cfg,
+		writeURL: strings.TrimRight(cfg.URL, "/") + "/api/v2/write?" + q.Encode(),
+		client:   &http.Client{},
+	}, nil
+}
+
+func (s *Sink) BatchSize() int {
+	return s.cfg.BatchSize
+}
+
+// Produce writes a single reading.
+func (s *Sink) Produce(payload []byte, timeout time.Duration) error {
+	return s.ProduceBatch([]plugin.Message{{Payload: payload, Time: time.Now()}}, timeout)
+}
+
+// ProduceBatch writes the readings in msgs in one request, or in smaller
+// ones if the server finds it too large. Messages that are not readings are
+// skipped; the batch fails permanently only when none of them can be
+// written. Like other HTTP outputs, only a 400 or 422 response drops the
+// batch, so a missing bucket or revoked token pauses delivery instead.
+func (s *Sink) ProduceBatch(msgs []plugin.Message, timeout time.Duration) error {
+	return httpsink.Split(msgs, func(part []plugin.Message) error { return s.write(part, timeout) })
+}
+
+// write posts the readings in msgs in one request.
+func (s *Sink) write(msgs []plugin.Message, timeout time.Duration) error {
+	var body []byte
+	var skipped int
+	var lastErr error
+	for _, m := range msgs {
+		r, err := reading.Parse(m.Payload)
+		if err != nil {
+			skipped++
+			lastErr = err
+			continue
+		}
+		if r.Timestamp.IsZero() {
+			r.Timestamp = m.Time
+		}
+		if body, err = lineproto.AppendInflux(body, r, s.cfg.Precision); err != nil {
+			skipped++
+			lastErr = err
+		}
+	}
+	if len(body) == 0 {
+		return plugin.Permanent(fmt.Errorf("no writable readings in batch: %v", lastErr))
+	}
+	if skipped > 0 {
+		fmt.Printf("influx: skipped %d message(s) that are not writable readings: %v\n", skipped, lastErr)
+	}
+
+	if s.cfg.Gzip {
+		var zb bytes.Buffer
+		zw := gzip.NewWriter(&zb)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = zb.Bytes()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return plugin.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	}
+	if s.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return httpsink.StatusError(http.MethodPost, s.cfg.URL, resp)
+}
+
+func (s *Sink) Close() {
+	s.client.CloseIdleConnections()
+}
@@ -0,0 +1,80 @@
+package influx
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+func TestWriteBatch(t *testing.T) {
+	var got *http.Request
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	s, err := New(Config{URL: ts.URL, Org: "plant", Bucket: "telemetry", Token: "tok", Precision: "s"})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	buffered := time.Unix(1700000100, 0)
+	err = s.ProduceBatch([]plugin.Message{
+		{Payload: []byte(`{"measurement":"temp","tags":{"device":"d 1"},"fields":{"value":21.5,"ok":true},"timestamp":"2023-11-14T22:13:20Z"}`)},
+		{Payload: []byte(`not a reading`)},
+		{Payload: []byte(`{"measurement":"hum","fields":{"value":40}}`), Time: buffered},
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	if got.URL.Path != "/api/v2/write" || got.URL.Query().Get("bucket") != "telemetry" || got.URL.Query().Get("precision") != "s" {
+		t.Fatalf("unexpected url %s", got.URL)
+	}
+	if got.Header.Get("Authorization") != "Token tok" {
+		t.Fatalf("unexpected auth %q", got.Header.Get("Authorization"))
+	}
+	want := "temp,device=d\\ 1 ok=true,value=21.5 1700000000\nhum value=40 1700000100\n"
+	if body != want {
+		t.Fatalf("body = %q, want %q", body, want)
+	}
+}
+
+func TestRejectedWriteIsPermanent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	s, err := New(Config{URL: ts.URL, Org: "o", Bucket: "b"})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	err = s.ProduceBatch([]plugin.Message{{Payload: []byte(`{"measurement":"m","fields":{"v":1}}`), Time: time.Now()}}, time.Second)
+	if !plugin.IsPermanent(err) {
+		t.Fatalf("expected permanent error, got %v", err)
+	}
+	if err := s.ProduceBatch([]plugin.Message{{Payload: []byte(`x`)}}, time.Second); !plugin.IsPermanent(err) {
+		t.Fatalf("expected permanent error for batch without readings, got %v", err)
+	}
+}
+
+func TestMissingBucketIsRetriable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	s, err := New(Config{URL: ts.URL, Org: "o", Bucket: "missing"})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	err = s.ProduceBatch([]plugin.Message{{Payload: []byte(`{"measurement":"m","fields":{"v":1}}`), Time: time.Now()}}, time.Second)
+	if err == nil || plugin.IsPermanent(err) {
+		t.Fatalf("expected retriable error, got %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// Compression codecs supported by the producer ("compression.type").
+var compressionTypes = map[string]bool{"none": true, "gzip": true, "snappy": true, "lz4": true, "zstd": true}
+
+// Envelope packs several buffered readings into one Kafka message to cut the
+// per-message overhead on metered links:
+//
+//	{"gateway_id":"gw-01","seq":12,"first_id":40,"last_id":42,"count":2,"readings":[{...},{...}]}
+//
+// Payloads that are JSON are embedded as they are, others as JSON strings.
+// seq numbers the envelopes delivered to a destination topic from 1 without
+// gaps, so consumers of a topic can detect a missing envelope. An envelope
+// sent again after a failed delivery keeps its seq, and may carry more
+// readings. first_id and last_id are the buffer ids of the first and last
+// reading; buffer ids are never reused, so consumers can drop readings they
+// have already seen.
+type Envelope struct {
+	GatewayID string
+	// Size is the maximum number of readings per envelope.
+	Size int
+	// SeqFile keeps the sequence numbers across restarts. Without it they
+	// start over at 1 in every process.
+	SeqFile string
+}
+
+// sequence counts the envelopes delivered per destination topic.
+type sequence struct {
+	path string
+	sent map[string]uint64
+}
+
+// loadSequence reads the counts saved at path, if any.
+func loadSequence(path string) (*sequence, error) {
+	s := &sequence{path: path, sent: make(map[string]uint64)}
+	if path == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.sent); err != nil {
+		return nil, fmt.Errorf("envelope sequence %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// next returns the seq of the next envelope for dest.
+func (s *sequence) next(dest string) uint64 {
+	return s.sent[dest] + 1
+}
+
+// delivered counts an envelope for each of dests and saves the counts.
+func (s *sequence) delivered(dests []string) error {
+	for _, d := range dests {
+		s.sent[d]++
+	}
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(s.sent)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// encodeEnvelope returns envelope seq for msgs.
+func encodeEnvelope(gatewayID string, seq uint64, msgs []plugin.Message) ([]byte, error) {
+	id, err := json.Marshal(gatewayID)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `{"gateway_id":%s,"seq":%d,"first_id":%d,"last_id":%d,"count":%d,"readings":[`,
+		id, seq, msgs[0].ID, msgs[len(msgs)-1].ID, len(msgs))
+	for i, m := range msgs {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		p := m.Payload
+		if json.Valid(p) {
+			if err := json.Compact(&b, p); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		s, err := json.Marshal(string(p))
+		if err != nil {
+			return nil, err
+		}
+		b.Write(s)
+	}
+	b.WriteString("]}")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+func TestEncodeEnvelope(t *testing.T) {
+	b, err := encodeEnvelope("gw-01", 3, []plugin.Message{
+		{ID: 7, Payload: []byte(`{"measurement": "temp", "fields": {"v": 1}}`)},
+		{ID: 9, Payload: []byte("raw line")},
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	want := `{"gateway_id":"gw-01","seq":3,"first_id":7,"last_id":9,"count":2,"readings":[{"measurement":"temp","fields":{"v":1}},"raw line"]}`
+	if string(b) != want {
+		t.Fatalf("got %s\nwant %s", b, want)
+	}
+	var env struct {
+		Count    int               `json:"count"`
+		Readings []json.RawMessage `json:"readings"`
+	}
+	if err := json.Unmarshal(b, &env); err != nil || env.Count != len(env.Readings) {
+		t.Fatalf("envelope does not decode: %v", err)
+	}
+}
+
+func TestSequenceSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "kafka.seq")
+	seq, err := loadSequence(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if n := seq.next("a"); n != 1 {
+		t.Fatalf("first seq = %d, want 1", n)
+	}
+	if err := seq.delivered([]string{"a", "b"}); err != nil {
+		t.Fatalf("delivered: %v", err)
+	}
+	if err := seq.delivered([]string{"a"}); err != nil {
+		t.Fatalf("delivered: %v", err)
+	}
+	// a failed delivery is not counted, so the resend keeps its number
+	if n := seq.next("a"); n != 3 {
+		t.Fatalf("next seq for a = %d, want 3", n)
+	}
+
+	seq, err = loadSequence(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if a, b := seq.next("a"), seq.next("b"); a != 3 || b != 2 {
+		t.Fatalf("after restart next seq = %d, %d, want 3, 2", a, b)
+	}
+}
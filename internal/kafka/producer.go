@@ -1,36 +1,61 @@
 package kafka
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
 	confluent "github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
 )
 
-// ProducerClient is the minimal interface used by the forwarder to send messages.
-// This allows providing a mock implementation for tests.
-type ProducerClient interface {
-	Produce([]byte, time.Duration) error
-	Close()
-}
+// DefaultBatchSize is the number of messages handed to the client per
+// delivery, so they share compressed batches on the wire.
+const DefaultBatchSize = 100
+
+// statsInterval is how often the client reports the bytes it sent.
+const statsInterval = 15 * time.Second
+
+// ProducerClient is the contract the forwarder uses to deliver messages.
+// It is the generic plugin.Sink; the name is kept for existing callers.
+type ProducerClient = plugin.Sink
 
 type Producer struct {
-	p     *confluent.Producer
-	topic string
-	wg    sync.WaitGroup
-	closed bool
+	p        *confluent.Producer
+	topic    string
+	router   *Router
+	envelope *Envelope
+	// seq numbers envelopes; envMu serializes envelope sends so the
+	// numbers stay contiguous
+	seq      *sequence
+	envMu    sync.Mutex
+	txBytes  int64
+	wg       sync.WaitGroup
+	closed   bool
 }
 
 // NewProducer creates a confluent Kafka producer.
 // brokers: comma-separated broker list, topic is target topic, clientID optional.
-func NewProducer(brokers string, topic string, clientID string) (*Producer, error) {
+// compression is the codec for message batches: none (default), gzip, snappy,
+// lz4 or zstd.
+func NewProducer(brokers string, topic string, clientID string, compression string) (*Producer, error) {
 	if brokers == "" {
 		return nil, fmt.Errorf("brokers required")
 	}
+	if compression == "" {
+		compression = "none"
+	}
+	if !compressionTypes[compression] {
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
 	cfg := &confluent.ConfigMap{
 		"bootstrap.servers": brokers,
 		"acks": "all",
+		"compression.type": compression,
+		"statistics.interval.ms": int(statsInterval / time.Millisecond),
 	}
 	if clientID != "" {
 		_ = cfg.SetKey("client.id", clientID)
@@ -61,45 +86,178 @@ func (pr *Producer) deliveryHandler() {
 			} else {
 				fmt.Printf("Delivered message to %v\n", ev.TopicPartition)
 			}
+		case *confluent.Stats:
+			pr.recordStats(ev.String())
 		default:
 			// ignore other events
 		}
 	}
 }
 
-// Produce sends a message and waits up to timeout for delivery report.
-// Returns nil on success.
+// SetRoutes routes messages to topics by content; messages no route takes go
+// to the producer's topic. Routes must be set before the producer is used.
+func (pr *Producer) SetRoutes(routes []Route) error {
+	r, err := NewRouter(routes, pr.topic)
+	if err != nil {
+		return err
+	}
+	pr.router = r
+	return nil
+}
+
+// recordStats adds the bytes the client sent to brokers since the last report
+// to the sent bytes metric.
+func (pr *Producer) recordStats(stats string) {
+	var st struct {
+		TxBytes int64 `json:"tx_bytes"`
+	}
+	if err := json.Unmarshal([]byte(stats), &st); err != nil {
+		return
+	}
+	if d := st.TxBytes - pr.txBytes; d > 0 {
+		metrics.KafkaSentBytes.Add(float64(d))
+	}
+	pr.txBytes = st.TxBytes
+}
+
+// SetEnvelope packs up to env.Size messages for the same topic into one
+// envelope (see Envelope). An empty GatewayID defaults to the host name. The
+// envelope must be set before the producer is used; envelopes are sent one
+// batch at a time.
+func (pr *Producer) SetEnvelope(env Envelope) error {
+	if env.Size <= 0 {
+		return fmt.Errorf("envelope size must be positive")
+	}
+	if env.GatewayID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("gateway id required: %w", err)
+		}
+		env.GatewayID = host
+	}
+	seq, err := loadSequence(env.SeqFile)
+	if err != nil {
+		return err
+	}
+	pr.envelope, pr.seq = &env, seq
+	return nil
+}
+
+// BatchSize is the envelope size when messages are enveloped.
+func (pr *Producer) BatchSize() int {
+	if pr.envelope != nil {
+		return pr.envelope.Size
+	}
+	return DefaultBatchSize
+}
+
+// ProduceBatch sends msgs and waits up to timeout for all delivery reports.
+// It fails if any message was not delivered; the batch is then sent again as
+// a whole. With an envelope set, the messages for each destination topic are
+// sent as one envelope.
+func (pr *Producer) ProduceBatch(msgs []plugin.Message, timeout time.Duration) error {
+	if pr.envelope == nil {
+		out := make([]*confluent.Message, len(msgs))
+		for i, m := range msgs {
+			out[i] = pr.message(pr.resolve(m.Topic, m.Payload), m.Payload)
+		}
+		return pr.send(out, timeout)
+	}
+
+	pr.envMu.Lock()
+	defer pr.envMu.Unlock()
+	// one envelope per destination, in order of first appearance
+	var dests []string
+	groups := make(map[string][]plugin.Message)
+	for _, m := range msgs {
+		dest := pr.resolve(m.Topic, m.Payload)
+		if _, ok := groups[dest]; !ok {
+			dests = append(dests, dest)
+		}
+		groups[dest] = append(groups[dest], m)
+	}
+	out := make([]*confluent.Message, len(dests))
+	for i, dest := range dests {
+		b, err := encodeEnvelope(pr.envelope.GatewayID, pr.seq.next(dest), groups[dest])
+		if err != nil {
+			return plugin.Permanent(err)
+		}
+		out[i] = pr.message(dest, b)
+	}
+	if err := pr.send(out, timeout); err != nil {
+		// the batch is sent again with the same numbers
+		return err
+	}
+	if err := pr.seq.delivered(dests); err != nil {
+		fmt.Printf("kafka: saving envelope sequence: %v\n", err)
+	}
+	return nil
+}
+
+// Produce sends a message to the producer's topic and waits up to timeout for
+// delivery report. Returns nil on success.
 func (pr *Producer) Produce(payload []byte, timeout time.Duration) error {
+	return pr.ProduceTopic("", payload, timeout)
+}
+
+// ProduceTopic is like Produce for a message submitted under topic; the
+// destination is chosen by the routes set with SetRoutes.
+func (pr *Producer) ProduceTopic(topic string, payload []byte, timeout time.Duration) error {
+	return pr.ProduceBatch([]plugin.Message{{Topic: topic, Payload: payload}}, timeout)
+}
+
+func (pr *Producer) resolve(topic string, payload []byte) string {
+	if pr.router != nil {
+		return pr.router.Resolve(topic, payload)
+	}
+	return pr.topic
+}
+
+func (pr *Producer) message(dest string, value []byte) *confluent.Message {
+	return &confluent.Message{
+		TopicPartition: confluent.TopicPartition{Topic: &dest, Partition: confluent.PartitionAny},
+		Value: value,
+	}
+}
+
+// send produces msgs and waits for their delivery reports.
+func (pr *Producer) send(msgs []*confluent.Message, timeout time.Duration) error {
 	if pr == nil || pr.p == nil {
 		return fmt.Errorf("producer not initialized")
 	}
 	if pr.closed {
 		return fmt.Errorf("producer closed")
 	}
-	msg := &confluent.Message{
-		TopicPartition: confluent.TopicPartition{Topic: &pr.topic, Partition: confluent.PartitionAny},
-		Value: payload,
-	}
-	// Produce with delivery channel
-	deliveryChan := make(chan confluent.Event, 1)
-	err := pr.p.Produce(msg, deliveryChan)
-	if err != nil {
-		close(deliveryChan)
-		return err
-	}
-	select {
-	case ev := <-deliveryChan:
-		m, ok := ev.(*confluent.Message)
-		if !ok {
-			return fmt.Errorf("unexpected delivery event type")
+	// Produce with delivery channel, buffered so late reports never block
+	deliveryChan := make(chan confluent.Event, len(msgs))
+	for _, msg := range msgs {
+		if err := pr.p.Produce(msg, deliveryChan); err != nil {
+			return err
 		}
-		if m.TopicPartition.Error != nil {
-			return m.TopicPartition.Error
+		metrics.KafkaPayloadBytes.Add(float64(len(msg.Value)))
+	}
+	return pr.wait(deliveryChan, len(msgs), timeout)
+}
+
+// wait returns the first delivery error among n reports on ch.
+func (pr *Producer) wait(ch chan confluent.Event, n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	var firstErr error
+	for i := 0; i < n; i++ {
+		select {
+		case ev := <-ch:
+			m, ok := ev.(*confluent.Message)
+			if !ok {
+				return fmt.Errorf("unexpected delivery event type")
+			}
+			if m.TopicPartition.Error != nil && firstErr == nil {
+				firstErr = m.TopicPartition.Error
+			}
+		case <-deadline:
+			return fmt.Errorf("delivery timeout")
 		}
-		return nil
-	case <-time.After(timeout):
-		return fmt.Errorf("delivery timeout")
 	}
+	return firstErr
 }
 
 // Close flushes and closes the producer.
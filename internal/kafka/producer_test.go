@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+)
+
+func TestNewProducerCompression(t *testing.T) {
+	for _, tc := range []struct {
+		compression string
+		ok          bool
+	}{
+		{"", true},
+		{"none", true},
+		{"gzip", true},
+		{"snappy", true},
+		{"lz4", true},
+		{"zstd", true},
+		{"brotli", false},
+		{"GZIP", false},
+	} {
+		p, err := NewProducer("localhost:9092", "t", "", tc.compression)
+		if (err == nil) != tc.ok {
+			t.Fatalf("compression %q: err = %v, want ok=%v", tc.compression, err, tc.ok)
+		}
+		if p != nil {
+			p.Close()
+		}
+	}
+}
+
+func TestRecordStatsAddsSentBytes(t *testing.T) {
+	pr := &Producer{}
+	before := testutil.ToFloat64(metrics.KafkaSentBytes)
+	for _, stats := range []string{
+		`{"tx_bytes":100}`,
+		`{"tx_bytes":250}`,
+		`{"tx_bytes":250}`,
+		`not json`,
+	} {
+		pr.recordStats(stats)
+	}
+	if d := testutil.ToFloat64(metrics.KafkaSentBytes) - before; d != 250 {
+		t.Fatalf("sent bytes grew by %v, want 250", d)
+	}
+}
@@ -0,0 +1,132 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/your-username/iot-edge-gateway/internal/topic"
+)
+
+// Route selects the destination topic for the messages it matches. The
+// conditions that are set must all hold:
+//   - Match is an MQTT-style filter ("+" and "#" wildcards) on the topic the
+//     message was submitted under;
+//   - Field is a dot-separated path into the JSON payload. The value found
+//     there must equal Value, or only exist when Value is empty.
+//
+// A route without conditions matches every message.
+type Route struct {
+	Match string
+	Field string
+	Value string
+	// Topic is the destination and may contain placeholders: {topic} is the
+	// source topic, {topic:N} its N-th level (from 0) and any other {path} is
+	// looked up in the payload like Field. A bare name that is not a top-level
+	// field is also looked up in "tags", so {site} finds tags.site of a
+	// reading. Substituted values are reduced to characters valid in Kafka
+	// topic names.
+	Topic string
+}
+
+// Router picks a topic per message from an ordered list of routes. The first
+// route that matches and whose placeholders all resolve wins; messages no
+// route takes go to the default topic.
+type Router struct {
+	routes []Route
+	def    string
+}
+
+// NewRouter validates routes. defaultTopic must be a plain topic name.
+func NewRouter(routes []Route, defaultTopic string) (*Router, error) {
+	if defaultTopic == "" || strings.ContainsAny(defaultTopic, "{}") {
+		return nil, fmt.Errorf("default topic %q must be a plain topic name", defaultTopic)
+	}
+	for i, r := range routes {
+		if r.Topic == "" {
+			return nil, fmt.Errorf("route %d: topic required", i)
+		}
+		if strings.Count(r.Topic, "{") != strings.Count(r.Topic, "}") {
+			return nil, fmt.Errorf("route %d: unbalanced braces in %q", i, r.Topic)
+		}
+	}
+	return &Router{routes: routes, def: defaultTopic}, nil
+}
+
+// Resolve returns the destination topic for a message submitted under src.
+func (r *Router) Resolve(src string, payload []byte) string {
+	if r == nil {
+		return ""
+	}
+	var doc map[string]interface{}
+	parsed := false
+	for _, rt := range r.routes {
+		if rt.Match != "" && !topic.Match(rt.Match, src) {
+			continue
+		}
+		needsDoc := rt.Field != "" || strings.Contains(rt.Topic, "{")
+		if needsDoc && !parsed {
+			parsed = true
+			_ = json.Unmarshal(payload, &doc)
+		}
+		if rt.Field != "" {
+			v, ok := lookup(doc, rt.Field)
+			if !ok || (rt.Value != "" && v != rt.Value) {
+				continue
+			}
+		}
+		if dest, ok := topic.Expand(rt.Topic, src, field(doc), sanitize); ok {
+			return dest
+		}
+	}
+	return r.def
+}
+
+// field returns a lookup of placeholders in doc. A bare name that is not a
+// top-level field is also looked up in "tags".
+func field(doc map[string]interface{}) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := lookup(doc, name)
+		if !ok && !strings.Contains(name, ".") {
+			v, ok = lookup(doc, "tags."+name)
+		}
+		return v, ok
+	}
+}
+
+// lookup returns the scalar at a dot-separated path as a string.
+func lookup(doc map[string]interface{}, path string) (string, bool) {
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if cur, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// sanitize replaces characters that are not allowed in Kafka topic names.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,41 @@
+package kafka
+
+import "testing"
+
+func TestRouterResolve(t *testing.T) {
+	r, err := NewRouter([]Route{
+		{Match: "sensors/+/alarm", Topic: "iot-alarms"},
+		{Field: "type", Value: "aggregate", Topic: "iot-aggregates"},
+		{Match: "diag/#", Topic: "iot-raw"},
+		{Field: "tags.site", Topic: "iot-{site}-{measurement}"},
+		{Match: "plants/#", Topic: "iot-{topic:1}"},
+	}, "iot-sensor-data")
+	if err != nil {
+		t.Fatalf("new router: %v", err)
+	}
+
+	cases := []struct {
+		topic, payload, want string
+	}{
+		{"sensors/boiler/alarm", `{"level":3}`, "iot-alarms"},
+		{"sensors/boiler/data", `{"type":"aggregate"}`, "iot-aggregates"},
+		{"diag/modem/rssi", `not json`, "iot-raw"},
+		{"sensors/boiler/data", `{"measurement":"temp","tags":{"site":"north yard"}}`, "iot-north_yard-temp"},
+		// placeholder missing: route skipped
+		{"sensors/boiler/data", `{"tags":{"site":"north"}}`, "iot-sensor-data"},
+		{"plants/p7/line1", `{}`, "iot-p7"},
+		{"other", `{"type":"raw"}`, "iot-sensor-data"},
+	}
+	for _, c := range cases {
+		if got := r.Resolve(c.topic, []byte(c.payload)); got != c.want {
+			t.Fatalf("Resolve(%q, %s) = %q, want %q", c.topic, c.payload, got, c.want)
+		}
+	}
+
+	if _, err := NewRouter(nil, "iot-{site}"); err == nil {
+		t.Fatalf("expected error for templated default topic")
+	}
+	if _, err := NewRouter([]Route{{Topic: "iot-{site"}}, "x"); err == nil {
+		t.Fatalf("expected error for unbalanced template")
+	}
+}
@@ -0,0 +1,118 @@
+// Package keyring provides the keys used to encrypt data at rest. Keys are
+// identified by an id that is stored with the data, so data encrypted with an
+// older key stays readable after a new key is added.
+package keyring
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keyring holds the current encryption key and older keys that are only used
+// for decryption. Implementations must be safe for concurrent use.
+type Keyring interface {
+	// Current returns the id of the key new data is encrypted with.
+	Current() string
+	// Key returns the key with the given id.
+	Key(id string) ([]byte, bool)
+}
+
+// DefaultID is the id of a key given without one.
+const DefaultID = "default"
+
+// Static is a fixed set of keys.
+type Static struct {
+	current string
+	keys    map[string][]byte
+}
+
+// Current implements Keyring.
+func (s *Static) Current() string {
+	return s.current
+}
+
+// Key implements Keyring.
+func (s *Static) Key(id string) ([]byte, bool) {
+	k, ok := s.keys[id]
+	return k, ok
+}
+
+// Parse reads keys from text with one "id:base64-key" entry per line or
+// comma-separated entry; blank lines and lines starting with "#" are ignored.
+// A key without an id gets DefaultID. Keys are 16, 24 or 32 bytes (AES-128,
+// AES-192 or AES-256). The last entry is the current key, so a key is rotated
+// by appending a new one; older keys should stay until the data they
+// encrypted is gone.
+func Parse(text string) (*Static, error) {
+	s := &Static{keys: make(map[string][]byte)}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, entry := range strings.Split(line, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			id, enc := DefaultID, entry
+			if i := strings.IndexByte(entry, ':'); i >= 0 {
+				id, enc = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			}
+			if id == "" {
+				return nil, fmt.Errorf("empty key id")
+			}
+			if _, dup := s.keys[id]; dup {
+				return nil, fmt.Errorf("duplicate key id %q", id)
+			}
+			key, err := base64.StdEncoding.DecodeString(enc)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", id, err)
+			}
+			switch len(key) {
+			case 16, 24, 32:
+			default:
+				return nil, fmt.Errorf("key %q: length %d, want 16, 24 or 32 bytes", id, len(key))
+			}
+			s.keys[id] = key
+			s.current = id
+		}
+	}
+	if s.current == "" {
+		return nil, fmt.Errorf("no keys")
+	}
+	return s, nil
+}
+
+// FromFile reads keys in the format of Parse from path. A file readable by
+// other users is reported, as the keys protect data on the same disk.
+func FromFile(path string) (*Static, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode().Perm()&0o077 != 0 {
+		fmt.Printf("keyring: %s is accessible by other users (mode %v)\n", path, fi.Mode().Perm())
+	}
+	s, err := Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// FromEnv reads keys in the format of Parse from the environment variable
+// name.
+func FromEnv(name string) (*Static, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+	s, err := Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return s, nil
+}
@@ -0,0 +1,34 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	k1 := bytes.Repeat([]byte{1}, 32)
+	k2 := bytes.Repeat([]byte{2}, 16)
+	text := "# buffer keys\n" + base64.StdEncoding.EncodeToString(k1) + "\n\n2024-06:" + base64.StdEncoding.EncodeToString(k2) + "\n"
+	kr, err := Parse(text)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if kr.Current() != "2024-06" {
+		t.Fatalf("current = %q, want the last key", kr.Current())
+	}
+	if k, ok := kr.Key(DefaultID); !ok || !bytes.Equal(k, k1) {
+		t.Fatalf("default key not found")
+	}
+
+	// comma-separated, as in an environment variable
+	if kr, err := Parse("a:" + base64.StdEncoding.EncodeToString(k1) + ",b:" + base64.StdEncoding.EncodeToString(k1)); err != nil || kr.Current() != "b" {
+		t.Fatalf("parse list: %v", err)
+	}
+
+	for _, bad := range []string{"", "# nothing", "a:" + base64.StdEncoding.EncodeToString([]byte("short")), "a:!!", "a:" + base64.StdEncoding.EncodeToString(k1) + ",a:" + base64.StdEncoding.EncodeToString(k2)} {
+		if _, err := Parse(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
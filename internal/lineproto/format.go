@@ -0,0 +1,106 @@
+package lineproto
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// AppendInflux appends r as one line of InfluxDB line protocol, terminated by
+// a newline, with the timestamp in the given precision ("ns", "us", "ms" or
+// "s"). Tags and fields are written in key order. Fields whose values have no
+// line protocol type (null, objects, arrays) are skipped; a reading left
+// without fields is an error.
+func AppendInflux(dst []byte, r reading.Reading, precision string) ([]byte, error) {
+	if r.Measurement == "" {
+		return dst, fmt.Errorf("missing measurement")
+	}
+	unit, err := precisionUnit(precision)
+	if err != nil {
+		return dst, err
+	}
+	var fields []string
+	for k, v := range r.Fields {
+		if formatField(v) != "" {
+			fields = append(fields, k)
+		}
+	}
+	if len(fields) == 0 {
+		return dst, fmt.Errorf("reading %q has no writable fields", r.Measurement)
+	}
+	sort.Strings(fields)
+	tags := make([]string, 0, len(r.Tags))
+	for k, v := range r.Tags {
+		if k != "" && v != "" {
+			tags = append(tags, k)
+		}
+	}
+	sort.Strings(tags)
+
+	dst = append(dst, measurementEscaper.Replace(r.Measurement)...)
+	for _, k := range tags {
+		dst = append(dst, ',')
+		dst = append(dst, keyEscaper.Replace(k)...)
+		dst = append(dst, '=')
+		dst = append(dst, keyEscaper.Replace(r.Tags[k])...)
+	}
+	for i, k := range fields {
+		if i == 0 {
+			dst = append(dst, ' ')
+		} else {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, keyEscaper.Replace(k)...)
+		dst = append(dst, '=')
+		dst = append(dst, formatField(r.Fields[k])...)
+	}
+	if !r.Timestamp.IsZero() {
+		dst = append(dst, ' ')
+		dst = strconv.AppendInt(dst, r.Timestamp.UnixNano()/int64(unit), 10)
+	}
+	return append(dst, '\n'), nil
+}
+
+func formatField(v interface{}) string {
+	switch x := v.(type) {
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case int:
+		return strconv.Itoa(x) + "i"
+	case int64:
+		return strconv.FormatInt(x, 10) + "i"
+	case bool:
+		return strconv.FormatBool(x)
+	case string:
+		return `"` + stringEscaper.Replace(x) + `"`
+	default:
+		return ""
+	}
+}
+
+func precisionUnit(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	default:
+		return 0, fmt.Errorf("unknown precision %q", precision)
+	}
+}
@@ -0,0 +1,214 @@
+package lineproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// maxLineBytes bounds a single line on TCP connections.
+const maxLineBytes = 64 * 1024
+
+// Listener accepts InfluxDB line protocol or Graphite plaintext over TCP or
+// UDP, converts each line into a reading and submits it to the pipeline under
+// the topic "<prefix>/<measurement>".
+type Listener struct {
+	format    string
+	transport string
+	addr      string
+	prefix    string
+	precision string
+	in        plugin.Ingester
+
+	mu    sync.Mutex
+	ln    net.Listener
+	pc    net.PacketConn
+	conns map[net.Conn]struct{}
+	// closed is set by Close; connections accepted after it are closed at once.
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// New creates a listener. format is "influx" or "graphite", transport is
+// "tcp" or "udp". precision applies to influx timestamps only. An empty
+// topicPrefix defaults to the format name.
+func New(format, transport, addr, topicPrefix, precision string, in plugin.Ingester) (*Listener, error) {
+	if format != FormatInflux && format != FormatGraphite {
+		return nil, fmt.Errorf("unknown line protocol format %q", format)
+	}
+	if transport == "" {
+		transport = "tcp"
+	}
+	if transport != "tcp" && transport != "udp" {
+		return nil, fmt.Errorf("unknown transport %q", transport)
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("addr required")
+	}
+	if _, err := fromPrecision(0, precision); err != nil {
+		return nil, err
+	}
+	if topicPrefix == "" {
+		topicPrefix = format
+	}
+	return &Listener{
+		format:    format,
+		transport: transport,
+		addr:      addr,
+		prefix:    strings.TrimSuffix(topicPrefix, "/"),
+		precision: precision,
+		in:        in,
+		conns:     make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Start binds the socket and serves in the background.
+func (l *Listener) Start() error {
+	if l.transport == "udp" {
+		pc, err := net.ListenPacket("udp", l.addr)
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		l.pc = pc
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go l.serveUDP(pc)
+		return nil
+	}
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.ln = ln
+	l.mu.Unlock()
+	l.wg.Add(1)
+	go l.serveTCP(ln)
+	return nil
+}
+
+// Addr returns the bound address once started.
+func (l *Listener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ln != nil {
+		return l.ln.Addr()
+	}
+	if l.pc != nil {
+		return l.pc.LocalAddr()
+	}
+	return nil
+}
+
+// Close stops the listener and closes open connections.
+func (l *Listener) Close() {
+	l.mu.Lock()
+	l.closed = true
+	if l.ln != nil {
+		_ = l.ln.Close()
+	}
+	if l.pc != nil {
+		_ = l.pc.Close()
+	}
+	for c := range l.conns {
+		_ = c.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+}
+
+func (l *Listener) serveTCP(ln net.Listener) {
+	defer l.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("lineproto: accept error: %v\n", err)
+			}
+			return
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go l.handleConn(conn)
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		conn.Close()
+	}()
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 0, 4096), maxLineBytes)
+	for sc.Scan() {
+		l.handleLine(sc.Text())
+	}
+	if err := sc.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		metrics.LineParseErrors.WithLabelValues(l.format).Inc()
+		fmt.Printf("lineproto: connection from %s: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+func (l *Listener) serveUDP(pc net.PacketConn) {
+	defer l.wg.Done()
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("lineproto: read error: %v\n", err)
+			continue
+		}
+		for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+			l.handleLine(string(line))
+		}
+	}
+}
+
+func (l *Listener) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+	var r reading.Reading
+	var err error
+	if l.format == FormatInflux {
+		r, err = ParseInflux(line, l.precision, time.Now())
+	} else {
+		r, err = ParseGraphite(line, time.Now())
+	}
+	if err != nil {
+		metrics.LineParseErrors.WithLabelValues(l.format).Inc()
+		return
+	}
+	payload, err := r.Marshal()
+	if err != nil {
+		metrics.LineParseErrors.WithLabelValues(l.format).Inc()
+		return
+	}
+	if err := l.in.Submit(l.prefix+"/"+r.Measurement, payload); err != nil {
+		fmt.Printf("lineproto: submit failed: %v\n", err)
+	}
+}
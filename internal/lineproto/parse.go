@@ -0,0 +1,225 @@
+package lineproto
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+)
+
+// Supported formats.
+const (
+	FormatInflux   = "influx"
+	FormatGraphite = "graphite"
+)
+
+// ParseInflux parses one line of InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// precision is the unit of the timestamp ("ns", "us", "ms" or "s"). Lines
+// without a timestamp get now.
+func ParseInflux(line string, precision string, now time.Time) (reading.Reading, error) {
+	key, rest, err := splitUnescaped(line, ' ', false)
+	if err != nil {
+		return reading.Reading{}, err
+	}
+	fieldsPart, tsPart, err := splitUnescaped(rest, ' ', true)
+	if err != nil {
+		return reading.Reading{}, err
+	}
+	if fieldsPart == "" {
+		return reading.Reading{}, fmt.Errorf("missing fields")
+	}
+
+	keyParts, err := splitAll(key, ',', false)
+	if err != nil {
+		return reading.Reading{}, err
+	}
+	r := reading.Reading{
+		Measurement: unescape(keyParts[0]),
+		Fields:      make(map[string]interface{}),
+		Timestamp:   now.UTC(),
+	}
+	if r.Measurement == "" {
+		return reading.Reading{}, fmt.Errorf("missing measurement")
+	}
+	for _, kv := range keyParts[1:] {
+		k, v, err := splitUnescaped(kv, '=', false)
+		if err != nil || k == "" || v == "" {
+			return reading.Reading{}, fmt.Errorf("invalid tag %q", kv)
+		}
+		if r.Tags == nil {
+			r.Tags = make(map[string]string)
+		}
+		r.Tags[unescape(k)] = unescape(v)
+	}
+
+	fields, err := splitAll(fieldsPart, ',', true)
+	if err != nil {
+		return reading.Reading{}, err
+	}
+	for _, kv := range fields {
+		k, v, err := splitUnescaped(kv, '=', true)
+		if err != nil || k == "" || v == "" {
+			return reading.Reading{}, fmt.Errorf("invalid field %q", kv)
+		}
+		val, err := parseFieldValue(v)
+		if err != nil {
+			return reading.Reading{}, fmt.Errorf("field %s: %w", k, err)
+		}
+		r.Fields[unescape(k)] = val
+	}
+
+	if tsPart = strings.TrimSpace(tsPart); tsPart != "" {
+		n, err := strconv.ParseInt(tsPart, 10, 64)
+		if err != nil {
+			return reading.Reading{}, fmt.Errorf("invalid timestamp %q", tsPart)
+		}
+		ts, err := fromPrecision(n, precision)
+		if err != nil {
+			return reading.Reading{}, err
+		}
+		r.Timestamp = ts
+	}
+	return r, nil
+}
+
+// ParseGraphite parses one line of Graphite plaintext protocol, with optional
+// tags:
+//
+//	metric.path[;tag=value...] value [timestamp]
+//
+// The value is stored in the field "value" and the timestamp is in seconds.
+func ParseGraphite(line string, now time.Time) (reading.Reading, error) {
+	parts := strings.Fields(line)
+	if len(parts) < 2 || len(parts) > 3 {
+		return reading.Reading{}, fmt.Errorf("expected \"metric value [timestamp]\"")
+	}
+	nameParts := strings.Split(parts[0], ";")
+	r := reading.Reading{
+		Measurement: nameParts[0],
+		Timestamp:   now.UTC(),
+	}
+	if r.Measurement == "" {
+		return reading.Reading{}, fmt.Errorf("missing metric name")
+	}
+	for _, kv := range nameParts[1:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" || v == "" {
+			return reading.Reading{}, fmt.Errorf("invalid tag %q", kv)
+		}
+		if r.Tags == nil {
+			r.Tags = make(map[string]string)
+		}
+		r.Tags[k] = v
+	}
+	v, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return reading.Reading{}, fmt.Errorf("invalid value %q", parts[1])
+	}
+	r.Fields = map[string]interface{}{"value": v}
+	if len(parts) == 3 && parts[2] != "-1" {
+		ts, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return reading.Reading{}, fmt.Errorf("invalid timestamp %q", parts[2])
+		}
+		r.Timestamp = time.Unix(0, int64(ts*1e9)).UTC()
+	}
+	return r, nil
+}
+
+func parseFieldValue(v string) (interface{}, error) {
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	if v[0] == '"' {
+		if len(v) < 2 || v[len(v)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		s := v[1 : len(v)-1]
+		s = strings.ReplaceAll(s, `\"`, `"`)
+		return strings.ReplaceAll(s, `\\`, `\`), nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		return strconv.ParseInt(v[:len(v)-1], 10, 64)
+	case 'u':
+		return strconv.ParseUint(v[:len(v)-1], 10, 64)
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+func fromPrecision(n int64, precision string) (time.Time, error) {
+	switch precision {
+	case "", "ns":
+		return time.Unix(0, n).UTC(), nil
+	case "us":
+		return time.UnixMicro(n).UTC(), nil
+	case "ms":
+		return time.UnixMilli(n).UTC(), nil
+	case "s":
+		return time.Unix(n, 0).UTC(), nil
+	default:
+		return time.Time{}, fmt.Errorf("unknown precision %q", precision)
+	}
+}
+
+// splitUnescaped splits s at the first sep that is not escaped with a
+// backslash and, if quotes is set, not inside a double-quoted string.
+func splitUnescaped(s string, sep byte, quotes bool) (string, string, error) {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case quotes && c == '"':
+			inQuote = !inQuote
+		case c == sep && !inQuote:
+			return s[:i], s[i+1:], nil
+		}
+	}
+	if inQuote {
+		return "", "", fmt.Errorf("unterminated string")
+	}
+	return s, "", nil
+}
+
+func splitAll(s string, sep byte, quotes bool) ([]string, error) {
+	var out []string
+	for {
+		head, tail, err := splitUnescaped(s, sep, quotes)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, head)
+		if len(head) == len(s) {
+			return out, nil
+		}
+		s = tail
+	}
+}
+
+// unescape removes line protocol backslash escapes from keys, tag values and
+// measurement names.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', '=', ' ', '\\':
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package lineproto
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+	"github.com/your-username/iot-edge-gateway/internal/pipeline"
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+)
+
+func TestParseInflux(t *testing.T) {
+	now := time.Unix(10, 0)
+	r, err := ParseInflux(`cpu\ load,host=edge\,1,region=eu usage=0.5,count=3i,ok=t,msg="a \"b\", c" 1700000000000000000`, "ns", now)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r.Measurement != "cpu load" || r.Tags["host"] != "edge,1" || r.Tags["region"] != "eu" {
+		t.Fatalf("unexpected key: %+v", r)
+	}
+	if r.Fields["usage"] != 0.5 || r.Fields["count"] != int64(3) || r.Fields["ok"] != true || r.Fields["msg"] != `a "b", c` {
+		t.Fatalf("unexpected fields: %+v", r.Fields)
+	}
+	if !r.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected timestamp: %v", r.Timestamp)
+	}
+
+	r, err = ParseInflux("temp value=21.5 1700000000", "s", now)
+	if err != nil || !r.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("precision s: %v %v", r.Timestamp, err)
+	}
+	r, err = ParseInflux("temp value=1u", "", now)
+	if err != nil || r.Fields["value"] != uint64(1) || !r.Timestamp.Equal(now) {
+		t.Fatalf("no timestamp: %+v %v", r, err)
+	}
+
+	for _, bad := range []string{"temp", "temp value=", "temp value=abc", `temp s="open`, "temp,host value=1", "temp value=1 notatime"} {
+		if _, err := ParseInflux(bad, "ns", now); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParseGraphite(t *testing.T) {
+	r, err := ParseGraphite("site.a.temp;unit=c 21.5 1700000000", time.Now())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r.Measurement != "site.a.temp" || r.Tags["unit"] != "c" || r.Fields["value"] != 21.5 {
+		t.Fatalf("unexpected reading: %+v", r)
+	}
+	if !r.Timestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("unexpected timestamp: %v", r.Timestamp)
+	}
+	if _, err := ParseGraphite("site.a.temp abc", time.Now()); err == nil {
+		t.Fatalf("expected error for invalid value")
+	}
+}
+
+func TestListenersSubmitReadings(t *testing.T) {
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+	in := pipeline.New(store, nil, 0)
+
+	tcp, err := New(FormatInflux, "tcp", "127.0.0.1:0", "", "", in)
+	if err != nil {
+		t.Fatalf("new tcp: %v", err)
+	}
+	if err := tcp.Start(); err != nil {
+		t.Fatalf("start tcp: %v", err)
+	}
+	defer tcp.Close()
+	udp, err := New(FormatGraphite, "udp", "127.0.0.1:0", "legacy", "", in)
+	if err != nil {
+		t.Fatalf("new udp: %v", err)
+	}
+	if err := udp.Start(); err != nil {
+		t.Fatalf("start udp: %v", err)
+	}
+	defer udp.Close()
+
+	c, err := net.Dial("tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("dial tcp: %v", err)
+	}
+	_, _ = c.Write([]byte("cpu,host=a usage=1\nbroken line\ncpu,host=b usage=2\n"))
+	c.Close()
+
+	u, err := net.Dial("udp", udp.Addr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	_, _ = u.Write([]byte("a.b.c 1 1700000000\n"))
+	u.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cnt, _ := store.CountUnsent()
+		if cnt == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 buffered readings, got %d", cnt)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	msgs, _ := store.FetchUnsent(10)
+	for _, m := range msgs {
+		if _, err := reading.Parse(m.Payload); err != nil {
+			t.Fatalf("buffered payload is not a reading: %s", m.Payload)
+		}
+	}
+}
+
+func TestAppendInfluxRoundTrip(t *testing.T) {
+	r := reading.Reading{
+		Measurement: "cpu load",
+		Tags:        map[string]string{"host": "a,b", "empty": ""},
+		Fields:      map[string]interface{}{"value": 0.5, "state": `say "hi"`, "up": true, "skip": nil},
+		Timestamp:   time.Unix(0, 1700000000123456789),
+	}
+	line, err := AppendInflux(nil, r, "ms")
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	want := `cpu\ load,host=a\,b state="say \"hi\"",up=true,value=0.5 1700000000123` + "\n"
+	if string(line) != want {
+		t.Fatalf("line = %q, want %q", line, want)
+	}
+	back, err := ParseInflux(strings.TrimSuffix(string(line), "\n"), "ms", time.Now())
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if back.Measurement != r.Measurement || back.Tags["host"] != "a,b" || back.Fields["state"] != `say "hi"` {
+		t.Fatalf("round trip mismatch: %+v", back)
+	}
+}
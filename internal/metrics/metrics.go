@@ -11,18 +11,78 @@ var (
 	})
 	Forwarded = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "iot_forwarded_total",
-		Help: "Total number of messages successfully forwarded to Kafka",
+		Help: "Total number of messages successfully forwarded to an output",
 	})
 	ForwardFailed = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "iot_forward_failed_total",
 		Help: "Total number of messages that failed forwarding after retries",
 	})
+	ForwardDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_forward_dropped_total",
+		Help: "Total number of messages dropped because an output rejected them permanently",
+	})
 	BufferPending = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "iot_buffer_pending",
 		Help: "Current number of pending (unsent) messages in the buffer",
 	})
+	BufferQuarantined = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_buffer_quarantined_total",
+		Help: "Total number of buffered messages quarantined because they failed authentication or could not be decoded",
+	})
+	BufferEvicted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_buffer_evicted_total",
+		Help: "Total number of unsent messages dropped to make room in a full buffer, by priority",
+	}, []string{"priority"})
+	BufferRecoveries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_buffer_recoveries_total",
+		Help: "Total number of times a corrupt buffer database was set aside and recovered into a new one at startup",
+	})
+	BufferRecoveredMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_buffer_recovered_messages_total",
+		Help: "Total number of messages copied from a corrupt buffer database into the new one",
+	})
+	BufferUnreadableIDs = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_buffer_unreadable_ids_total",
+		Help: "Total number of message ids in damaged parts of a corrupt buffer database; an upper bound on the messages lost",
+	})
+	SinkPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iot_sink_pending",
+		Help: "Current number of messages not yet delivered, by sink",
+	}, []string{"sink"})
+	SinkCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iot_sink_circuit_state",
+		Help: "State of the circuit breaker in front of each sink: 0 closed, 1 open, 2 half-open",
+	}, []string{"sink"})
+	HTTPIngestRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_http_ingest_requests_total",
+		Help: "Total number of HTTP ingest requests by response status code",
+	}, []string{"code"})
+	ModbusPollErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_modbus_poll_errors_total",
+		Help: "Total number of failed Modbus polls by device",
+	}, []string{"device"})
+	CoAPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_coap_requests_total",
+		Help: "Total number of CoAP requests by response code",
+	}, []string{"code"})
+	SparkplugOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iot_sparkplug_online",
+		Help: "Online state (1/0) of Sparkplug B edge nodes and devices",
+	}, []string{"group", "edge_node", "device"})
+	KafkaPayloadBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_kafka_payload_bytes_total",
+		Help: "Total number of message bytes handed to Kafka producers, before compression",
+	})
+	KafkaSentBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "iot_kafka_sent_bytes_total",
+		Help: "Total number of bytes Kafka producers sent to brokers, after compression and including protocol overhead",
+	})
+	LineParseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iot_line_parse_errors_total",
+		Help: "Total number of line protocol lines that could not be parsed, by format",
+	}, []string{"format"})
 )
 
 func Init() {
-	prometheus.MustRegister(Enqueued, Forwarded, ForwardFailed, BufferPending)
+	prometheus.MustRegister(Enqueued, Forwarded, ForwardFailed, ForwardDropped, BufferPending, BufferQuarantined, BufferEvicted, BufferRecoveries, BufferRecoveredMessages, BufferUnreadableIDs, SinkPending, SinkCircuitState, HTTPIngestRequests, ModbusPollErrors, CoAPRequests, SparkplugOnline, LineParseErrors, KafkaPayloadBytes, KafkaSentBytes)
 }
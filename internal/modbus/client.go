@@ -0,0 +1,166 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Modbus function codes used by the poller.
+const (
+	FuncReadCoils            byte = 0x01
+	FuncReadDiscreteInputs   byte = 0x02
+	FuncReadHoldingRegisters byte = 0x03
+	FuncReadInputRegisters   byte = 0x04
+)
+
+// ExceptionIllegalDataAddress is the exception code of a request covering an
+// address the device does not have.
+const ExceptionIllegalDataAddress byte = 0x02
+
+// ExceptionError is returned when the device answers with a Modbus exception.
+type ExceptionError struct {
+	Function byte
+	Code     byte
+}
+
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("modbus exception 0x%02x for function 0x%02x", e.Code, e.Function)
+}
+
+// Client is a minimal Modbus TCP client. It keeps one connection open and
+// reconnects lazily after errors. It is safe for concurrent use.
+type Client struct {
+	addr    string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	tid  uint16
+}
+
+// NewClient creates a client for the device at addr (host:port).
+func NewClient(addr string, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	return &Client{addr: addr, timeout: timeout}
+}
+
+// ReadRegisters reads qty 16-bit registers using fn (holding or input
+// registers) and returns the raw big-endian register bytes.
+func (c *Client) ReadRegisters(unit, fn byte, addr, qty uint16) ([]byte, error) {
+	if qty == 0 || qty > 125 {
+		return nil, fmt.Errorf("invalid register quantity %d", qty)
+	}
+	data, err := c.request(unit, fn, addr, qty)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(qty)*2 {
+		return nil, fmt.Errorf("short register response: %d bytes for %d registers", len(data), qty)
+	}
+	return data, nil
+}
+
+// ReadBits reads qty coils or discrete inputs using fn.
+func (c *Client) ReadBits(unit, fn byte, addr, qty uint16) ([]bool, error) {
+	if qty == 0 || qty > 2000 {
+		return nil, fmt.Errorf("invalid bit quantity %d", qty)
+	}
+	data, err := c.request(unit, fn, addr, qty)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != (int(qty)+7)/8 {
+		return nil, fmt.Errorf("short bit response: %d bytes for %d bits", len(data), qty)
+	}
+	out := make([]bool, qty)
+	for i := range out {
+		out[i] = data[i/8]&(1<<(uint(i)%8)) != 0
+	}
+	return out, nil
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *Client) request(unit, fn byte, addr, qty uint16) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	data, err := c.roundTrip(unit, fn, addr, qty)
+	if err != nil {
+		if _, ok := err.(*ExceptionError); !ok {
+			// the stream may be out of sync; start over on the next request
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+func (c *Client) roundTrip(unit, fn byte, addr, qty uint16) ([]byte, error) {
+	c.tid++
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], c.tid)
+	binary.BigEndian.PutUint16(req[2:], 0) // protocol id
+	binary.BigEndian.PutUint16(req[4:], 6) // unit id + PDU
+	req[6] = unit
+	req[7] = fn
+	binary.BigEndian.PutUint16(req[8:], addr)
+	binary.BigEndian.PutUint16(req[10:], qty)
+
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, err
+	}
+	for {
+		hdr := make([]byte, 7)
+		if _, err := io.ReadFull(c.conn, hdr); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint16(hdr[4:])
+		if length < 2 || length > 254 {
+			return nil, fmt.Errorf("invalid MBAP length %d", length)
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(c.conn, pdu); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint16(hdr[0:]) != c.tid {
+			// stale answer to an earlier, timed out request
+			continue
+		}
+		if pdu[0] == fn|0x80 {
+			if len(pdu) < 2 {
+				return nil, fmt.Errorf("truncated exception response")
+			}
+			return nil, &ExceptionError{Function: fn, Code: pdu[1]}
+		}
+		if pdu[0] != fn {
+			return nil, fmt.Errorf("unexpected function 0x%02x in response", pdu[0])
+		}
+		if len(pdu) < 2 || int(pdu[1]) != len(pdu)-2 {
+			return nil, fmt.Errorf("malformed response")
+		}
+		return pdu[2:], nil
+	}
+}
@@ -0,0 +1,378 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// Register describes one value in a device's register map.
+type Register struct {
+	Name string
+	// Table is one of "holding", "input", "coil" or "discrete".
+	Table   string
+	Address uint16
+	// Type is one of uint16, int16, uint32, int32, float32, uint64, int64 or
+	// float64. Coils and discrete inputs are always bool.
+	Type string
+	// ByteOrder is the order of the two bytes inside each register ("big" or
+	// "little"); WordOrder is the order of registers in multi-register values.
+	// Both default to big endian.
+	ByteOrder string
+	WordOrder string
+	// Scale and Offset convert the raw value: value*Scale + Offset.
+	// A zero Scale leaves the value unscaled.
+	Scale  float64
+	Offset float64
+}
+
+// Device is a Modbus TCP device polled at a fixed interval.
+type Device struct {
+	Name     string
+	Address  string
+	UnitID   byte
+	Interval time.Duration
+	Timeout  time.Duration
+	Topic    string
+	// MaxGap is how many unmapped addresses one read may span to cover
+	// neighbouring registers. Zero reads only contiguous registers together,
+	// as many devices reject reads covering addresses they do not have.
+	MaxGap    int
+	Registers []Register
+}
+
+// block is a single read request covering one or more registers.
+type block struct {
+	fn    byte
+	start uint16
+	qty   uint16
+	regs  []Register
+}
+
+// Poller periodically reads a device's register map and submits the values
+// as a JSON reading to the pipeline.
+type Poller struct {
+	dev    Device
+	client *Client
+	in     plugin.Ingester
+	blocks []block
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewPoller validates the device configuration and prepares the read plan.
+// Polling starts with Start.
+func NewPoller(dev Device, in plugin.Ingester) (*Poller, error) {
+	if dev.Name == "" || dev.Address == "" {
+		return nil, fmt.Errorf("modbus device requires name and address")
+	}
+	if len(dev.Registers) == 0 {
+		return nil, fmt.Errorf("modbus device %s has no registers", dev.Name)
+	}
+	if dev.Interval <= 0 {
+		dev.Interval = 10 * time.Second
+	}
+	if dev.Topic == "" {
+		dev.Topic = "modbus/" + dev.Name
+	}
+	blocks, err := plan(dev.Registers, dev.MaxGap)
+	if err != nil {
+		return nil, fmt.Errorf("modbus device %s: %w", dev.Name, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Poller{
+		dev:    dev,
+		client: NewClient(dev.Address, dev.Timeout),
+		in:     in,
+		blocks: blocks,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+func (p *Poller) Start() error {
+	p.wg.Add(1)
+	go p.loop()
+	return nil
+}
+
+func (p *Poller) Close() {
+	p.cancel()
+	p.wg.Wait()
+	p.client.Close()
+}
+
+func (p *Poller) loop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.dev.Interval)
+	defer ticker.Stop()
+	for {
+		p.pollOnce()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) pollOnce() {
+	r, err := p.Poll()
+	if err != nil {
+		metrics.ModbusPollErrors.WithLabelValues(p.dev.Name).Inc()
+		fmt.Printf("modbus: poll %s failed: %v\n", p.dev.Name, err)
+		return
+	}
+	payload, err := r.Marshal()
+	if err != nil {
+		fmt.Printf("modbus: encode reading for %s: %v\n", p.dev.Name, err)
+		return
+	}
+	if err := p.in.Submit(p.dev.Topic, payload); err != nil {
+		fmt.Printf("modbus: submit reading for %s: %v\n", p.dev.Name, err)
+	}
+}
+
+// Poll reads all configured registers once. Float registers holding NaN or
+// ±Inf, which meters use for "no value", are left out of the reading, as JSON
+// cannot carry them. A read of several registers the device rejects with an
+// illegal data address exception is split into one read per register, for
+// this and later polls. Poll must not be called while the poller is running.
+func (p *Poller) Poll() (reading.Reading, error) {
+	r := reading.Reading{
+		Measurement: p.dev.Name,
+		Tags: map[string]string{
+			"device":  p.dev.Name,
+			"unit_id": strconv.Itoa(int(p.dev.UnitID)),
+		},
+		Fields:    make(map[string]interface{}),
+		Timestamp: time.Now().UTC(),
+	}
+	for i := 0; i < len(p.blocks); i++ {
+		b := p.blocks[i]
+		err := p.read(b, r.Fields)
+		var ex *ExceptionError
+		if errors.As(err, &ex) && ex.Code == ExceptionIllegalDataAddress && len(b.regs) > 1 {
+			fmt.Printf("modbus: %s rejected reading %d registers from %d; reading them one by one\n", p.dev.Name, b.qty, b.start)
+			p.blocks = append(p.blocks[:i:i], append(b.split(), p.blocks[i+1:]...)...)
+			i--
+			continue
+		}
+		if err != nil {
+			return reading.Reading{}, err
+		}
+	}
+	return r, nil
+}
+
+// read reads one block and stores its values in fields.
+func (p *Poller) read(b block, fields map[string]interface{}) error {
+	switch b.fn {
+	case FuncReadCoils, FuncReadDiscreteInputs:
+		bits, err := p.client.ReadBits(p.dev.UnitID, b.fn, b.start, b.qty)
+		if err != nil {
+			return err
+		}
+		for _, reg := range b.regs {
+			fields[reg.Name] = bits[reg.Address-b.start]
+		}
+	default:
+		data, err := p.client.ReadRegisters(p.dev.UnitID, b.fn, b.start, b.qty)
+		if err != nil {
+			return err
+		}
+		for _, reg := range b.regs {
+			off := int(reg.Address-b.start) * 2
+			v, err := decode(reg, data[off:off+registerCount(reg.Type)*2])
+			if err != nil {
+				return err
+			}
+			if f, ok := v.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+				continue
+			}
+			fields[reg.Name] = v
+		}
+	}
+	return nil
+}
+
+// plan groups registers of the same table into as few read requests as the
+// protocol limits allow, spanning at most maxGap unmapped addresses.
+func plan(regs []Register, maxGap int) ([]block, error) {
+	byFn := make(map[byte][]Register)
+	for _, reg := range regs {
+		if reg.Name == "" {
+			return nil, fmt.Errorf("register at address %d has no name", reg.Address)
+		}
+		fn, err := tableFunc(reg.Table)
+		if err != nil {
+			return nil, err
+		}
+		if fn == FuncReadHoldingRegisters || fn == FuncReadInputRegisters {
+			if registerCount(reg.Type) == 0 {
+				return nil, fmt.Errorf("register %s: unknown type %q", reg.Name, reg.Type)
+			}
+		}
+		byFn[fn] = append(byFn[fn], reg)
+	}
+
+	fns := make([]int, 0, len(byFn))
+	for fn := range byFn {
+		fns = append(fns, int(fn))
+	}
+	sort.Ints(fns)
+
+	var out []block
+	for _, f := range fns {
+		fn := byte(f)
+		rs := byFn[fn]
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Address < rs[j].Address })
+		limit := 125
+		if fn == FuncReadCoils || fn == FuncReadDiscreteInputs {
+			limit = 2000
+		}
+		var cur *block
+		for _, reg := range rs {
+			end := int(reg.Address) + width(fn, reg)
+			if end > 0x10000 {
+				return nil, fmt.Errorf("register %s exceeds address space", reg.Name)
+			}
+			if cur != nil && int(reg.Address) <= int(cur.start)+int(cur.qty)+maxGap && end-int(cur.start) <= limit {
+				if n := uint16(end - int(cur.start)); n > cur.qty {
+					cur.qty = n
+				}
+				cur.regs = append(cur.regs, reg)
+				continue
+			}
+			out = append(out, block{fn: fn, start: reg.Address, qty: uint16(width(fn, reg)), regs: []Register{reg}})
+			cur = &out[len(out)-1]
+		}
+	}
+	return out, nil
+}
+
+// split returns one block per register of b.
+func (b block) split() []block {
+	out := make([]block, len(b.regs))
+	for i, reg := range b.regs {
+		out[i] = block{fn: b.fn, start: reg.Address, qty: uint16(width(b.fn, reg)), regs: []Register{reg}}
+	}
+	return out
+}
+
+// width returns how many addresses reg spans in the table read with fn.
+func width(fn byte, reg Register) int {
+	if fn == FuncReadCoils || fn == FuncReadDiscreteInputs {
+		return 1
+	}
+	return registerCount(reg.Type)
+}
+
+func tableFunc(table string) (byte, error) {
+	switch table {
+	case "holding", "":
+		return FuncReadHoldingRegisters, nil
+	case "input":
+		return FuncReadInputRegisters, nil
+	case "coil", "coils":
+		return FuncReadCoils, nil
+	case "discrete", "discrete_input":
+		return FuncReadDiscreteInputs, nil
+	default:
+		return 0, fmt.Errorf("unknown register table %q", table)
+	}
+}
+
+// registerCount returns how many 16-bit registers a value of type t spans.
+func registerCount(t string) int {
+	switch t {
+	case "uint16", "int16", "":
+		return 1
+	case "uint32", "int32", "float32":
+		return 2
+	case "uint64", "int64", "float64":
+		return 4
+	default:
+		return 0
+	}
+}
+
+// decode converts raw register bytes (as received, big endian per register)
+// into a value according to the register's type, byte order, word order and
+// scaling.
+func decode(reg Register, raw []byte) (interface{}, error) {
+	n := len(raw) / 2
+	words := make([]byte, 0, len(raw))
+	for i := 0; i < n; i++ {
+		w := n - 1 - i
+		if reg.WordOrder != "little" {
+			w = i
+		}
+		hi, lo := raw[w*2], raw[w*2+1]
+		if reg.ByteOrder == "little" {
+			hi, lo = lo, hi
+		}
+		words = append(words, hi, lo)
+	}
+
+	var v interface{}
+	switch reg.Type {
+	case "uint16", "":
+		v = binary.BigEndian.Uint16(words)
+	case "int16":
+		v = int16(binary.BigEndian.Uint16(words))
+	case "uint32":
+		v = binary.BigEndian.Uint32(words)
+	case "int32":
+		v = int32(binary.BigEndian.Uint32(words))
+	case "float32":
+		v = float64(math.Float32frombits(binary.BigEndian.Uint32(words)))
+	case "uint64":
+		v = binary.BigEndian.Uint64(words)
+	case "int64":
+		v = int64(binary.BigEndian.Uint64(words))
+	case "float64":
+		v = math.Float64frombits(binary.BigEndian.Uint64(words))
+	default:
+		return nil, fmt.Errorf("register %s: unknown type %q", reg.Name, reg.Type)
+	}
+	if reg.Scale == 0 && reg.Offset == 0 {
+		return v, nil
+	}
+	scale := reg.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return toFloat(v)*scale + reg.Offset, nil
+}
+
+func toFloat(v interface{}) float64 {
+	switch x := v.(type) {
+	case uint16:
+		return float64(x)
+	case int16:
+		return float64(x)
+	case uint32:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case float64:
+		return x
+	}
+	return 0
+}
@@ -0,0 +1,200 @@
+package modbus
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+	"github.com/your-username/iot-edge-gateway/internal/pipeline"
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+)
+
+func TestPollDecodesRegisterMap(t *testing.T) {
+	sim, err := NewSimulator("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("simulator: %v", err)
+	}
+	defer sim.Close()
+
+	f32 := math.Float32bits(230.5)
+	sim.SetInput(0, uint16(f32&0xffff), uint16(f32>>16)) // low word first
+	sim.SetHolding(10, 0x0001, 0x86a0)                   // 100000
+	sim.SetHolding(20, 0xff38)                           // -200
+	sim.SetHolding(21, 0x3412)                           // 0x1234 byte swapped
+	sim.SetCoil(3, true)
+	nan := math.Float32bits(float32(math.NaN()))
+	sim.SetInput(2, uint16(nan&0xffff), uint16(nan>>16))
+
+	dev := Device{
+		Name:    "meter",
+		Address: sim.Addr(),
+		UnitID:  7,
+		Registers: []Register{
+			{Name: "voltage", Table: "input", Address: 0, Type: "float32", WordOrder: "little"},
+			{Name: "current", Table: "input", Address: 2, Type: "float32", WordOrder: "little"},
+			{Name: "energy", Table: "holding", Address: 10, Type: "uint32", Scale: 0.01},
+			{Name: "temp", Table: "holding", Address: 20, Type: "int16", Scale: 0.1},
+			{Name: "raw", Table: "holding", Address: 21, Type: "uint16", ByteOrder: "little"},
+			{Name: "running", Table: "coil", Address: 3},
+		},
+	}
+	p, err := NewPoller(dev, nil)
+	if err != nil {
+		t.Fatalf("new poller: %v", err)
+	}
+	defer p.Close()
+	if len(p.blocks) != 4 {
+		t.Fatalf("expected 4 read requests, got %d", len(p.blocks))
+	}
+
+	r, err := p.Poll()
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if v := r.Fields["voltage"].(float64); v != 230.5 {
+		t.Fatalf("voltage: got %v", v)
+	}
+	if v := r.Fields["energy"].(float64); math.Abs(v-1000) > 1e-9 {
+		t.Fatalf("energy: got %v", v)
+	}
+	if v := r.Fields["temp"].(float64); math.Abs(v+20) > 1e-9 {
+		t.Fatalf("temp: got %v", v)
+	}
+	if v := r.Fields["raw"].(uint16); v != 0x1234 {
+		t.Fatalf("raw: got %#x", v)
+	}
+	if v := r.Fields["running"].(bool); !v {
+		t.Fatalf("running: expected true")
+	}
+	if v, ok := r.Fields["current"]; ok {
+		t.Fatalf("current: expected NaN to be left out, got %v", v)
+	}
+	if _, err := r.Marshal(); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if r.Tags["unit_id"] != "7" {
+		t.Fatalf("unit_id tag: got %q", r.Tags["unit_id"])
+	}
+}
+
+func TestPollSplitsRejectedReads(t *testing.T) {
+	sim, err := NewSimulator("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("simulator: %v", err)
+	}
+	defer sim.Close()
+	sim.SetStrict(true)
+	sim.SetHolding(0, 1)
+	sim.SetHolding(1, 2)
+	sim.SetHolding(5, 3) // 2-4 are not defined
+
+	dev := Device{
+		Name:    "plc",
+		Address: sim.Addr(),
+		MaxGap:  3,
+		Registers: []Register{
+			{Name: "a", Address: 0},
+			{Name: "b", Address: 1},
+			{Name: "c", Address: 5},
+		},
+	}
+	p, err := NewPoller(dev, nil)
+	if err != nil {
+		t.Fatalf("new poller: %v", err)
+	}
+	defer p.Close()
+	if len(p.blocks) != 1 || p.blocks[0].qty != 6 {
+		t.Fatalf("expected one read across the gap, got %+v", p.blocks)
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := p.Poll()
+		if err != nil {
+			t.Fatalf("poll %d: %v", i, err)
+		}
+		if r.Fields["a"] != uint16(1) || r.Fields["b"] != uint16(2) || r.Fields["c"] != uint16(3) {
+			t.Fatalf("poll %d: unexpected fields %v", i, r.Fields)
+		}
+	}
+	if len(p.blocks) != 3 {
+		t.Fatalf("expected the rejected read to stay split, got %d reads", len(p.blocks))
+	}
+
+	// without a gap only contiguous registers are read together
+	dev.MaxGap = 0
+	q, err := NewPoller(dev, nil)
+	if err != nil {
+		t.Fatalf("new poller: %v", err)
+	}
+	defer q.Close()
+	if len(q.blocks) != 2 {
+		t.Fatalf("expected 2 reads without a gap, got %d", len(q.blocks))
+	}
+}
+
+func TestPollerSubmitsReadings(t *testing.T) {
+	sim, err := NewSimulator("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("simulator: %v", err)
+	}
+	defer sim.Close()
+	sim.SetHolding(0, 42)
+
+	store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("buffer init: %v", err)
+	}
+	defer store.Close()
+
+	dev := Device{
+		Name:      "plc",
+		Address:   sim.Addr(),
+		Interval:  20 * time.Millisecond,
+		Registers: []Register{{Name: "level", Address: 0}},
+	}
+	p, err := NewPoller(dev, pipeline.New(store, nil, 0))
+	if err != nil {
+		t.Fatalf("new poller: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	p.Close()
+
+	msgs, err := store.FetchUnsent(10)
+	if err != nil {
+		t.Fatalf("fetch: %v", err)
+	}
+	if len(msgs) == 0 {
+		t.Fatalf("expected buffered readings")
+	}
+	r, err := reading.Parse(msgs[0].Payload)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r.Measurement != "plc" || r.Fields["level"].(float64) != 42 {
+		t.Fatalf("unexpected reading: %+v", r)
+	}
+}
+
+func TestPollReportsExceptions(t *testing.T) {
+	sim, err := NewSimulator("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("simulator: %v", err)
+	}
+	defer sim.Close()
+
+	c := NewClient(sim.Addr(), time.Second)
+	defer c.Close()
+	_, err = c.ReadRegisters(1, 0x2b, 0, 1)
+	if _, ok := err.(*ExceptionError); !ok {
+		t.Fatalf("expected exception error, got %v", err)
+	}
+	// the connection survives an exception
+	if _, err := c.ReadRegisters(1, FuncReadHoldingRegisters, 0, 2); err != nil {
+		t.Fatalf("read after exception: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// Simulator is an in-process Modbus TCP server backed by in-memory register
+// tables. It answers read requests for any unit id and is meant for tests and
+// local development without real hardware.
+type Simulator struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	holding  map[uint16]uint16
+	input    map[uint16]uint16
+	coils    map[uint16]bool
+	discrete map[uint16]bool
+	strict   bool
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewSimulator starts a simulator listening on addr, e.g. "127.0.0.1:0".
+func NewSimulator(addr string) (*Simulator, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulator{
+		ln:       ln,
+		holding:  make(map[uint16]uint16),
+		input:    make(map[uint16]uint16),
+		coils:    make(map[uint16]bool),
+		discrete: make(map[uint16]bool),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the simulator listens on.
+func (s *Simulator) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// SetHolding sets consecutive holding registers starting at addr.
+func (s *Simulator) SetHolding(addr uint16, values ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range values {
+		s.holding[addr+uint16(i)] = v
+	}
+}
+
+// SetInput sets consecutive input registers starting at addr.
+func (s *Simulator) SetInput(addr uint16, values ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range values {
+		s.input[addr+uint16(i)] = v
+	}
+}
+
+// SetCoil sets a single coil.
+func (s *Simulator) SetCoil(addr uint16, v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.coils[addr] = v
+}
+
+// SetDiscrete sets a single discrete input.
+func (s *Simulator) SetDiscrete(addr uint16, v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discrete[addr] = v
+}
+
+// SetStrict makes reads covering an address that was never set fail with an
+// illegal data address exception, as many devices answer.
+func (s *Simulator) SetStrict(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strict = on
+}
+
+// Close stops the simulator, drops open connections and waits for them to finish.
+func (s *Simulator) Close() {
+	_ = s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Simulator) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Simulator) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		hdr := make([]byte, 7)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(hdr[4:])
+		if length < 2 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := s.respond(pdu)
+		out := make([]byte, 7, 7+len(resp))
+		copy(out, hdr[:4])
+		binary.BigEndian.PutUint16(out[4:], uint16(len(resp)+1))
+		out[6] = hdr[6]
+		out = append(out, resp...)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Simulator) respond(pdu []byte) []byte {
+	fn := pdu[0]
+	if len(pdu) != 5 {
+		return []byte{fn | 0x80, 0x03}
+	}
+	addr := binary.BigEndian.Uint16(pdu[1:])
+	qty := binary.BigEndian.Uint16(pdu[3:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch fn {
+	case FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if qty == 0 || qty > 125 {
+			return []byte{fn | 0x80, 0x03}
+		}
+		table := s.holding
+		if fn == FuncReadInputRegisters {
+			table = s.input
+		}
+		out := []byte{fn, byte(qty * 2)}
+		for i := uint16(0); i < qty; i++ {
+			v, ok := table[addr+i]
+			if !ok && s.strict {
+				return []byte{fn | 0x80, ExceptionIllegalDataAddress}
+			}
+			out = binary.BigEndian.AppendUint16(out, v)
+		}
+		return out
+	case FuncReadCoils, FuncReadDiscreteInputs:
+		if qty == 0 || qty > 2000 {
+			return []byte{fn | 0x80, 0x03}
+		}
+		table := s.coils
+		if fn == FuncReadDiscreteInputs {
+			table = s.discrete
+		}
+		data := make([]byte, (qty+7)/8)
+		for i := uint16(0); i < qty; i++ {
+			v, ok := table[addr+i]
+			if !ok && s.strict {
+				return []byte{fn | 0x80, ExceptionIllegalDataAddress}
+			}
+			if v {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{fn, byte(len(data))}, data...)
+	default:
+		return []byte{fn | 0x80, 0x01}
+	}
+}
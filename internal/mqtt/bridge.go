@@ -0,0 +1,199 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/your-username/iot-edge-gateway/internal/topic"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// DefaultBatchSize is the number of messages published before waiting for
+// their acknowledgements when no batch size is configured. Brokers limit the
+// unacknowledged messages per connection, AWS IoT Core to 100.
+const DefaultBatchSize = 100
+
+// TLSConfig configures TLS for connections to a broker. CertFile and KeyFile
+// are the client certificate used by brokers that authenticate devices with
+// X.509 certificates (e.g. AWS IoT Core).
+type TLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// TopicMapping publishes messages whose source topic matches the MQTT filter
+// Match to Topic, which may use {topic} (the source topic) and {topic:N}
+// (its N-th level, from 0).
+type TopicMapping struct {
+	Match string
+	Topic string
+}
+
+// BridgeConfig configures a Bridge.
+type BridgeConfig struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// QoS 1 and 2 wait for the broker's acknowledgement; QoS 0 gives no
+	// delivery guarantee.
+	QoS    byte
+	Retain bool
+	// Messages that no mapping takes are published to TopicPrefix followed by
+	// their source topic, or to DefaultTopic when they have none.
+	TopicPrefix  string
+	DefaultTopic string
+	Mappings     []TopicMapping
+	TLS          *TLSConfig
+	// BatchSize is how many messages are published in a row before waiting
+	// for their acknowledgements.
+	BatchSize int
+}
+
+// Bridge is a sink that publishes buffered messages to an upstream MQTT
+// broker such as AWS IoT Core or HiveMQ Cloud. Like kafka.Producer it reports
+// success only once the broker has acknowledged a message, so messages are
+// not marked sent in the buffer before the upstream broker has them. Batches
+// are published without waiting in between, so a slow link costs one round
+// trip per batch rather than per message.
+type Bridge struct {
+	client paho.Client
+	cfg    BridgeConfig
+}
+
+// NewBridge validates cfg and starts connecting to the broker in the
+// background; publishing fails until the connection is up.
+func NewBridge(cfg BridgeConfig) (*Bridge, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("broker required")
+	}
+	if cfg.QoS > 2 {
+		return nil, fmt.Errorf("invalid qos %d", cfg.QoS)
+	}
+	if cfg.DefaultTopic == "" {
+		return nil, fmt.Errorf("default topic required")
+	}
+	for i, m := range cfg.Mappings {
+		if m.Match == "" || m.Topic == "" {
+			return nil, fmt.Errorf("mapping %d: match and topic required", i)
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	opts := paho.NewClientOptions()
+	opts.AddBroker(cfg.Broker)
+	opts.SetClientID(cfg.ClientID)
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(2 * time.Second)
+	if cfg.TLS != nil {
+		tc, err := cfg.TLS.build()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tc)
+	}
+
+	b := &Bridge{client: paho.NewClient(opts), cfg: cfg}
+	b.client.Connect()
+	return b, nil
+}
+
+// Produce publishes payload to the default topic.
+func (b *Bridge) Produce(payload []byte, timeout time.Duration) error {
+	return b.ProduceTopic("", payload, timeout)
+}
+
+// ProduceTopic publishes a message submitted under src to its mapped
+// upstream topic and waits up to timeout for the PUBACK (or PUBCOMP).
+func (b *Bridge) ProduceTopic(src string, payload []byte, timeout time.Duration) error {
+	return b.ProduceBatch([]plugin.Message{{Topic: src, Payload: payload}}, timeout)
+}
+
+func (b *Bridge) BatchSize() int {
+	return b.cfg.BatchSize
+}
+
+// ProduceBatch publishes msgs to their mapped upstream topics one after the
+// other and then waits up to timeout for all acknowledgements. It fails if
+// any message was not acknowledged; the batch is then sent again as a whole.
+func (b *Bridge) ProduceBatch(msgs []plugin.Message, timeout time.Duration) error {
+	if !b.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to %s", b.cfg.Broker)
+	}
+	dests := make([]string, len(msgs))
+	tokens := make([]paho.Token, len(msgs))
+	for i, m := range msgs {
+		dests[i] = b.Resolve(m.Topic)
+		tokens[i] = b.client.Publish(dests[i], b.cfg.QoS, b.cfg.Retain, m.Payload)
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for i, token := range tokens {
+		select {
+		case <-token.Done():
+		case <-deadline.C:
+			return fmt.Errorf("publish to %s: not acknowledged within %s", dests[i], timeout)
+		}
+		if err := token.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve returns the upstream topic for a message submitted under src.
+func (b *Bridge) Resolve(src string) string {
+	if src == "" {
+		return b.cfg.DefaultTopic
+	}
+	for _, m := range b.cfg.Mappings {
+		if !topic.Match(m.Match, src) {
+			continue
+		}
+		if dest, ok := topic.Expand(m.Topic, src, nil, nil); ok {
+			return dest
+		}
+	}
+	return b.cfg.TopicPrefix + src
+}
+
+func (b *Bridge) Close() {
+	b.client.Disconnect(250)
+}
+
+func (t *TLSConfig) build() (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// fakeBroker is a minimal MQTT 3.1.1 broker that accepts one client,
+// records PUBLISH packets and acknowledges QoS 1 publishes unless ack is false.
+type fakeBroker struct {
+	ln   net.Listener
+	ack  chan bool
+	pubs chan string
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &fakeBroker{ln: ln, ack: make(chan bool, 10), pubs: make(chan string, 10)}
+	go b.serve()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) serve() {
+	conn, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		var length, mult int = 0, 1
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(c&127) * mult
+			mult *= 128
+			if c&128 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			conn.Write([]byte{0x20, 2, 0, 0})
+		case 3: // PUBLISH
+			n := int(body[0])<<8 | int(body[1])
+			b.pubs <- string(body[2 : 2+n])
+			if (header>>1)&3 == 1 && <-b.ack {
+				conn.Write([]byte{0x40, 2, body[2+n], body[3+n]})
+			}
+		case 12: // PINGREQ
+			conn.Write([]byte{0xd0, 0})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+func TestBridgeWaitsForPuback(t *testing.T) {
+	broker := newFakeBroker(t)
+	b, err := NewBridge(BridgeConfig{
+		Broker:       "tcp://" + broker.ln.Addr().String(),
+		ClientID:     "bridge-test",
+		QoS:          1,
+		TopicPrefix:  "site1/",
+		DefaultTopic: "site1/data",
+		Mappings:     []TopicMapping{{Match: "sensors/+/alarm", Topic: "alarms/{topic:1}"}},
+	})
+	if err != nil {
+		t.Fatalf("new bridge: %v", err)
+	}
+	defer b.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.client.IsConnectionOpen() {
+		if time.Now().After(deadline) {
+			t.Fatalf("bridge did not connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	broker.ack <- true
+	if err := b.ProduceTopic("sensors/boiler/alarm", []byte(`{}`), 2*time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	if got := <-broker.pubs; got != "alarms/boiler" {
+		t.Fatalf("published to %q, want alarms/boiler", got)
+	}
+
+	// without a PUBACK the message must not be reported as delivered
+	broker.ack <- false
+	if err := b.ProduceTopic("sensors/boiler/temp", []byte(`{}`), 200*time.Millisecond); err == nil {
+		t.Fatalf("expected error when the broker does not acknowledge")
+	}
+	if got := <-broker.pubs; got != "site1/sensors/boiler/temp" {
+		t.Fatalf("published to %q, want site1/sensors/boiler/temp", got)
+	}
+
+	// a batch is published in one go and fails if any message is not
+	// acknowledged
+	batch := []plugin.Message{
+		{Topic: "sensors/a/temp", Payload: []byte(`1`)},
+		{Topic: "sensors/b/alarm", Payload: []byte(`2`)},
+		{Topic: "", Payload: []byte(`3`)},
+	}
+	for i := 0; i < 3; i++ {
+		broker.ack <- true
+	}
+	if err := b.ProduceBatch(batch, 2*time.Second); err != nil {
+		t.Fatalf("produce batch: %v", err)
+	}
+	for _, want := range []string{"site1/sensors/a/temp", "alarms/b", "site1/data"} {
+		if got := <-broker.pubs; got != want {
+			t.Fatalf("published to %q, want %s", got, want)
+		}
+	}
+	broker.ack <- true
+	broker.ack <- false
+	broker.ack <- true
+	if err := b.ProduceBatch(batch, 200*time.Millisecond); err == nil {
+		t.Fatalf("expected error when the broker does not acknowledge every message")
+	}
+
+	if got := b.Resolve(""); got != "site1/data" {
+		t.Fatalf("Resolve(\"\") = %q, want default topic", got)
+	}
+}
@@ -5,20 +5,25 @@ import (
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
-	"github.com/your-username/iot-edge-gateway/internal/buffer"
-	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/internal/sparkplug"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
 )
 
 type Client struct {
 	client paho.Client
-	store  *buffer.Store
+	in     plugin.Ingester
 	topic  string
 	qos    byte
+	// sparkplug decodes messages on spBv1.0 topics and tracks node state
+	sparkplug *sparkplug.Tracker
+	priority  int
 }
 
-// New creates and connects an MQTT client and subscribes to the given topic.
+// New creates an MQTT client for the given broker and topic. The connection
+// and subscription are established by Start.
 // broker - e.g. tcp://localhost:1883
-func New(broker, clientID, topic string, qos byte, store *buffer.Store) (*Client, error) {
+// Received messages are submitted to the pipeline in.
+func New(broker, clientID, topic string, qos byte, in plugin.Ingester) (*Client, error) {
 	if broker == "" {
 		return nil, fmt.Errorf("broker required")
 	}
@@ -27,52 +32,91 @@ func New(broker, clientID, topic string, qos byte, store *buffer.Store) (*Client
 	opts.SetClientID(clientID)
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(2 * time.Second)
-	c := paho.NewClient(opts)
 
-	token := c.Connect()
-	if token.Wait() && token.Error() != nil {
-		return nil, token.Error()
-	}
+	return &Client{
+		client:    paho.NewClient(opts),
+		in:        in,
+		topic:     topic,
+		qos:       qos,
+		sparkplug: sparkplug.NewTracker(),
+	}, nil
+}
 
-	mc := &Client{
-		client: c,
-		store:  store,
-		topic:  topic,
-		qos:    qos,
+// SetPriority sets the buffer priority of the subscription's messages, if
+// the ingester accepts priorities.
+func (c *Client) SetPriority(priority int) {
+	c.priority = priority
+}
+
+// Start connects to the broker and subscribes to the topic.
+func (c *Client) Start() error {
+	token := c.client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
 	}
 
 	// Subscribe with message handler
-	if token := c.Subscribe(topic, qos, mc.messageHandler); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+	if token := c.client.Subscribe(c.topic, c.qos, c.messageHandler); token.Wait() && token.Error() != nil {
+		return token.Error()
 	}
-
-	return mc, nil
+	return nil
 }
 
 func (c *Client) messageHandler(client paho.Client, msg paho.Message) {
-	// Enqueue payload to disk-backed buffer; errors are logged to stdout for now.
-	if c.store == nil {
-		fmt.Println("buffer store is nil; dropping message")
+	// Hand the payload to the processing pipeline; errors are logged to stdout for now.
+	if c.in == nil {
+		fmt.Println("pipeline is nil; dropping message")
+		return
+	}
+	if sparkplug.IsTopic(msg.Topic()) {
+		c.handleSparkplug(client, msg)
+		return
+	}
+	if err := c.submit(msg.Topic(), msg.Payload()); err != nil {
+		fmt.Printf("failed to enqueue message from topic %s: %v\n", msg.Topic(), err)
 		return
 	}
-	id, err := c.store.Enqueue(msg.Payload())
+	// minimal ack/log
+	fmt.Printf("enqueued message from topic %s (len=%d)\n", msg.Topic(), len(msg.Payload()))
+}
+
+// handleSparkplug decodes a Sparkplug B message into JSON readings and asks the
+// edge node for a rebirth when the message references unknown aliases.
+func (c *Client) handleSparkplug(client paho.Client, msg paho.Message) {
+	res, err := c.sparkplug.Handle(msg.Topic(), msg.Payload())
 	if err != nil {
-		fmt.Printf("failed to enqueue message: %v\n", err)
-	} else {
-		// increment Prometheus counter and update pending gauge
-		metrics.Enqueued.Inc()
-		if cnt, err := c.store.CountUnsent(); err == nil {
-			metrics.BufferPending.Set(float64(cnt))
+		fmt.Printf("sparkplug: dropping message from topic %s: %v\n", msg.Topic(), err)
+		return
+	}
+	for _, r := range res.Readings {
+		payload, err := r.Marshal()
+		if err != nil {
+			fmt.Printf("sparkplug: encode reading: %v\n", err)
+			continue
+		}
+		if err := c.submit(msg.Topic(), payload); err != nil {
+			fmt.Printf("failed to enqueue message from topic %s: %v\n", msg.Topic(), err)
 		}
-		// minimal ack/log
-		fmt.Printf("enqueued message id=%d from topic %s (len=%d)\n", id, msg.Topic(), len(msg.Payload()))
+	}
+	if res.Rebirth != "" {
+		fmt.Printf("sparkplug: requesting rebirth on %s\n", res.Rebirth)
+		client.Publish(res.Rebirth, 0, false, sparkplug.RebirthPayload(uint64(time.Now().UnixMilli())))
 	}
 }
 
+func (c *Client) submit(topic string, payload []byte) error {
+	if pi, ok := c.in.(plugin.PriorityIngester); ok && c.priority != plugin.PriorityNormal {
+		return pi.SubmitPriority(topic, payload, c.priority)
+	}
+	return c.in.Submit(topic, payload)
+}
+
 func (c *Client) Close() {
 	if c == nil || c.client == nil {
 		return
 	}
-	_ = c.client.Unsubscribe(c.topic)
+	if c.client.IsConnectionOpen() {
+		_ = c.client.Unsubscribe(c.topic)
+	}
 	c.client.Disconnect(250)
 }
@@ -0,0 +1,102 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+	"github.com/your-username/iot-edge-gateway/internal/sparkplug"
+)
+
+// recordingIngester keeps the payloads submitted to it.
+type recordingIngester struct {
+	topics   []string
+	payloads [][]byte
+}
+
+func (r *recordingIngester) Submit(topic string, payload []byte) error {
+	r.topics = append(r.topics, topic)
+	r.payloads = append(r.payloads, payload)
+	return nil
+}
+
+func (r *recordingIngester) Full() bool { return false }
+
+// publishRecorder is a paho.Client that records publishes.
+type publishRecorder struct {
+	paho.Client
+	published []string
+}
+
+func (p *publishRecorder) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	p.published = append(p.published, topic)
+	return nil
+}
+
+type testMessage struct {
+	paho.Message
+	topic   string
+	payload []byte
+}
+
+func (m testMessage) Topic() string   { return m.topic }
+func (m testMessage) Payload() []byte { return m.payload }
+
+// sparkplugDouble encodes a Sparkplug B payload with one Double metric. An
+// empty name sends the metric by alias only.
+func sparkplugDouble(name string, alias uint64, v float64) []byte {
+	var m []byte
+	if name != "" {
+		m = protowire.AppendTag(m, 1, protowire.BytesType)
+		m = protowire.AppendString(m, name)
+	}
+	m = protowire.AppendTag(m, 2, protowire.VarintType)
+	m = protowire.AppendVarint(m, alias)
+	m = protowire.AppendTag(m, 4, protowire.VarintType)
+	m = protowire.AppendVarint(m, uint64(sparkplug.TypeDouble))
+	m = protowire.AppendTag(m, 13, protowire.Fixed64Type)
+	m = protowire.AppendFixed64(m, math.Float64bits(v))
+
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.VarintType)
+	out = protowire.AppendVarint(out, 1000)
+	out = protowire.AppendTag(out, 2, protowire.BytesType)
+	return protowire.AppendBytes(out, m)
+}
+
+func TestSparkplugMessagesBecomeReadings(t *testing.T) {
+	in := &recordingIngester{}
+	c := &Client{in: in, sparkplug: sparkplug.NewTracker()}
+	broker := &publishRecorder{}
+	const data = "spBv1.0/plant/NDATA/edge1"
+
+	// data by alias before the birth cannot be resolved: ask for a rebirth
+	c.messageHandler(broker, testMessage{topic: data, payload: sparkplugDouble("", 5, 20.5)})
+	if len(in.payloads) != 0 {
+		t.Fatalf("expected no readings before the birth, got %d", len(in.payloads))
+	}
+	if len(broker.published) != 1 || broker.published[0] != "spBv1.0/plant/NCMD/edge1" {
+		t.Fatalf("expected a rebirth request, published %v", broker.published)
+	}
+
+	c.messageHandler(broker, testMessage{topic: "spBv1.0/plant/NBIRTH/edge1", payload: sparkplugDouble("temperature", 5, 20.0)})
+	in.topics, in.payloads = nil, nil
+
+	c.messageHandler(broker, testMessage{topic: data, payload: sparkplugDouble("", 5, 21.5)})
+	if len(in.payloads) != 1 || in.topics[0] != data {
+		t.Fatalf("expected one reading on %s, got %v", data, in.topics)
+	}
+	r, err := reading.Parse(in.payloads[0])
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if r.Fields["temperature"] != 21.5 {
+		t.Fatalf("expected the alias resolved to temperature, got %v", r.Fields)
+	}
+	if len(broker.published) != 1 {
+		t.Fatalf("unexpected rebirth requests after the birth: %v", broker.published)
+	}
+}
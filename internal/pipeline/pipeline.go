@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/internal/processor"
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+var (
+	// ErrBufferFull is returned when the pending data in the buffer exceeds
+	// the configured size limit. Callers should ask the sender to retry later.
+	ErrBufferFull = plugin.ErrBufferFull
+	// ErrUnavailable is returned when the buffer cannot accept writes.
+	ErrUnavailable = plugin.ErrUnavailable
+)
+
+// sizeCheckInterval bounds how often the pending size is queried from the store.
+const sizeCheckInterval = time.Second
+
+// Pipeline is the shared entry point for all inputs: messages are run through
+// the processor and the results are enqueued to the disk-backed buffer.
+// It implements plugin.PriorityIngester and plugin.BatchIngester.
+type Pipeline struct {
+	store     buffer.Buffer
+	proc      *processor.Processor
+	maxBytes  int64
+	evictable []int
+	notify    func(n, priority int)
+
+	mu        sync.Mutex
+	full      bool
+	checkedAt time.Time
+}
+
+// New creates a pipeline writing to store. maxBytes limits the pending payload
+// bytes held in the buffer; zero disables the limit.
+func New(store buffer.Buffer, proc *processor.Processor, maxBytes int64) *Pipeline {
+	if proc == nil {
+		proc = processor.New()
+	}
+	return &Pipeline{
+		store:    store,
+		proc:     proc,
+		maxBytes: maxBytes,
+	}
+}
+
+// SetEvictable sets the priorities whose oldest messages are dropped to make
+// room when the buffer is full, instead of refusing new messages. Room is
+// only made for a message of the same or a higher priority, evicting the
+// lowest priority first. The buffer must implement buffer.Evicter.
+func (p *Pipeline) SetEvictable(priorities []int) {
+	p.evictable = append([]int(nil), priorities...)
+	sort.Ints(p.evictable)
+}
+
+// SetNotify sets a function called after messages were buffered with their
+// number and highest priority, e.g. to wake the forwarders. Call it before
+// the inputs are started.
+func (p *Pipeline) SetNotify(fn func(n, priority int)) {
+	p.notify = fn
+}
+
+// Submit processes a payload received on topic and enqueues the results.
+func (p *Pipeline) Submit(topic string, payload []byte) error {
+	return p.SubmitPriority(topic, payload, plugin.PriorityNormal)
+}
+
+// SubmitPriority is like Submit for a payload of the given priority, which
+// processor rules may override.
+func (p *Pipeline) SubmitPriority(topic string, payload []byte, priority int) error {
+	if p == nil || p.store == nil {
+		return ErrUnavailable
+	}
+	out, err := p.proc.Process(processor.Message{Topic: topic, Payload: payload, Priority: priority})
+	if err != nil {
+		return err
+	}
+	return p.enqueue(out)
+}
+
+// SubmitBatch processes payloads received on topic and enqueues the results
+// in one batch, so either all of them are buffered or none is.
+func (p *Pipeline) SubmitBatch(topic string, payloads [][]byte) error {
+	if p == nil || p.store == nil {
+		return ErrUnavailable
+	}
+	var out []processor.Message
+	for _, payload := range payloads {
+		msgs, err := p.proc.Process(processor.Message{Topic: topic, Payload: payload, Priority: plugin.PriorityNormal})
+		if err != nil {
+			return err
+		}
+		out = append(out, msgs...)
+	}
+	return p.enqueue(out)
+}
+
+// enqueue writes processed messages to the buffer in one batch.
+func (p *Pipeline) enqueue(out []processor.Message) error {
+	if len(out) == 0 {
+		return nil
+	}
+	batch := make([]buffer.Message, len(out))
+	top := out[0].Priority
+	for i, m := range out {
+		batch[i] = buffer.Message{Topic: m.Topic, Payload: m.Payload, Priority: m.Priority}
+		if m.Priority > top {
+			top = m.Priority
+		}
+	}
+	if p.Full() && !p.makeRoom(top) {
+		return ErrBufferFull
+	}
+	if _, err := p.store.EnqueueBatch(batch); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	metrics.Enqueued.Add(float64(len(batch)))
+	if p.notify != nil {
+		p.notify(len(batch), top)
+	}
+	if cnt, err := p.store.CountUnsent(); err == nil {
+		metrics.BufferPending.Set(float64(cnt))
+	}
+	return nil
+}
+
+// Full reports whether the buffer has reached its size limit. The result is
+// cached for a short interval so that high-rate inputs don't query the
+// database on every message.
+func (p *Pipeline) Full() bool {
+	if p == nil || p.store == nil || p.maxBytes <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.checkedAt) < sizeCheckInterval {
+		return p.full
+	}
+	size, err := p.store.PendingBytes()
+	if err != nil {
+		// keep the previous verdict; the enqueue itself will surface real errors
+		return p.full
+	}
+	p.full = size >= p.maxBytes
+	p.checkedAt = time.Now()
+	return p.full
+}
+
+// makeRoom evicts messages of evictable priorities up to priority until the
+// buffer is below its limit again, and reports whether it is.
+func (p *Pipeline) makeRoom(priority int) bool {
+	ev, ok := p.store.(buffer.Evicter)
+	if !ok || len(p.evictable) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.full {
+		// another submit made room meanwhile
+		return true
+	}
+	// leave some headroom so that not every message has to evict
+	target := p.maxBytes - p.maxBytes/10
+	for _, prio := range p.evictable {
+		if prio > priority {
+			break
+		}
+		n, err := ev.Evict(prio, target)
+		if n > 0 {
+			fmt.Printf("pipeline: buffer full, evicted %d message(s) of priority %d\n", n, prio)
+			metrics.BufferEvicted.WithLabelValues(strconv.Itoa(prio)).Add(float64(n))
+		}
+		if err != nil {
+			fmt.Printf("pipeline: evict priority %d: %v\n", prio, err)
+			return false
+		}
+		if size, err := p.store.PendingBytes(); err == nil && size < p.maxBytes {
+			p.full = false
+			p.checkedAt = time.Now()
+			return true
+		}
+	}
+	return false
+}
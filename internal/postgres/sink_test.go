@@ -0,0 +1,152 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// fakeDB is a database/sql driver that stores the device of every row
+// inserted and rejects statements containing the device "bad" like
+// PostgreSQL rejects a value out of range.
+type fakeDB struct {
+	mu       sync.Mutex
+	inserted []string
+}
+
+func (d *fakeDB) Open(string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return nil, fmt.Errorf("not supported") }
+
+type fakeStmt struct{ db *fakeDB }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	var devices []string
+	for i := 1; i < len(args); i += 3 {
+		if args[i] == "bad" {
+			return nil, &pq.Error{Code: "22003", Message: "numeric field overflow"}
+		}
+		devices = append(devices, args[i].(string))
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.inserted = append(s.db.inserted, devices...)
+	return driver.RowsAffected(len(devices)), nil
+}
+
+// reset forgets the rows inserted by an earlier test.
+func (d *fakeDB) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.inserted = nil
+}
+
+var fake = &fakeDB{}
+
+func init() { sql.Register("fakepg", fake) }
+
+func TestInsertStatement(t *testing.T) {
+	s, err := newSink(Config{Mapping: Mapping{
+		Table:             "public.readings",
+		TimeColumn:        "time",
+		MeasurementColumn: "measurement",
+		TagsColumn:        "tags",
+		Tags:              map[string]string{"device": "device_id"},
+		Fields:            map[string]string{"temperature": "temp_c"},
+		ConflictColumns:   []string{"time", "device_id"},
+	}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	buffered := time.Unix(1700000100, 0)
+	query, args, err := s.insert([]plugin.Message{
+		{Payload: []byte(`{"measurement":"env","tags":{"device":"d1"},"fields":{"temperature":21.5},"timestamp":"2023-11-14T22:13:20Z"}`)},
+		{Payload: []byte(`garbage`)},
+		{Payload: []byte(`{"measurement":"env","fields":{"humidity":40}}`), Time: buffered},
+	})
+	if err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+	wantQuery := `INSERT INTO "public"."readings" ("time", "measurement", "tags", "device_id", "temp_c") VALUES ($1, $2, $3, $4, $5), ($6, $7, $8, $9, $10) ON CONFLICT ("time", "device_id") DO NOTHING`
+	if query != wantQuery {
+		t.Fatalf("query =\n%s\nwant\n%s", query, wantQuery)
+	}
+	wantArgs := []interface{}{
+		time.Unix(1700000000, 0).UTC(), "env", `{"device":"d1"}`, "d1", 21.5,
+		buffered, "env", `null`, nil, nil,
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Fatalf("args = %#v\nwant %#v", args, wantArgs)
+	}
+
+	if _, _, err := s.insert([]plugin.Message{{Payload: []byte(`x`)}}); err == nil {
+		t.Fatalf("expected error for batch without readings")
+	}
+}
+
+func TestConflictColumnsRequired(t *testing.T) {
+	if _, err := newSink(Config{Mapping: Mapping{Table: "t", TimeColumn: "time", FieldsColumn: "fields"}}); err == nil {
+		t.Fatalf("expected error without conflict columns")
+	}
+}
+
+func TestBatchSizeRespectsParameterLimit(t *testing.T) {
+	s, err := newSink(Config{BatchSize: 100000, Mapping: Mapping{Table: "t", TimeColumn: "time", FieldsColumn: "fields", ConflictColumns: []string{"time"}}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if s.BatchSize()*2 > maxParams {
+		t.Fatalf("batch size %d exceeds parameter limit", s.BatchSize())
+	}
+}
+
+func TestRejectedRowsAreDropped(t *testing.T) {
+	fake.reset()
+	s, err := newSink(Config{Mapping: Mapping{
+		Table:           "readings",
+		TimeColumn:      "time",
+		Tags:            map[string]string{"device": "device_id"},
+		Fields:          map[string]string{"value": "value"},
+		ConflictColumns: []string{"time", "device_id"},
+	}})
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if s.db, err = sql.Open("fakepg", ""); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+
+	var msgs []plugin.Message
+	for _, d := range []string{"d1", "bad", "d2", "d3", "d4", "bad", "d5"} {
+		msgs = append(msgs, plugin.Message{Payload: []byte(`{"measurement":"m","tags":{"device":"` + d + `"},"fields":{"value":1}}`), Time: time.Now()})
+	}
+	if err := s.ProduceBatch(msgs, time.Second); err != nil {
+		t.Fatalf("produce: %v", err)
+	}
+	if want := []string{"d1", "d2", "d3", "d4", "d5"}; !reflect.DeepEqual(fake.inserted, want) {
+		t.Fatalf("inserted %v, want %v", fake.inserted, want)
+	}
+
+	if err := s.ProduceBatch(msgs[1:2], time.Second); !plugin.IsPermanent(err) {
+		t.Fatalf("expected a permanent error for a rejected reading, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/your-username/iot-edge-gateway/internal/topic"
+)
+
+// Message is a unit of data travelling from an input towards the buffer.
+// Topic is the MQTT topic or, for other inputs, the virtual topic assigned by
+// the input's configuration.
+type Message struct {
+	Topic   string
+	Payload []byte
+	// Priority orders delivery from the buffer; see plugin.ParsePriority.
+	Priority int
+}
+
+// PriorityRule sets the priority of the messages it matches. The conditions
+// that are set must all hold: Match is an MQTT-style filter on the topic and
+// Field a dot-separated path into the JSON payload whose value must equal
+// Value, or only exist when Value is empty.
+type PriorityRule struct {
+	Match    string
+	Field    string
+	Value    string
+	Priority int
+}
+
+// Processor applies filtering, aggregation and enrichment rules to incoming
+// messages before they are buffered.
+type Processor struct {
+	priorities []PriorityRule
+}
+
+// New creates a processor without rules, so messages pass through unchanged
+// until rules are set.
+func New() *Processor {
+	return &Processor{}
+}
+
+// SetPriorityRules sets the rules that assign priorities. The first rule that
+// matches a message wins; messages no rule matches keep the priority their
+// input gave them. Rules must be set before the processor is used.
+func (p *Processor) SetPriorityRules(rules []PriorityRule) error {
+	for i, r := range rules {
+		if r.Match == "" && r.Field == "" {
+			return fmt.Errorf("priority rule %d: match or field required", i)
+		}
+	}
+	p.priorities = rules
+	return nil
+}
+
+// Process applies the configured rules to msg and returns the messages that
+// should be buffered. An empty result means the message was dropped.
+func (p *Processor) Process(msg Message) ([]Message, error) {
+	if len(msg.Payload) == 0 {
+		return nil, nil
+	}
+	if prio, ok := p.priority(msg); ok {
+		msg.Priority = prio
+	}
+	return []Message{msg}, nil
+}
+
+func (p *Processor) priority(msg Message) (int, bool) {
+	var doc map[string]interface{}
+	parsed := false
+	for _, r := range p.priorities {
+		if r.Match != "" && !topic.Match(r.Match, msg.Topic) {
+			continue
+		}
+		if r.Field != "" {
+			if !parsed {
+				parsed = true
+				_ = json.Unmarshal(msg.Payload, &doc)
+			}
+			v, ok := lookup(doc, r.Field)
+			if !ok || (r.Value != "" && v != r.Value) {
+				continue
+			}
+		}
+		return r.Priority, true
+	}
+	return 0, false
+}
+
+// lookup returns the scalar at a dot-separated path as a string.
+func lookup(doc map[string]interface{}, path string) (string, bool) {
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if cur, ok = m[key]; !ok {
+			return "", false
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
@@ -5,3 +5,37 @@ import "testing"
 func TestPlaceholder(t *testing.T) {
     // Placeholder test; implement logic tests here.
 }
+
+func TestPriorityRules(t *testing.T) {
+    p := New()
+    err := p.SetPriorityRules([]PriorityRule{
+        {Match: "sensors/+/alarm", Priority: 1},
+        {Field: "tags.class", Value: "bulk", Priority: -1},
+    })
+    if err != nil {
+        t.Fatalf("SetPriorityRules: %v", err)
+    }
+    cases := []struct {
+        msg  Message
+        want int
+    }{
+        {Message{Topic: "sensors/boiler/alarm", Payload: []byte(`{}`)}, 1},
+        {Message{Topic: "sensors/boiler", Payload: []byte(`{"tags":{"class":"bulk"}}`)}, -1},
+        // no rule matches: the input's priority is kept
+        {Message{Topic: "sensors/boiler", Payload: []byte(`{"tags":{"class":"ops"}}`), Priority: 5}, 5},
+        {Message{Topic: "sensors/boiler", Payload: []byte(`not json`)}, 0},
+    }
+    for _, c := range cases {
+        out, err := p.Process(c.msg)
+        if err != nil || len(out) != 1 {
+            t.Fatalf("Process(%s) = %v, %v", c.msg.Topic, out, err)
+        }
+        if out[0].Priority != c.want {
+            t.Fatalf("Process(%s, %s) priority = %d, want %d", c.msg.Topic, c.msg.Payload, out[0].Priority, c.want)
+        }
+    }
+
+    if err := p.SetPriorityRules([]PriorityRule{{Priority: 1}}); err == nil {
+        t.Fatalf("expected a rule without conditions to be rejected")
+    }
+}
@@ -0,0 +1,37 @@
+package reading
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Reading is the gateway's internal model for a set of measured values taken
+// at one point in time. Inputs that decode binary or text protocols produce
+// readings and submit them as JSON.
+type Reading struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags,omitempty"`
+	Fields      map[string]interface{} `json:"fields"`
+	Timestamp   time.Time              `json:"timestamp"`
+}
+
+// Marshal encodes the reading as JSON.
+func (r Reading) Marshal() ([]byte, error) {
+	if len(r.Fields) == 0 {
+		return nil, fmt.Errorf("reading %q has no fields", r.Measurement)
+	}
+	return json.Marshal(r)
+}
+
+// Parse decodes a JSON reading produced by Marshal.
+func Parse(b []byte) (Reading, error) {
+	var r Reading
+	if err := json.Unmarshal(b, &r); err != nil {
+		return Reading{}, err
+	}
+	if r.Measurement == "" || len(r.Fields) == 0 {
+		return Reading{}, fmt.Errorf("not a reading")
+	}
+	return r, nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+    "fmt"
+    "path/filepath"
+    "time"
+
+    "github.com/your-username/iot-edge-gateway/internal/buffer"
+    "github.com/your-username/iot-edge-gateway/internal/config"
+    "github.com/your-username/iot-edge-gateway/internal/keyring"
+    "github.com/your-username/iot-edge-gateway/internal/processor"
+    "github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// openBuffer opens the configured buffer backend and, when buffer.memory is
+// enabled, puts an in-memory ring in front of it.
+func openBuffer(cfg *config.Config) (buffer.Buffer, error) {
+    disk, err := OpenDiskBuffer(cfg)
+    if err != nil {
+        return nil, err
+    }
+    if cfg == nil {
+        return disk, nil
+    }
+    mem, ok := cfg.Buffer["memory"].(map[string]interface{})
+    if !ok {
+        return disk, nil
+    }
+    if enabled, _ := mem["enabled"].(bool); !enabled {
+        return disk, nil
+    }
+    var ho buffer.HybridOptions
+    ho.Mode, _ = mem["mode"].(string)
+    if v, ok := mem["max_messages"].(int); ok {
+        ho.MaxMessages = v
+    }
+    if v, ok := mem["max_mb"].(int); ok && v > 0 {
+        ho.MaxBytes = int64(v) << 20
+    }
+    if v, ok := mem["spill_after_seconds"].(int); ok && v > 0 {
+        ho.SpillAfter = time.Duration(v) * time.Second
+    }
+    h, err := buffer.NewHybrid(disk, ho)
+    if err != nil {
+        disk.Close()
+        return nil, err
+    }
+    return h, nil
+}
+
+// OpenDiskBuffer opens the buffer backend selected by buffer.backend:
+// "sqlite" (the default) or "segment", an append-only segment log for flash
+// storage that wears under SQLite's write pattern. Compression and encryption
+// are only supported by the SQLite backend.
+// The export and import commands use it to reach the buffered data without
+// the in-memory ring.
+func OpenDiskBuffer(cfg *config.Config) (buffer.Buffer, error) {
+    opts := map[string]interface{}{}
+    if cfg != nil && cfg.Buffer != nil {
+        opts = cfg.Buffer
+    }
+    backend, _ := opts["backend"].(string)
+    bufPath := ""
+    if v, ok := opts["path"]; ok {
+        bufPath = fmt.Sprint(v)
+    }
+    kr, err := bufferKeyring(cfg)
+    if err != nil {
+        return nil, fmt.Errorf("buffer encryption: %w", err)
+    }
+    codec, _ := opts["compression"].(string)
+    if codec == "none" {
+        codec = buffer.CodecNone
+    }
+
+    switch backend {
+    case "", "sqlite":
+        if bufPath == "" {
+            bufPath = "./data/buffer.db"
+        }
+        store, err := buffer.Init(bufPath)
+        if err != nil {
+            return nil, fmt.Errorf("buffer init: %w", err)
+        }
+        if err := store.SetCodec(codec); err != nil {
+            store.Close()
+            return nil, fmt.Errorf("buffer compression: %w", err)
+        }
+        if err := store.SetKeyring(kr); err != nil {
+            store.Close()
+            return nil, fmt.Errorf("buffer encryption: %w", err)
+        }
+        if v, ok := opts["group_commit_ms"].(int); ok {
+            store.SetGroupCommit(time.Duration(v) * time.Millisecond)
+        }
+        return store, nil
+    case "segment":
+        if codec != buffer.CodecNone || kr != nil {
+            return nil, fmt.Errorf("buffer: compression and encryption need the sqlite backend")
+        }
+        if bufPath == "" {
+            bufPath = "./data/buffer"
+        }
+        if filepath.Ext(bufPath) == ".db" {
+            return nil, fmt.Errorf("buffer: the segment backend needs a directory as path, not %s", bufPath)
+        }
+        var so buffer.SegmentOptions
+        if v, ok := opts["segment_mb"].(int); ok && v > 0 {
+            so.SegmentBytes = int64(v) << 20
+        }
+        if v, ok := opts["sync_interval_ms"].(int); ok && v > 0 {
+            so.SyncInterval = time.Duration(v) * time.Millisecond
+        }
+        l, err := buffer.OpenSegmentLog(bufPath, so)
+        if err != nil {
+            return nil, fmt.Errorf("buffer init: %w", err)
+        }
+        return l, nil
+    default:
+        return nil, fmt.Errorf("buffer: unknown backend %q", backend)
+    }
+}
+
+// bufferKeyring loads the buffer encryption keys from the file or environment
+// variable named in buffer.encryption. It returns nil when encryption is not
+// configured.
+func bufferKeyring(cfg *config.Config) (keyring.Keyring, error) {
+    if cfg == nil || cfg.Buffer == nil {
+        return nil, nil
+    }
+    enc, ok := cfg.Buffer["encryption"].(map[string]interface{})
+    if !ok {
+        return nil, nil
+    }
+    keyFile, _ := enc["key_file"].(string)
+    keyEnv, _ := enc["key_env"].(string)
+    switch {
+    case keyFile != "" && keyEnv != "":
+        return nil, fmt.Errorf("set key_file or key_env, not both")
+    case keyFile != "":
+        return keyring.FromFile(keyFile)
+    case keyEnv != "":
+        return keyring.FromEnv(keyEnv)
+    }
+    return nil, nil
+}
+
+// priorityRules reads processing.priorities, a list of rules with match,
+// field, value and priority keys.
+func priorityRules(cfg *config.Config) ([]processor.PriorityRule, error) {
+    if cfg == nil {
+        return nil, nil
+    }
+    entries, _ := cfg.Processing["priorities"].([]interface{})
+    rules := make([]processor.PriorityRule, 0, len(entries))
+    for i, e := range entries {
+        m, ok := e.(map[string]interface{})
+        if !ok {
+            return nil, fmt.Errorf("rule %d: not a map", i)
+        }
+        var rc struct {
+            Match    string `mapstructure:"match"`
+            Field    string `mapstructure:"field"`
+            Value    string `mapstructure:"value"`
+            Priority string `mapstructure:"priority"`
+        }
+        if err := plugin.Config(m).Decode(&rc); err != nil {
+            return nil, fmt.Errorf("rule %d: %w", i, err)
+        }
+        prio, err := plugin.ParsePriority(rc.Priority)
+        if err != nil {
+            return nil, fmt.Errorf("rule %d: %w", i, err)
+        }
+        rules = append(rules, processor.PriorityRule{Match: rc.Match, Field: rc.Field, Value: rc.Value, Priority: prio})
+    }
+    return rules, nil
+}
+
+// overflowPolicy reads buffer.overflow, which maps priorities to "reject"
+// (the default) or "drop_oldest", and returns the priorities to evict from.
+func overflowPolicy(cfg *config.Config) ([]int, error) {
+    if cfg == nil {
+        return nil, nil
+    }
+    policies, _ := cfg.Buffer["overflow"].(map[string]interface{})
+    var evictable []int
+    for name, v := range policies {
+        prio, err := plugin.ParsePriority(name)
+        if err != nil {
+            return nil, err
+        }
+        switch v {
+        case "reject":
+        case "drop_oldest":
+            evictable = append(evictable, prio)
+        default:
+            return nil, fmt.Errorf("priority %s: unknown policy %v", name, v)
+        }
+    }
+    return evictable, nil
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/your-username/iot-edge-gateway/internal/archive"
+    "github.com/your-username/iot-edge-gateway/internal/coap"
+    "github.com/your-username/iot-edge-gateway/internal/config"
+    "github.com/your-username/iot-edge-gateway/internal/httpingest"
+    "github.com/your-username/iot-edge-gateway/internal/httpsink"
+    "github.com/your-username/iot-edge-gateway/internal/influx"
+    "github.com/your-username/iot-edge-gateway/internal/kafka"
+    "github.com/your-username/iot-edge-gateway/internal/lineproto"
+    "github.com/your-username/iot-edge-gateway/internal/modbus"
+    "github.com/your-username/iot-edge-gateway/internal/mqtt"
+    "github.com/your-username/iot-edge-gateway/internal/postgres"
+    "github.com/your-username/iot-edge-gateway/pkg/plugin"
+)
+
+// Built-in input and output types. Each factory decodes its entry into the
+// matching schema from the config package.
+func init() {
+    plugin.RegisterSource("mqtt", newMQTTSource)
+    plugin.RegisterSource("http", newHTTPSource)
+    plugin.RegisterSource("coap", newCoAPSource)
+    plugin.RegisterSource("modbus", newModbusSource)
+    plugin.RegisterSource("line_protocol", newLineProtoSource)
+    plugin.RegisterSink("kafka", newKafkaSink)
+    plugin.RegisterSink("mqtt", newMQTTSink)
+    plugin.RegisterSink("http", newHTTPSink)
+    plugin.RegisterSink("influxdb", newInfluxSink)
+    plugin.RegisterSink("postgres", newPostgresSink)
+    plugin.RegisterSink("s3", newArchiveSink)
+}
+
+func newMQTTSource(c plugin.Config, in plugin.Ingester) (plugin.Source, error) {
+    var mc config.MQTTConfig
+    if err := c.Decode(&mc); err != nil {
+        return nil, err
+    }
+    if mc.Topic == "" {
+        mc.Topic = "sensors/#"
+    }
+    if _, ok := c["qos"]; !ok {
+        mc.QoS = 1
+    }
+    prio, err := plugin.ParsePriority(mc.Priority)
+    if err != nil {
+        return nil, err
+    }
+    cl, err := mqtt.New(mc.Broker, mc.ClientID, mc.Topic, byte(mc.QoS), in)
+    if err != nil {
+        return nil, err
+    }
+    cl.SetPriority(prio)
+    return cl, nil
+}
+
+func newHTTPSource(c plugin.Config, in plugin.Ingester) (plugin.Source, error) {
+    var hc config.HTTPIngestConfig
+    if err := c.Decode(&hc); err != nil {
+        return nil, err
+    }
+    routes := make([]httpingest.Route, 0, len(hc.Routes))
+    for _, r := range hc.Routes {
+        routes = append(routes, httpingest.Route{Path: r.Path, Topic: r.Topic})
+    }
+    auth := httpingest.Auth{
+        Type:   hc.Auth.Type,
+        Token:  hc.Auth.Token,
+        Secret: hc.Auth.Secret,
+        Header: hc.Auth.Header,
+    }
+    return httpingest.New(hc.Addr, routes, auth, hc.MaxBodyBytes, in)
+}
+
+func newCoAPSource(c plugin.Config, in plugin.Ingester) (plugin.Source, error) {
+    var cc config.CoAPConfig
+    if err := c.Decode(&cc); err != nil {
+        return nil, err
+    }
+    resources := make([]coap.Resource, 0, len(cc.Resources))
+    for _, r := range cc.Resources {
+        resources = append(resources, coap.Resource{Path: r.Path, Topic: r.Topic})
+    }
+    return coap.New(cc.Addr, resources, cc.MaxPayloadBytes, in)
+}
+
+func newModbusSource(c plugin.Config, in plugin.Ingester) (plugin.Source, error) {
+    var d config.ModbusDevice
+    if err := c.Decode(&d); err != nil {
+        return nil, err
+    }
+    dev := modbus.Device{
+        Name:     d.Name,
+        Address:  d.Address,
+        UnitID:   byte(d.UnitID),
+        Interval: time.Duration(d.PollIntervalMs) * time.Millisecond,
+        Timeout:  time.Duration(d.TimeoutMs) * time.Millisecond,
+        Topic:    d.Topic,
+        MaxGap:   d.MaxGap,
+    }
+    for _, r := range d.Registers {
+        dev.Registers = append(dev.Registers, modbus.Register{
+            Name:      r.Name,
+            Table:     r.Table,
+            Address:   uint16(r.Address),
+            Type:      r.Type,
+            ByteOrder: r.ByteOrder,
+            WordOrder: r.WordOrder,
+            Scale:     r.Scale,
+            Offset:    r.Offset,
+        })
+    }
+    return modbus.NewPoller(dev, in)
+}
+
+func newLineProtoSource(c plugin.Config, in plugin.Ingester) (plugin.Source, error) {
+    var lc config.LineProtoListener
+    if err := c.Decode(&lc); err != nil {
+        return nil, err
+    }
+    return lineproto.New(lc.Format, lc.Transport, lc.Addr, lc.TopicPrefix, lc.Precision, in)
+}
+
+func newKafkaSink(c plugin.Config) (plugin.Sink, error) {
+    var kc config.KafkaConfig
+    if err := c.Decode(&kc); err != nil {
+        return nil, err
+    }
+    if len(kc.Brokers) == 0 {
+        return nil, fmt.Errorf("kafka brokers required")
+    }
+    if kc.Topic == "" {
+        kc.Topic = "iot-sensor-data"
+    }
+    routes := make([]kafka.Route, 0, len(kc.Routes))
+    for _, r := range kc.Routes {
+        routes = append(routes, kafka.Route{Match: r.Match, Field: r.Field, Value: r.Value, Topic: r.Topic})
+    }
+    // validate the routes before connecting
+    if _, err := kafka.NewRouter(routes, kc.Topic); err != nil {
+        return nil, err
+    }
+    if kc.Envelope.Enabled && kc.Envelope.Size <= 0 {
+        kc.Envelope.Size = kafka.DefaultBatchSize
+    }
+    if kc.Envelope.Enabled && kc.Envelope.SeqFile == "" {
+        kc.Envelope.SeqFile = "./data/kafka-" + c.Name() + ".seq"
+    }
+    p, err := kafka.NewProducer(strings.Join(kc.Brokers, ","), kc.Topic, kc.ClientID, kc.Compression)
+    if err != nil {
+        return nil, err
+    }
+    if err := p.SetRoutes(routes); err != nil {
+        p.Close()
+        return nil, err
+    }
+    if kc.Envelope.Enabled {
+        if err := p.SetEnvelope(kafka.Envelope{GatewayID: kc.Envelope.GatewayID, Size: kc.Envelope.Size, SeqFile: kc.Envelope.SeqFile}); err != nil {
+            p.Close()
+            return nil, err
+        }
+    }
+    return p, nil
+}
+
+func newMQTTSink(c plugin.Config) (plugin.Sink, error) {
+    var bc config.MQTTBridgeConfig
+    if err := c.Decode(&bc); err != nil {
+        return nil, err
+    }
+    if _, ok := c["qos"]; !ok {
+        bc.QoS = 1
+    }
+    if bc.DefaultTopic == "" {
+        bc.DefaultTopic = "iot-sensor-data"
+    }
+    cfg := mqtt.BridgeConfig{
+        Broker:       bc.Broker,
+        ClientID:     bc.ClientID,
+        Username:     bc.Username,
+        Password:     bc.Password,
+        QoS:          byte(bc.QoS),
+        Retain:       bc.Retain,
+        TopicPrefix:  bc.TopicPrefix,
+        DefaultTopic: bc.DefaultTopic,
+        BatchSize:    bc.BatchSize,
+    }
+    for _, m := range bc.Mappings {
+        cfg.Mappings = append(cfg.Mappings, mqtt.TopicMapping{Match: m.Match, Topic: m.Topic})
+    }
+    if bc.TLS != nil {
+        cfg.TLS = &mqtt.TLSConfig{
+            CAFile:             bc.TLS.CAFile,
+            CertFile:           bc.TLS.CertFile,
+            KeyFile:            bc.TLS.KeyFile,
+            ServerName:         bc.TLS.ServerName,
+            InsecureSkipVerify: bc.TLS.InsecureSkipVerify,
+        }
+    }
+    return mqtt.NewBridge(cfg)
+}
+
+func newHTTPSink(c plugin.Config) (plugin.Sink, error) {
+    var hc config.HTTPSinkConfig
+    if err := c.Decode(&hc); err != nil {
+        return nil, err
+    }
+    return httpsink.New(httpsink.Config{
+        URL:       hc.URL,
+        Method:    hc.Method,
+        Format:    hc.Format,
+        BatchSize: hc.BatchSize,
+        Gzip:      hc.Gzip,
+        Headers:   hc.Headers,
+        Auth: httpsink.Auth{
+            Type:     hc.Auth.Type,
+            Token:    hc.Auth.Token,
+            Username: hc.Auth.Username,
+            Password: hc.Auth.Password,
+            Secret:   hc.Auth.Secret,
+            Header:   hc.Auth.Header,
+        },
+    })
+}
+
+func newInfluxSink(c plugin.Config) (plugin.Sink, error) {
+    var ic config.InfluxConfig
+    if err := c.Decode(&ic); err != nil {
+        return nil, err
+    }
+    return influx.New(influx.Config{
+        URL:       ic.URL,
+        Org:       ic.Org,
+        Bucket:    ic.Bucket,
+        Token:     ic.Token,
+        Precision: ic.Precision,
+        BatchSize: ic.BatchSize,
+        Gzip:      ic.Gzip,
+    })
+}
+
+func newPostgresSink(c plugin.Config) (plugin.Sink, error) {
+    var pc config.PostgresConfig
+    if err := c.Decode(&pc); err != nil {
+        return nil, err
+    }
+    if pc.TimeColumn == "" {
+        pc.TimeColumn = "time"
+    }
+    return postgres.New(postgres.Config{
+        DSN:       pc.DSN,
+        BatchSize: pc.BatchSize,
+        Mapping: postgres.Mapping{
+            Table:             pc.Table,
+            TimeColumn:        pc.TimeColumn,
+            MeasurementColumn: pc.MeasurementColumn,
+            TagsColumn:        pc.TagsColumn,
+            FieldsColumn:      pc.FieldsColumn,
+            Tags:              pc.Tags,
+            Fields:            pc.Fields,
+            ConflictColumns:   pc.ConflictColumns,
+        },
+    })
+}
+
+func newArchiveSink(c plugin.Config) (plugin.Sink, error) {
+    var ac config.ArchiveConfig
+    if err := c.Decode(&ac); err != nil {
+        return nil, err
+    }
+    return archive.New(archive.Config{
+        Endpoint:      ac.Endpoint,
+        Region:        ac.Region,
+        Bucket:        ac.Bucket,
+        AccessKey:     ac.AccessKey,
+        SecretKey:     ac.SecretKey,
+        Prefix:        ac.Prefix,
+        SpoolDir:      ac.SpoolDir,
+        MaxFileBytes:  int64(ac.MaxFileMB) << 20,
+        MaxMessages:   ac.MaxMessages,
+        MaxAge:        ac.MaxAge,
+        PartSize:      int64(ac.PartSizeMB) << 20,
+        UploadTimeout: ac.UploadTimeout,
+    })
+}
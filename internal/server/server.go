@@ -2,18 +2,22 @@ package server
 
 import (
     "context"
+    "encoding/json"
     "fmt"
     "net/http"
+    "sync"
     "time"
 
     "github.com/prometheus/client_golang/prometheus/promhttp"
     "github.com/your-username/iot-edge-gateway/internal/config"
     "github.com/your-username/iot-edge-gateway/internal/logger"
+    "github.com/your-username/iot-edge-gateway/internal/backoff"
     "github.com/your-username/iot-edge-gateway/internal/buffer"
-    "github.com/your-username/iot-edge-gateway/internal/mqtt"
-    "github.com/your-username/iot-edge-gateway/internal/kafka"
     "github.com/your-username/iot-edge-gateway/internal/forwarder"
     "github.com/your-username/iot-edge-gateway/internal/metrics"
+    "github.com/your-username/iot-edge-gateway/internal/pipeline"
+    "github.com/your-username/iot-edge-gateway/internal/processor"
+    "github.com/your-username/iot-edge-gateway/pkg/plugin"
 )
 
 type Server struct {
@@ -22,13 +26,21 @@ type Server struct {
     ctx context.Context
     cancel context.CancelFunc
 
-    store      *buffer.Store
-    mqttClient *mqtt.Client
-    producer   *kafka.Producer
-    fwd        *forwarder.Forwarder
+    store    buffer.Buffer
+    pipeline *pipeline.Pipeline
+    sources  []plugin.Source
+    sinks    []plugin.Sink
+    fwds     []*forwarder.Forwarder
+    bg       sync.WaitGroup
 }
 
-// New initializes the server, metrics endpoint and components (buffer, mqtt, kafka, forwarder).
+// compactInterval is how often uncompressed buffer rows are compacted when
+// buffer compression is on.
+const compactInterval = time.Minute
+
+// New initializes the server, metrics endpoint and components: the buffer,
+// the processing pipeline, the configured outputs with one forwarder each and
+// the configured inputs.
 func New(cfg *config.Config) (*Server, error) {
     ctx, cancel := context.WithCancel(context.Background())
     s := &Server{
@@ -42,6 +54,7 @@ func New(cfg *config.Config) (*Server, error) {
 
     mux := http.NewServeMux()
     mux.Handle("/metrics", promhttp.Handler())
+    mux.HandleFunc("/status", s.handleStatus)
     addr := cfg.Server.MetricsAddr
     s.http = &http.Server{
         Addr:    addr,
@@ -49,97 +62,103 @@ func New(cfg *config.Config) (*Server, error) {
     }
 
     // Initialize buffer store
-    bufPath := ""
-    if cfg != nil && cfg.Buffer != nil {
-        if v, ok := cfg.Buffer["path"]; ok {
-            bufPath = fmt.Sprint(v)
-        }
-    }
-    if bufPath == "" {
-        bufPath = "./data/buffer.db"
-    }
-    store, err := buffer.Init(bufPath)
+    store, err := openBuffer(cfg)
     if err != nil {
-        return nil, fmt.Errorf("buffer init: %w", err)
+        return nil, err
     }
     s.store = store
 
-    // Initialize Kafka producer (simple handling - expects brokers string or list)
-    var brokers string
-    if cfg != nil && cfg.Kafka != nil {
-        if v, ok := cfg.Kafka["brokers"]; ok {
-            // Try to handle slice or string
-            switch vv := v.(type) {
-            case []interface{}:
-                for i, item := range vv {
-                    if i > 0 {
-                        brokers += ","
-                    }
-                    brokers += fmt.Sprint(item)
-                }
-            default:
-                brokers = fmt.Sprint(v)
+    // All inputs share one pipeline: processor first, then the buffer.
+    var maxBytes int64
+    if cfg != nil && cfg.Buffer != nil {
+        if v, ok := cfg.Buffer["max_size_mb"]; ok {
+            if mv, ok := v.(int); ok && mv > 0 {
+                maxBytes = int64(mv) << 20
             }
         }
     }
-    topic := "iot-sensor-data"
-    if cfg != nil && cfg.Kafka != nil {
-        if v, ok := cfg.Kafka["topic"]; ok {
-            topic = fmt.Sprint(v)
-        }
+    proc := processor.New()
+    rules, err := priorityRules(cfg)
+    if err == nil {
+        err = proc.SetPriorityRules(rules)
     }
-    clientID := ""
-    if cfg != nil && cfg.Kafka != nil {
-        if v, ok := cfg.Kafka["client_id"]; ok {
-            clientID = fmt.Sprint(v)
-        }
+    if err != nil {
+        s.close()
+        return nil, fmt.Errorf("processing.priorities: %w", err)
     }
+    s.pipeline = pipeline.New(s.store, proc, maxBytes)
+    evictable, err := overflowPolicy(cfg)
+    if err != nil {
+        s.close()
+        return nil, fmt.Errorf("buffer.overflow: %w", err)
+    }
+    if (len(rules) > 0 || len(evictable) > 0) && cfg.Buffer["backend"] == "segment" {
+        s.close()
+        return nil, fmt.Errorf("buffer: priorities and overflow eviction need the sqlite backend")
+    }
+    s.pipeline.SetEvictable(evictable)
 
-    if brokers != "" {
-        prod, err := kafka.NewProducer(brokers, topic, clientID)
+    // Initialize outputs. Each output is tracked under its name in the buffer,
+    // so names must be unique.
+    names := make([]string, 0, len(cfg.Outputs))
+    workers := make([]int, 0, len(cfg.Outputs))
+    retries := make([]config.RetryConfig, 0, len(cfg.Outputs))
+    circuits := make([]config.CircuitConfig, 0, len(cfg.Outputs))
+    seen := make(map[string]bool)
+    for _, oc := range cfg.Outputs {
+        name := plugin.Config(oc).Name()
+        if seen[name] {
+            s.close()
+            return nil, fmt.Errorf("output %s: duplicate name; set a unique \"name\"", name)
+        }
+        seen[name] = true
+        sink, err := plugin.NewSink(plugin.Config(oc))
         if err != nil {
-            s.store.Close()
-            return nil, fmt.Errorf("kafka producer init: %w", err)
+            s.close()
+            return nil, fmt.Errorf("output %s: %w", name, err)
         }
-        s.producer = prod
-    } else {
-        // No brokers configured - producer will be nil and forwarder will be a no-op
-        fmt.Println("kafka brokers not configured; forwarder will be disabled")
-    }
-
-    // Initialize MQTT client if broker is configured
-    mqttBroker := ""
-    mqttTopic := ""
-    mqttClientID := ""
-    if cfg != nil && cfg.MQTT != nil {
-        if v, ok := cfg.MQTT["broker"]; ok {
-            mqttBroker = fmt.Sprint(v)
+        var fc struct {
+            Workers int                `mapstructure:"workers"`
+            Retry   config.RetryConfig   `mapstructure:"retry"`
+            Circuit config.CircuitConfig `mapstructure:"circuit"`
         }
-        if v, ok := cfg.MQTT["topic"]; ok {
-            mqttTopic = fmt.Sprint(v)
+        err = plugin.Config(oc).Decode(&fc)
+        if err == nil {
+            _, err = retryPolicy(fc.Retry)
         }
-        if v, ok := cfg.MQTT["client_id"]; ok {
-            mqttClientID = fmt.Sprint(v)
+        if err != nil {
+            s.close()
+            return nil, fmt.Errorf("output %s: %w", name, err)
         }
+        s.sinks = append(s.sinks, sink)
+        names = append(names, name)
+        workers = append(workers, fc.Workers)
+        retries = append(retries, fc.Retry)
+        circuits = append(circuits, fc.Circuit)
     }
-    if mqttTopic == "" {
-        mqttTopic = "sensors/#"
+    if err := s.store.SetSinks(names); err != nil {
+        s.close()
+        return nil, fmt.Errorf("buffer sinks: %w", err)
     }
-    if mqttBroker != "" {
-        mc, err := mqtt.New(mqttBroker, mqttClientID, mqttTopic, 1, s.store)
+    if len(s.sinks) == 0 {
+        // No output configured - forwarder stays disabled and data accumulates in the buffer
+        fmt.Println("no outputs configured; forwarder will be disabled")
+    }
+
+    // Initialize inputs
+    for _, ic := range cfg.Inputs {
+        src, err := plugin.NewSource(plugin.Config(ic), s.pipeline)
         if err != nil {
-            if s.producer != nil {
-                s.producer.Close()
-            }
-            s.store.Close()
-            return nil, fmt.Errorf("mqtt client init: %w", err)
+            s.close()
+            return nil, fmt.Errorf("input %s: %w", plugin.Config(ic).Name(), err)
         }
-        s.mqttClient = mc
-    } else {
-        fmt.Println("mqtt broker not configured; mqtt consumer disabled")
+        s.sources = append(s.sources, src)
+    }
+    if len(s.sources) == 0 {
+        fmt.Println("no inputs configured; nothing will be ingested")
     }
 
-    // Create forwarder only if producer exists
+    // One forwarder per sink, each draining its own pending messages
     flushInterval := 30 * time.Second
     if cfg != nil && cfg.Buffer != nil {
         if v, ok := cfg.Buffer["flush_interval_seconds"]; ok {
@@ -148,9 +167,35 @@ func New(cfg *config.Config) (*Server, error) {
             }
         }
     }
-    if s.producer != nil {
-        fwd := forwarder.New(s.store, s.producer, flushInterval, 3, 5*time.Second)
-        s.fwd = fwd
+    for i, sink := range s.sinks {
+        rc := retries[i]
+        maxRetries, timeout := 3, 5*time.Second
+        if rc.MaxRetries != nil {
+            maxRetries = *rc.MaxRetries
+        }
+        if rc.AttemptTimeout > 0 {
+            timeout = rc.AttemptTimeout
+        }
+        policy, _ := retryPolicy(rc)
+        fwd := forwarder.NewForSink(names[i], s.store, sink, flushInterval, maxRetries, timeout)
+        fwd.SetWorkers(workers[i])
+        fwd.SetBackoff(policy)
+        failures := forwarder.DefaultBreakerFailures
+        if c := circuits[i].Failures; c != nil {
+            failures = *c
+        }
+        fwd.SetBreaker(failures, circuits[i].OpenFor)
+        s.fwds = append(s.fwds, fwd)
+    }
+    if linger, threshold, ok := flushTrigger(cfg); ok {
+        for _, fwd := range s.fwds {
+            fwd.SetTrigger(linger, threshold)
+        }
+        s.pipeline.SetNotify(func(n, priority int) {
+            for _, fwd := range s.fwds {
+                fwd.Notify(n, priority)
+            }
+        })
     }
 
     return s, nil
@@ -164,13 +209,34 @@ func (s *Server) Start() error {
         }
     }()
 
-    // Start forwarder if configured
-    if s.fwd != nil {
-        s.fwd.Start()
-        logger.Sugar().Info("forwarder started")
+    disk := s.store
+    if h, ok := disk.(*buffer.Hybrid); ok {
+        disk = h.Disk()
+    }
+    if st, ok := disk.(*buffer.Store); ok {
+        if rec := st.Recovery(); rec != nil {
+            // running degraded: some buffered messages may be lost or sent twice
+            logger.Sugar().Warnf("buffer was recovered from a corrupt database (%s): %d message(s) recovered, up to %d lost; the damaged file is kept as %s",
+                rec.Problem, rec.Messages, rec.Unreadable, rec.SetAside)
+        }
+        if st.Codec() != buffer.CodecNone {
+            s.bg.Add(1)
+            go s.compactLoop(st)
+        }
+    }
+
+    for i, fwd := range s.fwds {
+        fwd.Start()
+        logger.Sugar().Infof("forwarder for output %s started", plugin.Config(s.cfg.Outputs[i]).Name())
+    }
+
+    for i, src := range s.sources {
+        if err := src.Start(); err != nil {
+            return fmt.Errorf("input %s: %w", plugin.Config(s.cfg.Inputs[i]).Name(), err)
+        }
+        logger.Sugar().Infof("input %s started", plugin.Config(s.cfg.Inputs[i]).Name())
     }
 
-    // MQTT client was subscribed in New(); nothing to start explicitly here.
     <-s.ctx.Done()
     return nil
 }
@@ -178,28 +244,127 @@ func (s *Server) Start() error {
 func (s *Server) Stop() {
     s.cancel()
 
-    // Stop forwarder first
-    if s.fwd != nil {
-        s.fwd.Stop()
+    // Stop forwarders first
+    for _, fwd := range s.fwds {
+        fwd.Stop()
     }
+    s.bg.Wait()
 
-    // Close MQTT client
-    if s.mqttClient != nil {
-        s.mqttClient.Close()
-    }
+    s.close()
 
-    // Close producer
-    if s.producer != nil {
-        s.producer.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    _ = s.http.Shutdown(ctx)
+    logger.Sugar().Info("server stopped")
+}
+
+// compactLoop compresses buffer rows stored uncompressed, such as those of a
+// buffer written before compression was turned on, and packs small messages
+// that pile up during an outage into blocks.
+func (s *Server) compactLoop(st *buffer.Store) {
+    defer s.bg.Done()
+    ticker := time.NewTicker(compactInterval)
+    defer ticker.Stop()
+    for {
+        for s.ctx.Err() == nil {
+            n, err := st.Compact(1000)
+            if err != nil {
+                logger.Sugar().Errorf("buffer compaction: %v", err)
+                break
+            }
+            if n == 0 {
+                break
+            }
+        }
+        select {
+        case <-s.ctx.Done():
+            return
+        case <-ticker.C:
+        }
     }
+}
 
-    // Close store
+// close releases inputs, outputs and the store, in that order, so nothing is
+// submitted to or read from the buffer once it is closed.
+func (s *Server) close() {
+    for _, src := range s.sources {
+        src.Close()
+    }
+    for _, sink := range s.sinks {
+        sink.Close()
+    }
     if s.store != nil {
         _ = s.store.Close()
     }
+}
 
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-    _ = s.http.Shutdown(ctx)
-    logger.Sugar().Info("server stopped")
+// handleStatus reports the state of each output as JSON: its circuit
+// breaker and the messages waiting for it.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+    type output struct {
+        Name    string `json:"name"`
+        Circuit string `json:"circuit"`
+        Pending int    `json:"pending"`
+    }
+    status := struct {
+        Outputs []output `json:"outputs"`
+    }{Outputs: []output{}}
+    for i, fwd := range s.fwds {
+        name := plugin.Config(s.cfg.Outputs[i]).Name()
+        o := output{Name: name, Circuit: fwd.Circuit().String()}
+        if n, err := s.store.CountPending(name); err == nil {
+            o.Pending = n
+        }
+        status.Outputs = append(status.Outputs, o)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(status); err != nil {
+        logger.Sugar().Warnf("writing status response: %v", err)
+    }
+}
+
+// flushTrigger reads buffer.flush_on_enqueue (default true),
+// buffer.flush_linger_ms and buffer.flush_threshold, which wake the outputs
+// when messages are buffered.
+func flushTrigger(cfg *config.Config) (time.Duration, int, bool) {
+    linger, threshold := forwarder.DefaultLinger, forwarder.DefaultThreshold
+    if cfg == nil || cfg.Buffer == nil {
+        return linger, threshold, true
+    }
+    if on, ok := cfg.Buffer["flush_on_enqueue"].(bool); ok && !on {
+        return 0, 0, false
+    }
+    if v, ok := cfg.Buffer["flush_linger_ms"].(int); ok && v >= 0 {
+        linger = time.Duration(v) * time.Millisecond
+    }
+    if v, ok := cfg.Buffer["flush_threshold"].(int); ok && v >= 0 {
+        threshold = v
+    }
+    return linger, threshold, true
+}
+
+// retryPolicy returns the backoff policy of an output's retry settings, with
+// defaults for the keys that are not set.
+func retryPolicy(rc config.RetryConfig) (backoff.Policy, error) {
+    p := backoff.DefaultPolicy()
+    if rc.Initial != 0 {
+        p.Initial = rc.Initial
+    }
+    if rc.Multiplier != 0 {
+        p.Multiplier = rc.Multiplier
+    }
+    if rc.Max != 0 {
+        p.Max = rc.Max
+    }
+    if rc.Jitter != nil {
+        p.Jitter = *rc.Jitter
+    }
+    p.MaxElapsed = rc.MaxElapsed
+    if rc.MaxRetries != nil && *rc.MaxRetries < 0 {
+        return p, fmt.Errorf("retry: max_retries must not be negative")
+    }
+    if err := p.Validate(); err != nil {
+        return p, fmt.Errorf("retry: %w", err)
+    }
+    return p, nil
 }
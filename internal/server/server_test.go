@@ -0,0 +1,73 @@
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    "github.com/your-username/iot-edge-gateway/internal/buffer"
+    "github.com/your-username/iot-edge-gateway/internal/config"
+    "github.com/your-username/iot-edge-gateway/internal/forwarder"
+)
+
+type statusSink struct{ err error }
+
+func (s *statusSink) Produce([]byte, time.Duration) error { return s.err }
+func (s *statusSink) Close()                              {}
+
+func TestStatusReportsCircuits(t *testing.T) {
+    store, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+    if err != nil {
+        t.Fatalf("buffer init: %v", err)
+    }
+    defer store.Close()
+    if err := store.SetSinks([]string{"up", "down"}); err != nil {
+        t.Fatalf("set sinks: %v", err)
+    }
+    if _, err := store.Enqueue([]byte(`{"t":1}`)); err != nil {
+        t.Fatalf("enqueue: %v", err)
+    }
+
+    s := &Server{
+        cfg:   &config.Config{Outputs: []map[string]interface{}{{"type": "http", "name": "up"}, {"type": "http", "name": "down"}}},
+        store: store,
+    }
+    for _, out := range []struct {
+        name string
+        err  error
+    }{{"up", nil}, {"down", errors.New("refused")}} {
+        fwd := forwarder.NewForSink(out.name, store, &statusSink{err: out.err}, time.Second, 0, time.Second)
+        fwd.SetBreaker(1, time.Minute)
+        fwd.FlushOnce()
+        s.fwds = append(s.fwds, fwd)
+    }
+
+    rec := httptest.NewRecorder()
+    s.handleStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+    if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+        t.Fatalf("status: %d %q", rec.Code, rec.Header().Get("Content-Type"))
+    }
+    var got struct {
+        Outputs []struct {
+            Name    string `json:"name"`
+            Circuit string `json:"circuit"`
+            Pending int    `json:"pending"`
+        } `json:"outputs"`
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+        t.Fatalf("decode %s: %v", rec.Body, err)
+    }
+    want := []struct {
+        Name    string `json:"name"`
+        Circuit string `json:"circuit"`
+        Pending int    `json:"pending"`
+    }{{"up", "closed", 0}, {"down", "open", 1}}
+    if !reflect.DeepEqual(got.Outputs, want) {
+        t.Fatalf("outputs = %+v, want %+v", got.Outputs, want)
+    }
+}
@@ -0,0 +1,225 @@
+package sparkplug
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Sparkplug B metric data types.
+const (
+	TypeInt8     uint32 = 1
+	TypeInt16    uint32 = 2
+	TypeInt32    uint32 = 3
+	TypeInt64    uint32 = 4
+	TypeUInt8    uint32 = 5
+	TypeUInt16   uint32 = 6
+	TypeUInt32   uint32 = 7
+	TypeUInt64   uint32 = 8
+	TypeFloat    uint32 = 9
+	TypeDouble   uint32 = 10
+	TypeBoolean  uint32 = 11
+	TypeString   uint32 = 12
+	TypeDateTime uint32 = 13
+	TypeText     uint32 = 14
+	TypeUUID     uint32 = 15
+	TypeBytes    uint32 = 17
+)
+
+// Payload is the subset of the Sparkplug B protobuf payload used by the gateway.
+type Payload struct {
+	Timestamp uint64
+	Seq       uint64
+	HasSeq    bool
+	Metrics   []Metric
+}
+
+// Metric is a single decoded Sparkplug B metric. Value holds the Go value
+// matching Datatype, or nil for null, dataset and template values.
+type Metric struct {
+	Name      string
+	Alias     uint64
+	HasAlias  bool
+	Timestamp uint64
+	Datatype  uint32
+	IsNull    bool
+	Value     interface{}
+}
+
+var errTruncated = errors.New("sparkplug: truncated payload")
+
+// DecodePayload decodes a Sparkplug B protobuf payload.
+func DecodePayload(b []byte) (*Payload, error) {
+	p := &Payload{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errTruncated
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, errTruncated
+			}
+			p.Timestamp, b = v, b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, errTruncated
+			}
+			m, err := decodeMetric(v)
+			if err != nil {
+				return nil, err
+			}
+			p.Metrics, b = append(p.Metrics, m), b[n:]
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, errTruncated
+			}
+			p.Seq, p.HasSeq, b = v, true, b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, errTruncated
+			}
+			b = b[n:]
+		}
+	}
+	return p, nil
+}
+
+func decodeMetric(b []byte) (Metric, error) {
+	var m Metric
+	var raw interface{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, errTruncated
+		}
+		b = b[n:]
+		var consumed int
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			consumed = n
+			switch num {
+			case 2:
+				m.Alias, m.HasAlias = v, true
+			case 3:
+				m.Timestamp = v
+			case 4:
+				m.Datatype = uint32(v)
+			case 7:
+				m.IsNull = v != 0
+			case 10, 11:
+				raw = v
+			case 14:
+				raw = v != 0
+			}
+		case protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			consumed = n
+			if num == 12 {
+				raw = math.Float32frombits(v)
+			}
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			consumed = n
+			if num == 13 {
+				raw = math.Float64frombits(v)
+			}
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			consumed = n
+			switch num {
+			case 1:
+				m.Name = string(v)
+			case 15:
+				raw = string(v)
+			case 16:
+				raw = append([]byte(nil), v...)
+			}
+		default:
+			consumed = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if consumed < 0 {
+			return m, errTruncated
+		}
+		b = b[consumed:]
+	}
+	if !m.IsNull {
+		v, err := convert(m.Datatype, raw)
+		if err != nil {
+			return m, fmt.Errorf("metric %q: %w", m.Name, err)
+		}
+		m.Value = v
+	}
+	return m, nil
+}
+
+// convert maps the raw protobuf value to the Go type of the declared datatype.
+// Signed integers are transported as two's complement in the unsigned fields.
+// NaN and ±Inf floats convert to nil, so the metric is left out of readings.
+func convert(datatype uint32, raw interface{}) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	switch v := raw.(type) {
+	case uint64:
+		switch datatype {
+		case TypeInt8:
+			return int64(int8(v)), nil
+		case TypeInt16:
+			return int64(int16(v)), nil
+		case TypeInt32:
+			return int64(int32(v)), nil
+		case TypeInt64:
+			return int64(v), nil
+		case TypeUInt8, TypeUInt16, TypeUInt32, TypeUInt64, TypeDateTime:
+			return v, nil
+		case TypeBoolean:
+			return v != 0, nil
+		}
+		return v, nil
+	case float32:
+		return finite(float64(v)), nil
+	case float64:
+		return finite(v), nil
+	default:
+		return v, nil
+	}
+}
+
+// finite returns f, or nil if it is NaN or ±Inf.
+func finite(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+// RebirthPayload encodes the NCMD payload asking an edge node to resend its
+// birth certificates.
+func RebirthPayload(timestamp uint64) []byte {
+	var metric []byte
+	metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+	metric = protowire.AppendString(metric, "Node Control/Rebirth")
+	metric = protowire.AppendTag(metric, 3, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, timestamp)
+	metric = protowire.AppendTag(metric, 4, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, uint64(TypeBoolean))
+	metric = protowire.AppendTag(metric, 14, protowire.VarintType)
+	metric = protowire.AppendVarint(metric, 1)
+
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.VarintType)
+	out = protowire.AppendVarint(out, timestamp)
+	out = protowire.AppendTag(out, 2, protowire.BytesType)
+	out = protowire.AppendBytes(out, metric)
+	return out
+}
@@ -0,0 +1,242 @@
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/metrics"
+	"github.com/your-username/iot-edge-gateway/internal/reading"
+)
+
+// Namespace is the topic namespace of Sparkplug B messages.
+const Namespace = "spBv1.0"
+
+// rebirthInterval limits how often a rebirth is requested from the same node.
+const rebirthInterval = 10 * time.Second
+
+// Topic is a parsed Sparkplug B topic:
+// spBv1.0/<group>/<message type>/<edge node>[/<device>].
+type Topic struct {
+	Group  string
+	Type   string
+	Node   string
+	Device string
+}
+
+// IsTopic reports whether topic is in the Sparkplug B namespace.
+func IsTopic(topic string) bool {
+	return strings.HasPrefix(topic, Namespace+"/")
+}
+
+// ParseTopic splits a Sparkplug B topic into its parts.
+func ParseTopic(topic string) (Topic, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != Namespace {
+		return Topic{}, fmt.Errorf("not a sparkplug topic: %s", topic)
+	}
+	t := Topic{Group: parts[1], Type: parts[2], Node: parts[3]}
+	if len(parts) == 5 {
+		t.Device = parts[4]
+	}
+	return t, nil
+}
+
+// Result is the outcome of handling one Sparkplug message.
+type Result struct {
+	Readings []reading.Reading
+	// Rebirth is the NCMD topic to publish RebirthPayload on, or empty.
+	Rebirth string
+}
+
+type node struct {
+	online      bool
+	aliases     map[uint64]string
+	devices     map[string]*device
+	lastRebirth time.Time
+}
+
+type device struct {
+	online  bool
+	aliases map[uint64]string
+}
+
+// Tracker follows the lifecycle of Sparkplug edge nodes and devices. It keeps
+// the alias tables announced in BIRTH certificates so that DATA messages
+// using aliases can be decoded, and asks nodes to rebirth when it sees data it
+// cannot resolve.
+type Tracker struct {
+	mu    sync.Mutex
+	nodes map[string]*node
+	now   func() time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{nodes: make(map[string]*node), now: time.Now}
+}
+
+// Online reports whether the node (device == "") or device is currently online.
+func (t *Tracker) Online(group, edgeNode, dev string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.nodes[group+"/"+edgeNode]
+	if n == nil || !n.online {
+		return false
+	}
+	if dev == "" {
+		return true
+	}
+	d := n.devices[dev]
+	return d != nil && d.online
+}
+
+// Handle processes a message received on a Sparkplug topic.
+func (t *Tracker) Handle(topic string, payload []byte) (Result, error) {
+	tp, err := ParseTopic(topic)
+	if err != nil {
+		return Result{}, err
+	}
+	switch tp.Type {
+	case "NBIRTH", "NDEATH", "DBIRTH", "DDEATH", "NDATA", "DDATA":
+	default:
+		// commands and host STATE messages carry no telemetry
+		return Result{}, nil
+	}
+	p, err := DecodePayload(payload)
+	if err != nil {
+		return Result{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := tp.Group + "/" + tp.Node
+	n := t.nodes[key]
+	var res Result
+	needRebirth := false
+
+	switch tp.Type {
+	case "NBIRTH":
+		n = &node{online: true, aliases: make(map[uint64]string), devices: make(map[string]*device)}
+		t.nodes[key] = n
+		learn(n.aliases, p.Metrics)
+		t.setOnline(tp, true)
+	case "NDEATH":
+		if n != nil {
+			n.online = false
+			for name, d := range n.devices {
+				d.online = false
+				t.setOnline(Topic{Group: tp.Group, Node: tp.Node, Device: name}, false)
+			}
+		}
+		t.setOnline(tp, false)
+		return res, nil
+	case "DBIRTH":
+		if n == nil || !n.online {
+			needRebirth = true
+			break
+		}
+		d := &device{online: true, aliases: make(map[uint64]string)}
+		n.devices[tp.Device] = d
+		learn(d.aliases, p.Metrics)
+		t.setOnline(tp, true)
+	case "DDEATH":
+		if n != nil {
+			if d := n.devices[tp.Device]; d != nil {
+				d.online = false
+			}
+		}
+		t.setOnline(tp, false)
+		return res, nil
+	case "NDATA", "DDATA":
+		if n == nil || !n.online {
+			needRebirth = true
+			break
+		}
+		if tp.Type == "DDATA" {
+			if d := n.devices[tp.Device]; d == nil || !d.online {
+				needRebirth = true
+			}
+		}
+	}
+
+	if n != nil && n.online {
+		r, unknown := t.toReading(tp, n, p)
+		needRebirth = needRebirth || unknown
+		if len(r.Fields) > 0 {
+			res.Readings = append(res.Readings, r)
+		}
+	}
+	if needRebirth {
+		if n == nil {
+			n = &node{aliases: make(map[uint64]string), devices: make(map[string]*device)}
+			t.nodes[key] = n
+		}
+		if now := t.now(); now.Sub(n.lastRebirth) >= rebirthInterval {
+			n.lastRebirth = now
+			res.Rebirth = strings.Join([]string{Namespace, tp.Group, "NCMD", tp.Node}, "/")
+		}
+	}
+	return res, nil
+}
+
+// toReading resolves metric names and builds a reading. unknown reports
+// whether a metric referenced an alias that no BIRTH certificate announced.
+func (t *Tracker) toReading(tp Topic, n *node, p *Payload) (reading.Reading, bool) {
+	measurement := tp.Node
+	tags := map[string]string{"group": tp.Group, "edge_node": tp.Node, "message_type": tp.Type}
+	var devAliases map[uint64]string
+	if tp.Device != "" {
+		measurement = tp.Device
+		tags["device"] = tp.Device
+		if d := n.devices[tp.Device]; d != nil {
+			devAliases = d.aliases
+		}
+	}
+	ts := t.now().UTC()
+	if p.Timestamp > 0 {
+		ts = time.UnixMilli(int64(p.Timestamp)).UTC()
+	}
+	r := reading.Reading{
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      make(map[string]interface{}),
+		Timestamp:   ts,
+	}
+	unknown := false
+	for _, m := range p.Metrics {
+		name := m.Name
+		if name == "" && m.HasAlias {
+			if v, ok := devAliases[m.Alias]; ok {
+				name = v
+			} else if v, ok := n.aliases[m.Alias]; ok {
+				name = v
+			}
+		}
+		if name == "" {
+			unknown = true
+			continue
+		}
+		if m.IsNull || m.Value == nil {
+			continue
+		}
+		r.Fields[name] = m.Value
+	}
+	return r, unknown
+}
+
+func learn(aliases map[uint64]string, ms []Metric) {
+	for _, m := range ms {
+		if m.HasAlias && m.Name != "" {
+			aliases[m.Alias] = m.Name
+		}
+	}
+}
+
+func (t *Tracker) setOnline(tp Topic, online bool) {
+	v := 0.0
+	if online {
+		v = 1
+	}
+	metrics.SparkplugOnline.WithLabelValues(tp.Group, tp.Node, tp.Device).Set(v)
+}
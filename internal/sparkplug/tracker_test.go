@@ -0,0 +1,177 @@
+package sparkplug
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testMetric struct {
+	name     string
+	alias    uint64
+	datatype uint32
+	value    interface{}
+}
+
+func encode(ts uint64, ms ...testMetric) []byte {
+	var out []byte
+	out = protowire.AppendTag(out, 1, protowire.VarintType)
+	out = protowire.AppendVarint(out, ts)
+	for _, m := range ms {
+		var b []byte
+		if m.name != "" {
+			b = protowire.AppendTag(b, 1, protowire.BytesType)
+			b = protowire.AppendString(b, m.name)
+		}
+		if m.alias != 0 {
+			b = protowire.AppendTag(b, 2, protowire.VarintType)
+			b = protowire.AppendVarint(b, m.alias)
+		}
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.datatype))
+		switch v := m.value.(type) {
+		case int32:
+			b = protowire.AppendTag(b, 10, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(uint32(v)))
+		case float64:
+			b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+			b = protowire.AppendFixed64(b, math.Float64bits(v))
+		case bool:
+			b = protowire.AppendTag(b, 14, protowire.VarintType)
+			b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+		case string:
+			b = protowire.AppendTag(b, 15, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		}
+		out = protowire.AppendTag(out, 2, protowire.BytesType)
+		out = protowire.AppendBytes(out, b)
+	}
+	return out
+}
+
+func TestTrackerResolvesAliasesFromBirth(t *testing.T) {
+	tr := NewTracker()
+
+	res, err := tr.Handle("spBv1.0/plant/NBIRTH/edge1", encode(1000,
+		testMetric{name: "Node Control/Rebirth", alias: 1, datatype: TypeBoolean, value: false},
+	))
+	if err != nil || res.Rebirth != "" {
+		t.Fatalf("nbirth: err=%v rebirth=%q", err, res.Rebirth)
+	}
+	if _, err := tr.Handle("spBv1.0/plant/DBIRTH/edge1/pump", encode(1000,
+		testMetric{name: "temperature", alias: 10, datatype: TypeDouble, value: 20.5},
+		testMetric{name: "offset", alias: 11, datatype: TypeInt32, value: int32(-3)},
+	)); err != nil {
+		t.Fatalf("dbirth: %v", err)
+	}
+	if !tr.Online("plant", "edge1", "pump") {
+		t.Fatalf("expected device online after DBIRTH")
+	}
+
+	res, err = tr.Handle("spBv1.0/plant/DDATA/edge1/pump", encode(2000,
+		testMetric{alias: 10, datatype: TypeDouble, value: 21.0},
+		testMetric{alias: 11, datatype: TypeInt32, value: int32(-5)},
+	))
+	if err != nil {
+		t.Fatalf("ddata: %v", err)
+	}
+	if len(res.Readings) != 1 || res.Rebirth != "" {
+		t.Fatalf("expected one reading and no rebirth, got %+v", res)
+	}
+	r := res.Readings[0]
+	if r.Measurement != "pump" || r.Fields["temperature"] != 21.0 || r.Fields["offset"] != int64(-5) {
+		t.Fatalf("unexpected reading: %+v", r)
+	}
+	if !r.Timestamp.Equal(time.UnixMilli(2000)) {
+		t.Fatalf("unexpected timestamp: %v", r.Timestamp)
+	}
+
+	if _, err := tr.Handle("spBv1.0/plant/DDEATH/edge1/pump", encode(3000)); err != nil {
+		t.Fatalf("ddeath: %v", err)
+	}
+	if tr.Online("plant", "edge1", "pump") || !tr.Online("plant", "edge1", "") {
+		t.Fatalf("expected device offline and node online after DDEATH")
+	}
+	if _, err := tr.Handle("spBv1.0/plant/NDEATH/edge1", encode(3000)); err != nil {
+		t.Fatalf("ndeath: %v", err)
+	}
+	if tr.Online("plant", "edge1", "") {
+		t.Fatalf("expected node offline after NDEATH")
+	}
+}
+
+func TestTrackerSkipsNonFiniteFloats(t *testing.T) {
+	tr := NewTracker()
+
+	if _, err := tr.Handle("spBv1.0/plant/NBIRTH/edge1", encode(1000)); err != nil {
+		t.Fatalf("nbirth: %v", err)
+	}
+	if _, err := tr.Handle("spBv1.0/plant/DBIRTH/edge1/pump", encode(1000)); err != nil {
+		t.Fatalf("dbirth: %v", err)
+	}
+	res, err := tr.Handle("spBv1.0/plant/DDATA/edge1/pump", encode(2000,
+		testMetric{name: "temperature", datatype: TypeDouble, value: math.NaN()},
+		testMetric{name: "flow", datatype: TypeDouble, value: math.Inf(1)},
+		testMetric{name: "pressure", datatype: TypeDouble, value: 1.5},
+	))
+	if err != nil {
+		t.Fatalf("ddata: %v", err)
+	}
+	if len(res.Readings) != 1 {
+		t.Fatalf("expected one reading, got %+v", res)
+	}
+	r := res.Readings[0]
+	if len(r.Fields) != 1 || r.Fields["pressure"] != 1.5 {
+		t.Fatalf("expected only pressure, got %+v", r.Fields)
+	}
+	if _, err := r.Marshal(); err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+}
+
+func TestTrackerRequestsRebirth(t *testing.T) {
+	tr := NewTracker()
+	now := time.Unix(100, 0)
+	tr.now = func() time.Time { return now }
+
+	// data from a node we never saw a birth for
+	res, err := tr.Handle("spBv1.0/plant/NDATA/edge2", encode(0, testMetric{alias: 5, datatype: TypeDouble, value: 1.0}))
+	if err != nil {
+		t.Fatalf("ndata: %v", err)
+	}
+	if res.Rebirth != "spBv1.0/plant/NCMD/edge2" {
+		t.Fatalf("expected rebirth request, got %q", res.Rebirth)
+	}
+	// requests are rate limited
+	res, _ = tr.Handle("spBv1.0/plant/NDATA/edge2", encode(0, testMetric{alias: 5, datatype: TypeDouble, value: 1.0}))
+	if res.Rebirth != "" {
+		t.Fatalf("expected rate limited rebirth")
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := tr.Handle("spBv1.0/plant/NBIRTH/edge2", encode(0, testMetric{name: "a", alias: 5, datatype: TypeString, value: "x"})); err != nil {
+		t.Fatalf("nbirth: %v", err)
+	}
+	res, _ = tr.Handle("spBv1.0/plant/NDATA/edge2", encode(0,
+		testMetric{alias: 5, datatype: TypeString, value: "y"},
+		testMetric{alias: 99, datatype: TypeBoolean, value: true},
+	))
+	if res.Rebirth == "" {
+		t.Fatalf("expected rebirth for unknown alias")
+	}
+	if len(res.Readings) != 1 || res.Readings[0].Fields["a"] != "y" {
+		t.Fatalf("expected known metrics to still be decoded, got %+v", res.Readings)
+	}
+}
+
+func TestRebirthPayloadDecodes(t *testing.T) {
+	p, err := DecodePayload(RebirthPayload(42))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(p.Metrics) != 1 || p.Metrics[0].Name != "Node Control/Rebirth" || p.Metrics[0].Value != true {
+		t.Fatalf("unexpected rebirth payload: %+v", p)
+	}
+}
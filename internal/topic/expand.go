@@ -0,0 +1,50 @@
+package topic
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Expand substitutes the placeholders of tmpl: {topic} is the source topic
+// src and {topic:N} its N-th level, counted from 0. Other names are resolved
+// by lookup, which may be nil when there are none. Each value is passed
+// through escape, if it is not nil, before it is inserted. Expand fails when
+// a placeholder cannot be resolved to a non-empty value or is not closed.
+func Expand(tmpl, src string, lookup func(name string) (string, bool), escape func(string) string) (string, bool) {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			b.WriteString(tmpl)
+			return b.String(), true
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			return "", false
+		}
+		b.WriteString(tmpl[:open])
+		name := tmpl[open+1 : open+end]
+		tmpl = tmpl[open+end+1:]
+
+		var v string
+		var ok bool
+		switch {
+		case name == "topic":
+			v, ok = src, true
+		case strings.HasPrefix(name, "topic:"):
+			levels := strings.Split(src, "/")
+			if n, err := strconv.Atoi(name[len("topic:"):]); err == nil && n >= 0 && n < len(levels) {
+				v, ok = levels[n], true
+			}
+		case lookup != nil:
+			v, ok = lookup(name)
+		}
+		if !ok || v == "" {
+			return "", false
+		}
+		if escape != nil {
+			v = escape(v)
+		}
+		b.WriteString(v)
+	}
+}
@@ -0,0 +1,24 @@
+// Package topic implements MQTT topic filter matching, which is also used to
+// select messages by the topic they were submitted under.
+package topic
+
+import "strings"
+
+// Match reports whether topic matches the filter. "+" matches one level and a
+// trailing "#" matches any number of levels, including none.
+func Match(filter, topic string) bool {
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) {
+			return false
+		}
+		if f != "+" && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
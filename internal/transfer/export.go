@@ -0,0 +1,62 @@
+package transfer
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+)
+
+// exportBatch is how many messages are read from the buffer at a time.
+const exportBatch = 500
+
+// ExportOptions select the messages to export.
+type ExportOptions struct {
+	// Origin identifies the exporting gateway; importers deduplicate by it.
+	Origin string
+	// Since and Until limit the export to messages created at or after Since
+	// and before Until. Zero values leave the range open.
+	Since, Until time.Time
+}
+
+// Export writes the unsent messages of b selected by opts to w as an archive
+// and returns their ids.
+func Export(b buffer.Buffer, w io.Writer, opts ExportOptions) ([]int64, error) {
+	sc, ok := b.(buffer.Scanner)
+	if !ok {
+		return nil, errors.New("the buffer backend cannot be exported")
+	}
+	aw, err := NewWriter(w, opts.Origin)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	var after int64
+	for {
+		msgs, err := sc.Scan(after, exportBatch)
+		if err != nil {
+			return nil, err
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		for _, m := range msgs {
+			after = m.ID
+			if !opts.Since.IsZero() && m.CreatedAt.Before(opts.Since) {
+				continue
+			}
+			if !opts.Until.IsZero() && !m.CreatedAt.Before(opts.Until) {
+				continue
+			}
+			if err := aw.Write(m); err != nil {
+				return nil, err
+			}
+			ids = append(ids, m.ID)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
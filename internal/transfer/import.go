@@ -0,0 +1,186 @@
+package transfer
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+)
+
+// importBatch is how many messages are buffered per transaction on import.
+const importBatch = 500
+
+// Ledger records which messages have been imported, by origin gateway and
+// the id the message had there, so importing an archive twice or two
+// overlapping archives does not buffer a message twice.
+type Ledger struct {
+	db *sql.DB
+}
+
+// OpenLedger opens or creates the ledger database at path.
+func OpenLedger(path string) (*Ledger, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS imported (
+		origin TEXT NOT NULL,
+		message_id INTEGER NOT NULL,
+		imported_at INTEGER NOT NULL,
+		PRIMARY KEY (origin, message_id)
+	) WITHOUT ROWID`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Ledger{db: db}, nil
+}
+
+// Close closes the ledger database.
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// seen returns which of ids from origin have been imported before.
+func (l *Ledger) seen(origin string, ids []int64) (map[int64]bool, error) {
+	out := make(map[int64]bool)
+	if len(ids) == 0 {
+		return out, nil
+	}
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, origin)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	q := "SELECT message_id FROM imported WHERE origin = ? AND message_id IN (?" + strings.Repeat(",?", len(ids)-1) + ")"
+	rows, err := l.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out[id] = true
+	}
+	return out, rows.Err()
+}
+
+// record marks ids from origin as imported.
+func (l *Ledger) record(origin string, ids []int64) error {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO imported(origin, message_id, imported_at) VALUES (?, ?, ?)", origin, id, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Verify reads the whole archive in r and checks its checksums.
+func Verify(r io.Reader) (Header, int, error) {
+	ar, err := NewReader(r)
+	if err != nil {
+		return Header{}, 0, err
+	}
+	n := 0
+	for {
+		if _, err := ar.Next(); err == io.EOF {
+			return ar.Header, n, nil
+		} else if err != nil {
+			return ar.Header, n, err
+		}
+		n++
+	}
+}
+
+// ImportFile buffers the messages of the archive at path in b with their
+// original topic, priority and creation time. The archive is verified before
+// anything is buffered. Messages the ledger has seen from the same origin are
+// skipped. It returns how many messages were imported and skipped.
+//
+// A message is recorded in the ledger after it was buffered, so a crash in
+// between can buffer it again on the next import; outputs see it at least
+// once, as with any other message.
+func ImportFile(b buffer.Buffer, l *Ledger, path string) (imported, skipped int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	if _, _, err := Verify(f); err != nil {
+		return 0, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	ar, err := NewReader(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	origin := ar.Header.Origin
+	var batch []buffer.Message
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ids := make([]int64, len(batch))
+		for i, m := range batch {
+			ids[i] = m.ID
+		}
+		seen, err := l.seen(origin, ids)
+		if err != nil {
+			return fmt.Errorf("ledger: %w", err)
+		}
+		msgs := make([]buffer.Message, 0, len(batch))
+		for _, m := range batch {
+			if seen[m.ID] {
+				skipped++
+				continue
+			}
+			seen[m.ID] = true
+			msgs = append(msgs, buffer.Message{Topic: m.Topic, Payload: m.Payload, Priority: m.Priority, CreatedAt: m.CreatedAt})
+		}
+		batch = batch[:0]
+		if len(msgs) == 0 {
+			return nil
+		}
+		if _, err := b.EnqueueBatch(msgs); err != nil {
+			return err
+		}
+		imported += len(msgs)
+		if err := l.record(origin, ids); err != nil {
+			return fmt.Errorf("ledger: %w", err)
+		}
+		return nil
+	}
+	for {
+		m, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, skipped, err
+		}
+		batch = append(batch, m)
+		if len(batch) == importBatch {
+			if err := flush(); err != nil {
+				return imported, skipped, err
+			}
+		}
+	}
+	return imported, skipped, flush()
+}
@@ -0,0 +1,194 @@
+// Package transfer moves buffered messages between gateways as portable
+// archives, e.g. on a USB stick when a gateway has been offline for weeks.
+//
+// An archive is a gzip compressed NDJSON file. The first line is a header
+// naming the gateway the messages come from, each following line holds one
+// message with a CRC-32 of its payload, and the last line is a trailer with
+// the message count and a SHA-256 over all message lines. Archives that are
+// truncated or altered are rejected as a whole.
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+)
+
+const (
+	// Format identifies buffer archives in their header.
+	Format = "iot-edge-gateway/buffer"
+	// Version is the archive version written by Writer.
+	Version = 1
+)
+
+// ErrCorrupt is returned when an archive fails its checksums or is not
+// complete.
+var ErrCorrupt = errors.New("archive corrupt")
+
+// Header is the first line of an archive.
+type Header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Origin  string    `json:"origin"`
+	Created time.Time `json:"created"`
+}
+
+// line is any line after the header: a message or, with End set, the trailer.
+type line struct {
+	ID       int64  `json:"id,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+	Payload  []byte `json:"payload,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// Created is the creation time in Unix seconds, as the buffer keeps it.
+	Created int64  `json:"created_at,omitempty"`
+	CRC32   uint32 `json:"crc32,omitempty"`
+
+	End    bool   `json:"end,omitempty"`
+	Count  int    `json:"count,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Writer writes an archive.
+type Writer struct {
+	zw    *gzip.Writer
+	sum   hash.Hash
+	count int
+}
+
+// NewWriter writes the header of an archive of messages from origin to w.
+func NewWriter(w io.Writer, origin string) (*Writer, error) {
+	if origin == "" {
+		return nil, errors.New("origin gateway id is empty")
+	}
+	aw := &Writer{zw: gzip.NewWriter(w), sum: sha256.New()}
+	if err := aw.writeLine(Header{Format: Format, Version: Version, Origin: origin, Created: time.Now().UTC()}); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Write adds m to the archive.
+func (w *Writer) Write(m buffer.Message) error {
+	l := line{ID: m.ID, Topic: m.Topic, Payload: m.Payload, Priority: m.Priority, CRC32: crc32.ChecksumIEEE(m.Payload)}
+	if !m.CreatedAt.IsZero() {
+		l.Created = m.CreatedAt.Unix()
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w.sum.Write(b)
+	w.count++
+	_, err = w.zw.Write(append(b, '\n'))
+	return err
+}
+
+// Close writes the trailer and flushes the archive. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	err := w.writeLine(line{End: true, Count: w.count, SHA256: hex.EncodeToString(w.sum.Sum(nil))})
+	if cerr := w.zw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *Writer) writeLine(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.zw.Write(append(b, '\n'))
+	return err
+}
+
+// Reader reads an archive and verifies its checksums.
+type Reader struct {
+	Header Header
+
+	br    *bufio.Reader
+	sum   hash.Hash
+	count int
+	done  bool
+}
+
+// NewReader reads the header of the archive in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	ar := &Reader{br: bufio.NewReader(zr), sum: sha256.New()}
+	b, err := ar.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &ar.Header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrCorrupt, err)
+	}
+	if ar.Header.Format != Format {
+		return nil, fmt.Errorf("not a buffer archive")
+	}
+	if ar.Header.Version != Version {
+		return nil, fmt.Errorf("archive version %d is not supported", ar.Header.Version)
+	}
+	if ar.Header.Origin == "" {
+		return nil, fmt.Errorf("%w: header has no origin", ErrCorrupt)
+	}
+	return ar, nil
+}
+
+// Next returns the next message, with the id it had on the origin gateway.
+// It returns io.EOF once the trailer was read and matched the messages.
+func (r *Reader) Next() (buffer.Message, error) {
+	if r.done {
+		return buffer.Message{}, io.EOF
+	}
+	b, err := r.readLine()
+	if err != nil {
+		return buffer.Message{}, err
+	}
+	var l line
+	if err := json.Unmarshal(b, &l); err != nil {
+		return buffer.Message{}, fmt.Errorf("%w: line %d: %v", ErrCorrupt, r.count+2, err)
+	}
+	if l.End {
+		if l.Count != r.count || l.SHA256 != hex.EncodeToString(r.sum.Sum(nil)) {
+			return buffer.Message{}, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+		}
+		r.done = true
+		return buffer.Message{}, io.EOF
+	}
+	r.sum.Write(b)
+	r.count++
+	if crc32.ChecksumIEEE(l.Payload) != l.CRC32 {
+		return buffer.Message{}, fmt.Errorf("%w: message %d: payload checksum mismatch", ErrCorrupt, l.ID)
+	}
+	m := buffer.Message{ID: l.ID, Topic: l.Topic, Payload: l.Payload, Priority: l.Priority}
+	if l.Created != 0 {
+		m.CreatedAt = time.Unix(l.Created, 0)
+	}
+	return m, nil
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	b, err := r.br.ReadBytes('\n')
+	if err == io.EOF && len(b) == 0 || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w: archive ends before its trailer", ErrCorrupt)
+	}
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return bytes.TrimSuffix(b, []byte("\n")), nil
+}
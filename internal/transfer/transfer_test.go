@@ -0,0 +1,145 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/buffer"
+)
+
+func openStore(t *testing.T) *buffer.Store {
+	t.Helper()
+	s, err := buffer.Init(filepath.Join(t.TempDir(), "buffer.db"))
+	if err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestExportImport(t *testing.T) {
+	src := openStore(t)
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	var msgs []buffer.Message
+	for i := 0; i < 1200; i++ {
+		msgs = append(msgs, buffer.Message{Topic: fmt.Sprintf("sensors/%d", i%3), Payload: []byte(fmt.Sprintf(`{"v":%d}`, i)), Priority: i % 2, CreatedAt: old})
+	}
+	ids, err := src.EnqueueBatch(msgs)
+	if err != nil {
+		t.Fatalf("EnqueueBatch: %v", err)
+	}
+	if err := src.MarkSent(ids[:100]); err != nil {
+		t.Fatalf("MarkSent: %v", err)
+	}
+	if _, err := src.EnqueueTopic("new", []byte("recent")); err != nil {
+		t.Fatalf("EnqueueTopic: %v", err)
+	}
+
+	var archive bytes.Buffer
+	exported, err := Export(src, &archive, ExportOptions{Origin: "gw-01", Until: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if len(exported) != 1100 || exported[0] != ids[100] {
+		t.Fatalf("exported %d messages from %d, want the 1100 unsent old ones", len(exported), exported[0])
+	}
+	path := filepath.Join(t.TempDir(), "gw-01.ndjson.gz")
+	if err := os.WriteFile(path, archive.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := openStore(t)
+	ledger, err := OpenLedger(filepath.Join(t.TempDir(), "imported.db"))
+	if err != nil {
+		t.Fatalf("OpenLedger: %v", err)
+	}
+	defer ledger.Close()
+	imported, skipped, err := ImportFile(dst, ledger, path)
+	if err != nil || imported != 1100 || skipped != 0 {
+		t.Fatalf("ImportFile = %d, %d, %v; want 1100 imported", imported, skipped, err)
+	}
+	got, err := dst.Scan(0, 1)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Scan = %v, %v", got, err)
+	}
+	want := msgs[100]
+	if got[0].Topic != want.Topic || string(got[0].Payload) != string(want.Payload) || got[0].Priority != want.Priority || !got[0].CreatedAt.Equal(old) {
+		t.Fatalf("imported %+v, want %+v", got[0], want)
+	}
+
+	// importing again buffers nothing
+	imported, skipped, err = ImportFile(dst, ledger, path)
+	if err != nil || imported != 0 || skipped != 1100 {
+		t.Fatalf("second ImportFile = %d, %d, %v; want 1100 skipped", imported, skipped, err)
+	}
+	if n, _ := dst.CountUnsent(); n != 1100 {
+		t.Fatalf("CountUnsent = %d, want 1100", n)
+	}
+}
+
+func TestImportRejectsDamagedArchive(t *testing.T) {
+	src := openStore(t)
+	for i := 0; i < 10; i++ {
+		if _, err := src.EnqueueTopic("t", []byte(fmt.Sprintf("m%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if _, err := Export(src, &archive, ExportOptions{Origin: "gw-01"}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	cases := map[string][]byte{
+		"truncated": archive.Bytes()[:archive.Len()/2],
+		"tampered":  tamper(t, archive.Bytes()),
+	}
+	for name, data := range cases {
+		path := filepath.Join(t.TempDir(), name+".ndjson.gz")
+		os.WriteFile(path, data, 0o644)
+		dst := openStore(t)
+		ledger, err := OpenLedger(filepath.Join(t.TempDir(), "imported.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = ImportFile(dst, ledger, path)
+		ledger.Close()
+		if !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%s: ImportFile error = %v, want ErrCorrupt", name, err)
+		}
+		if n, _ := dst.CountUnsent(); n != 0 {
+			t.Fatalf("%s: %d messages buffered from a damaged archive", name, n)
+		}
+	}
+}
+
+// tamper changes one payload in the archive and leaves the checksums as they
+// were.
+func tamper(t *testing.T, data []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m3 := base64.StdEncoding.EncodeToString([]byte("m3"))
+	m4 := base64.StdEncoding.EncodeToString([]byte("m4"))
+	if !bytes.Contains(plain, []byte(m3)) {
+		t.Fatalf("archive does not contain %s", m3)
+	}
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	zw.Write(bytes.Replace(plain, []byte(m3), []byte(m4), 1))
+	zw.Close()
+	return out.Bytes()
+}
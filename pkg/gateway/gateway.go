@@ -0,0 +1,65 @@
+// Package gateway exposes the gateway's command line entry point so that
+// programs linking additional sources or sinks (see pkg/plugin) can run the
+// same binary logic as cmd/gateway.
+package gateway
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/your-username/iot-edge-gateway/internal/config"
+	"github.com/your-username/iot-edge-gateway/internal/logger"
+	"github.com/your-username/iot-edge-gateway/internal/server"
+)
+
+// Main parses the command line flags, runs the gateway and returns once it
+// was stopped by SIGINT or SIGTERM. "export" and "import" as the first
+// argument run the buffer transfer commands instead.
+func Main() {
+	if len(os.Args) > 1 {
+		var run func([]string) error
+		switch os.Args[1] {
+		case "export":
+			run = runExport
+		case "import":
+			run = runImport
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+	cfgPath := flag.String("config", "config/config.yaml", "Path to config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		log.Fatalf("failed loading config: %v", err)
+	}
+
+	logger.Init(cfg.Logging.Level, cfg.Logging.Output, cfg.Logging.File)
+	defer logger.Sync()
+
+	s, err := server.New(cfg)
+	if err != nil {
+		log.Fatalf("failed creating server: %v", err)
+	}
+
+	// graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		if err := s.Start(); err != nil {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	<-stop
+	s.Stop()
+}
@@ -0,0 +1,152 @@
+package gateway
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/your-username/iot-edge-gateway/internal/config"
+	"github.com/your-username/iot-edge-gateway/internal/server"
+	"github.com/your-username/iot-edge-gateway/internal/transfer"
+)
+
+// runExport implements "gateway export": it writes the unsent buffered
+// messages to an archive that "gateway import" reads on another gateway. Both
+// commands open the buffer directly, so the gateway must be stopped first.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	cfgPath := fs.String("config", "config/config.yaml", "Path to config file")
+	out := fs.String("o", "", "Archive to write, e.g. /media/usb/gw01.ndjson.gz")
+	since := fs.String("since", "", "Only export messages created at or after this time (RFC 3339 or YYYY-MM-DD)")
+	until := fs.String("until", "", "Only export messages created before this time (RFC 3339 or YYYY-MM-DD)")
+	origin := fs.String("gateway-id", "", "Id of this gateway recorded in the archive (default: host name)")
+	markSent := fs.Bool("mark-sent", false, "Mark the exported messages as sent so outputs do not deliver them too")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s export -o FILE [flags]\n\nStop the gateway before exporting.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *out == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := transfer.ExportOptions{Origin: *origin}
+	var err error
+	if opts.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("-since: %w", err)
+	}
+	if opts.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("-until: %w", err)
+	}
+	if opts.Origin == "" {
+		if opts.Origin, err = os.Hostname(); err != nil {
+			return fmt.Errorf("gateway id required: %w", err)
+		}
+	}
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed loading config: %w", err)
+	}
+	store, err := server.OpenDiskBuffer(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	// write next to the target and rename once complete, so an interrupted
+	// export never leaves an archive that looks usable
+	f, err := os.CreateTemp(filepath.Dir(*out), filepath.Base(*out)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	ids, err := transfer.Export(store, f, opts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), *out)
+	}
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	fmt.Printf("exported %d message(s) from %s to %s\n", len(ids), opts.Origin, *out)
+
+	if *markSent && len(ids) > 0 {
+		if err := store.MarkSent(ids); err != nil {
+			return fmt.Errorf("mark sent: %w", err)
+		}
+		if _, err := store.PurgeSent(); err != nil {
+			return fmt.Errorf("purge sent: %w", err)
+		}
+		fmt.Printf("marked %d message(s) as sent\n", len(ids))
+	}
+	return nil
+}
+
+// runImport implements "gateway import": it buffers the messages of archives
+// written by "gateway export", skipping those imported before.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	cfgPath := fs.String("config", "config/config.yaml", "Path to config file")
+	ledgerPath := fs.String("ledger", "", "Database of imported messages (default: imported.db next to the buffer)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s import [flags] ARCHIVE...\n\nStop the gateway before importing.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		return fmt.Errorf("failed loading config: %w", err)
+	}
+	if *ledgerPath == "" {
+		bufPath := "./data/buffer"
+		if v, ok := cfg.Buffer["path"].(string); ok && v != "" {
+			bufPath = v
+		}
+		*ledgerPath = filepath.Join(filepath.Dir(bufPath), "imported.db")
+	}
+	store, err := server.OpenDiskBuffer(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ledger, err := transfer.OpenLedger(*ledgerPath)
+	if err != nil {
+		return fmt.Errorf("ledger: %w", err)
+	}
+	defer ledger.Close()
+
+	for _, path := range fs.Args() {
+		imported, skipped, err := transfer.ImportFile(store, ledger, path)
+		if err != nil {
+			return fmt.Errorf("%s: %w (imported %d message(s) before the error)", path, err, imported)
+		}
+		fmt.Printf("%s: imported %d message(s), skipped %d already imported\n", path, imported, skipped)
+	}
+	return nil
+}
+
+// parseTime parses an RFC 3339 time or a date in local time. An empty string
+// is the zero time.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
@@ -0,0 +1,308 @@
+// Package plugin defines the interfaces between the gateway core and its
+// inputs (sources) and outputs (sinks), and a registry that constructs them
+// from configuration entries by type.
+//
+// Third-party packages register their own types from an init function and are
+// linked into a custom main package that calls gateway.Main:
+//
+//	func init() {
+//		plugin.RegisterSink("historian", func(cfg plugin.Config) (plugin.Sink, error) {
+//			...
+//		})
+//	}
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+var (
+	// ErrBufferFull is returned by Ingester.Submit when the buffer has reached
+	// its size limit. Sources should ask senders to retry later.
+	ErrBufferFull = errors.New("buffer full")
+	// ErrUnavailable is returned by Ingester.Submit when the buffer cannot
+	// accept writes.
+	ErrUnavailable = errors.New("buffer unavailable")
+)
+
+// Ingester accepts data produced by a source. It is implemented by the
+// gateway's processing pipeline, which runs the processor and writes the
+// results to the local buffer.
+type Ingester interface {
+	// Submit processes a payload received on topic. Inputs that have no
+	// native topic use a virtual one from their configuration.
+	Submit(topic string, payload []byte) error
+	// Full reports whether the buffer has reached its size limit, so sources
+	// can push back on senders before reading a request.
+	Full() bool
+}
+
+// Message priorities. Buffered messages with a higher priority are delivered
+// first; any integer may be used, these are the named levels.
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// ParsePriority converts a priority name ("low", "normal", "high") or an
+// integer to a priority. An empty string is PriorityNormal.
+func ParsePriority(s string) (int, error) {
+	switch s {
+	case "", "normal":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown priority %q", s)
+	}
+	return n, nil
+}
+
+// PriorityIngester is implemented by ingesters that accept a priority with
+// the payload, such as the gateway's pipeline. Sources configured with a
+// priority use it when available; processor rules may still override it.
+type PriorityIngester interface {
+	Ingester
+	SubmitPriority(topic string, payload []byte, priority int) error
+}
+
+// BatchIngester is implemented by ingesters that buffer several payloads in
+// one step, such as the gateway's pipeline. Either all payloads are buffered
+// or none is, so a sender whose request was rejected can resend it whole.
+type BatchIngester interface {
+	Ingester
+	SubmitBatch(topic string, payloads [][]byte) error
+}
+
+// Source is an input such as an MQTT subscription or an HTTP listener.
+type Source interface {
+	// Start connects or binds and begins submitting data; it must not block.
+	Start() error
+	Close()
+}
+
+// Sink is an output the forwarder delivers buffered messages to.
+type Sink interface {
+	// Produce delivers one payload and returns nil once the receiving side
+	// has confirmed it, or an error after timeout.
+	Produce(payload []byte, timeout time.Duration) error
+	Close()
+}
+
+// TopicSink is implemented by sinks that use the topic a message was
+// submitted under, for example to route it. The forwarder calls ProduceTopic
+// instead of Produce when a sink implements it.
+type TopicSink interface {
+	Sink
+	ProduceTopic(topic string, payload []byte, timeout time.Duration) error
+}
+
+// Message is a buffered message handed to a BatchSink. ID is its buffer id,
+// which increases with every message; Time is when it was buffered.
+type Message struct {
+	ID      int64
+	Topic   string
+	Payload []byte
+	Time    time.Time
+}
+
+// BatchSink is implemented by sinks that deliver several messages at once,
+// such as one HTTP request per batch. The forwarder calls ProduceBatch with at
+// most BatchSize messages instead of calling Produce for each.
+type BatchSink interface {
+	Sink
+	BatchSize() int
+	// ProduceBatch delivers msgs as one unit: nil means all of them were
+	// confirmed, an error that none are considered delivered.
+	ProduceBatch(msgs []Message, timeout time.Duration) error
+}
+
+// Accumulator is implemented by batch sinks that collect messages into large
+// units delivered on size or age thresholds, such as archive files. Messages
+// stay pending in the buffer until their unit has been delivered.
+type Accumulator interface {
+	BatchSink
+	// Take is given the pending messages, oldest first, and returns how many
+	// of them form the next unit to deliver, or 0 to wait for more.
+	Take(msgs []Message) int
+}
+
+// permanentError marks a failure that retrying will not fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err to tell the forwarder that the receiving side rejected
+// the message and retrying is pointless, e.g. an HTTP 400. The forwarder
+// drops such messages instead of blocking the buffer on them.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+// retryAfterError carries the delay the receiving side asked for.
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter wraps a retriable err with the delay the receiving side asked
+// for, such as an HTTP Retry-After header. The forwarder waits at least that
+// long before the next attempt.
+func RetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryAfterError{err: err, after: d}
+}
+
+// RetryDelay returns the delay attached to err by RetryAfter.
+func RetryDelay(err error) (time.Duration, bool) {
+	var re *retryAfterError
+	if errors.As(err, &re) {
+		return re.after, true
+	}
+	return 0, false
+}
+
+// Config is one entry of the inputs or outputs list. The "type" key selects
+// the factory; all other keys are passed to it unchanged.
+type Config map[string]interface{}
+
+// Type returns the entry's type.
+func (c Config) Type() string {
+	return fmt.Sprint(c["type"])
+}
+
+// Name returns the entry's name, defaulting to its type.
+func (c Config) Name() string {
+	if v, ok := c["name"]; ok && fmt.Sprint(v) != "" {
+		return fmt.Sprint(v)
+	}
+	return c.Type()
+}
+
+// Decode fills out, a pointer to a struct with mapstructure tags, from the
+// entry. Values are converted weakly (e.g. "5" to 5) and duration strings
+// such as "500ms" are accepted for time.Duration fields.
+func (c Config) Decode(out interface{}) error {
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+	return dec.Decode(map[string]interface{}(c))
+}
+
+// SourceFactory constructs a source from its configuration entry.
+type SourceFactory func(cfg Config, in Ingester) (Source, error)
+
+// SinkFactory constructs a sink from its configuration entry.
+type SinkFactory func(cfg Config) (Sink, error)
+
+var (
+	mu      sync.RWMutex
+	sources = make(map[string]SourceFactory)
+	sinks   = make(map[string]SinkFactory)
+)
+
+// RegisterSource makes a source type available to configuration. It panics if
+// the type is registered twice.
+func RegisterSource(typ string, f SourceFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if f == nil {
+		panic("plugin: RegisterSource factory is nil")
+	}
+	if _, dup := sources[typ]; dup {
+		panic("plugin: RegisterSource called twice for type " + typ)
+	}
+	sources[typ] = f
+}
+
+// RegisterSink makes a sink type available to configuration. It panics if the
+// type is registered twice.
+func RegisterSink(typ string, f SinkFactory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if f == nil {
+		panic("plugin: RegisterSink factory is nil")
+	}
+	if _, dup := sinks[typ]; dup {
+		panic("plugin: RegisterSink called twice for type " + typ)
+	}
+	sinks[typ] = f
+}
+
+// NewSource constructs the source described by cfg.
+func NewSource(cfg Config, in Ingester) (Source, error) {
+	mu.RLock()
+	f, ok := sources[cfg.Type()]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown input type %q", cfg.Type())
+	}
+	return f(cfg, in)
+}
+
+// NewSink constructs the sink described by cfg.
+func NewSink(cfg Config) (Sink, error) {
+	mu.RLock()
+	f, ok := sinks[cfg.Type()]
+	mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown output type %q", cfg.Type())
+	}
+	return f(cfg)
+}
+
+// SourceTypes returns the registered source types, sorted.
+func SourceTypes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]string, 0, len(sources))
+	for t := range sources {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SinkTypes returns the registered sink types, sorted.
+func SinkTypes() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	out := make([]string, 0, len(sinks))
+	for t := range sinks {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+type nopSink struct{ topic string }
+
+func (s *nopSink) Produce([]byte, time.Duration) error { return nil }
+func (s *nopSink) Close()                              {}
+
+// unregisterSink removes a type registered by a test, so the test can run
+// again in the same process.
+func unregisterSink(typ string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(sinks, typ)
+}
+
+func TestRegistryConstructsByType(t *testing.T) {
+	t.Cleanup(func() { unregisterSink("test-nop") })
+	RegisterSink("test-nop", func(cfg Config) (Sink, error) {
+		var c struct {
+			Topic   string        `mapstructure:"topic"`
+			Timeout time.Duration `mapstructure:"timeout"`
+			Retries int           `mapstructure:"retries"`
+		}
+		if err := cfg.Decode(&c); err != nil {
+			return nil, err
+		}
+		if c.Timeout != 500*time.Millisecond || c.Retries != 3 {
+			t.Fatalf("unexpected decode: %+v", c)
+		}
+		return &nopSink{topic: c.Topic}, nil
+	})
+
+	sink, err := NewSink(Config{"type": "test-nop", "topic": "x", "timeout": "500ms", "retries": "3"})
+	if err != nil {
+		t.Fatalf("new sink: %v", err)
+	}
+	if sink.(*nopSink).topic != "x" {
+		t.Fatalf("factory did not receive config")
+	}
+	if _, err := NewSink(Config{"type": "missing"}); err == nil {
+		t.Fatalf("expected error for unknown type")
+	}
+	found := false
+	for _, typ := range SinkTypes() {
+		found = found || typ == "test-nop"
+	}
+	if !found {
+		t.Fatalf("registered type not listed")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic on duplicate registration")
+		}
+	}()
+	RegisterSink("test-nop", func(Config) (Sink, error) { return nil, nil })
+}
+
+func TestConfigName(t *testing.T) {
+	if n := (Config{"type": "kafka"}).Name(); n != "kafka" {
+		t.Fatalf("expected name to default to type, got %q", n)
+	}
+	if n := (Config{"type": "kafka", "name": "cloud"}).Name(); n != "cloud" {
+		t.Fatalf("expected configured name, got %q", n)
+	}
+}